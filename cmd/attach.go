@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var attachCmd = &cobra.Command{
+	Use:   "attach <vm-id>",
+	Short: "Open an interactive shell in a running microVM",
+	Long: `Open an interactive shell in a running microVM (see 'sear ps'). The VM
+keeps running when the shell exits.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return attachVM(args[0])
+	},
+}
+
+func attachVM(id string) error {
+	cfg, err := loadTrustedConfig()
+	if err != nil {
+		return err
+	}
+
+	vmInstance, err := openVM(id)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := vmInstance.Stop(); err != nil {
+			logrus.Errorf("Error releasing VM: %v", err)
+		}
+	}()
+
+	sshClient, err := vmInstance.GetSSHClient()
+	if err != nil {
+		return fmt.Errorf("failed to create SSH client: %w", err)
+	}
+
+	forwardAgent(cfg, sshClient)
+
+	result, err := sshClient.Shell()
+	if err != nil {
+		return fmt.Errorf("shell session failed: %w", err)
+	}
+	if !result.Success() {
+		return exitCode(result)
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/nikiskaarup/sear/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+var balloonCmd = &cobra.Command{
+	Use:   "balloon <vm-id> <MiB>",
+	Short: "Set the memory reclaimed from a microVM by its balloon",
+	Long: `Inflate or deflate the memory balloon of a running microVM, so that the
+given amount of guest memory is returned to the host. The profile must
+configure a balloon device:
+
+  vm:
+    balloon:
+      target_mib: 0
+      deflate_on_oom: true
+      stats_interval: 5s
+
+Use 'sear stats' to see how much memory the guest actually gave up.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		mib, err := strconv.Atoi(args[1])
+		if err != nil || mib < 0 {
+			return fmt.Errorf("invalid balloon size '%s', expected MiB", args[1])
+		}
+		return setBalloon(args[0], mib)
+	},
+}
+
+func setBalloon(id string, mib int) error {
+	vmInstance, err := vm.Open(id)
+	if err != nil {
+		return err
+	}
+	defer vmInstance.Stop()
+
+	if mem := vmInstance.Profile().VM.MemoryMiB; mem > 0 && mib > mem {
+		return fmt.Errorf("balloon size %d MiB exceeds the %d MiB of the VM", mib, mem)
+	}
+
+	if err := vmInstance.SetBalloon(mib); err != nil {
+		return err
+	}
+
+	fmt.Printf("Balloon of VM %s set to %d MiB\n", id, mib)
+	return nil
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nikiskaarup/sear/internal/console"
+	"github.com/nikiskaarup/sear/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+var consoleCmd = &cobra.Command{
+	Use:   "console <vm-id>",
+	Short: "Attach to the serial console of a microVM",
+	Long: `Attach the terminal to the serial console (ttyS0) of a running microVM.
+The recent console output is shown first. The console does not depend on
+SSH or networking in the guest, so it also works when those are broken.
+
+Press Ctrl-] to detach; the VM keeps running.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return attachConsole(args[0])
+	},
+}
+
+func attachConsole(id string) error {
+	vmInstance, err := vm.Open(id)
+	if err != nil {
+		return err
+	}
+	defer vmInstance.Stop()
+
+	socket := vmInstance.ConsoleSocket()
+	if _, err := os.Stat(socket); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("the serial console of VM '%s' is not available, its Firecracker process was not started by sear", id)
+	}
+
+	fmt.Fprintf(os.Stderr, "Connected to the console of VM %s, press Ctrl-] to detach\r\n", id)
+	err = console.Attach(socket, os.Stdin, os.Stdout)
+	fmt.Fprintf(os.Stderr, "\r\n")
+	return err
+}
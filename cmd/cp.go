@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var cpCmd = &cobra.Command{
+	Use:   "cp [vm:]src [vm:]dst",
+	Short: "Copy files between the host and a running microVM",
+	Long: `Copy files or directories between the host and a running microVM.
+
+Exactly one of the paths must be prefixed with the ID of a running VM (see
+'sear ps'), for example:
+
+  sear cp 3f9a1c2e:/root/target/release/app ./app
+  sear cp ./config.toml 3f9a1c2e:/etc/app/
+
+Directories are copied recursively. File modes and modification times are
+preserved.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return copyFiles(args[0], args[1])
+	},
+}
+
+func copyFiles(src, dst string) error {
+	srcID, srcPath := splitVMPath(src)
+	dstID, dstPath := splitVMPath(dst)
+
+	if (srcID == "") == (dstID == "") {
+		return fmt.Errorf("exactly one of source and destination must be a VM path (vm-id:path)")
+	}
+
+	id := srcID
+	if id == "" {
+		id = dstID
+	}
+
+	vmInstance, err := openVM(id)
+	if err != nil {
+		return err
+	}
+	defer vmInstance.Stop()
+
+	sshClient, err := vmInstance.GetSSHClient()
+	if err != nil {
+		return fmt.Errorf("failed to create SSH client: %w", err)
+	}
+
+	if srcID != "" {
+		logrus.Debugf("Downloading %s from VM %s to %s", srcPath, id, dstPath)
+		if err := sshClient.Download(srcPath, dstPath); err != nil {
+			return fmt.Errorf("failed to copy from VM: %w", err)
+		}
+		return nil
+	}
+
+	logrus.Debugf("Uploading %s to VM %s at %s", srcPath, id, dstPath)
+	if err := sshClient.Upload(srcPath, dstPath); err != nil {
+		return fmt.Errorf("failed to copy to VM: %w", err)
+	}
+	return nil
+}
+
+// splitVMPath splits "vm-id:path" into its parts. Arguments without a VM
+// prefix, including paths that merely contain a colon after a slash, are
+// returned as host paths with an empty ID.
+func splitVMPath(arg string) (id, path string) {
+	i := strings.IndexByte(arg, ':')
+	if i <= 0 || strings.ContainsRune(arg[:i], '/') {
+		return "", arg
+	}
+	return arg[:i], arg[i+1:]
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/ssh"
+	"github.com/nikiskaarup/sear/internal/tty"
+	"github.com/nikiskaarup/sear/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec <profile|vm-id> -- command [args...]",
+	Short: "Run a command in a microVM",
+	Long: `Run a single command inside a microVM and exit with its exit code.
+
+If the target is a profile name, a new VM is booted and provisioned as with
+'sear run', the command is run with the current working directory mounted,
+and the VM is torn down afterwards. If the target is the ID of a running VM
+(see 'sear ps'), the command is run in that VM instead.
+
+Standard input, output and error are connected to the command. A TTY is
+allocated only if standard input is a terminal.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if dash := cmd.ArgsLenAtDash(); dash != -1 && dash != 1 {
+			return fmt.Errorf("expected exactly one target before '--', got %d", dash)
+		}
+		return execCommand(args[0], args[1:])
+	},
+}
+
+func execCommand(target string, command []string) error {
+	cfg, err := loadTrustedConfig()
+	if err != nil {
+		return err
+	}
+
+	vmInstance, sshClient, err := resolveTarget(cfg, target)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := vmInstance.Stop(); err != nil {
+			logrus.Errorf("Error stopping VM: %v", err)
+		}
+	}()
+
+	forwardAgent(cfg, sshClient)
+
+	cmdLine := ssh.QuoteArgs(command)
+	logrus.Debugf("Executing in VM %s: %s", vmInstance.ID(), cmdLine)
+
+	result, err := sshClient.Exec(cmdLine, ssh.ExecOptions{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		TTY:    tty.Open(os.Stdin) != nil,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute command: %w", err)
+	}
+
+	logrus.Debugf("Command finished: %s", result)
+	if !result.Success() {
+		return exitCode(result)
+	}
+
+	return nil
+}
+
+// resolveTarget returns a VM for a profile name of cfg or the ID of a
+// running VM. Profiles take precedence. Stopping the returned VM tears it
+// down only if it was booted here.
+func resolveTarget(cfg *config.Config, target string) (*vm.VM, *vm.SSHClient, error) {
+	if _, exists := cfg.Profiles[target]; exists {
+		return bootProfile(cfg, target)
+	}
+
+	if len(mountFlags) > 0 || persistFlag || noSnapshotFlag {
+		return nil, nil, fmt.Errorf("--mount, --persist and --no-snapshot only apply when booting a profile, '%s' is not one", target)
+	}
+
+	if _, err := vm.LoadState(target); err != nil {
+		return nil, nil, fmt.Errorf("'%s' is neither a profile nor a running VM: %w", target, err)
+	}
+
+	vmInstance, err := openVM(target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sshClient, err := vmInstance.GetSSHClient()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create SSH client: %w", err)
+	}
+
+	return vmInstance, sshClient, nil
+}
+
+// openVM opens a running VM to run commands in, refusing paused VMs
+func openVM(id string) (*vm.VM, error) {
+	vmInstance, err := vm.Open(id)
+	if err != nil {
+		return nil, err
+	}
+
+	paused, err := vmInstance.Paused()
+	if err != nil {
+		return nil, err
+	}
+	if paused {
+		return nil, fmt.Errorf("VM '%s' is paused, resume it with 'sear resume %s' first", id, id)
+	}
+
+	return vmInstance, nil
+}
@@ -3,22 +3,65 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 	"text/tabwriter"
 
 	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/redact"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
 )
 
 var listCmd = &cobra.Command{
-	Use:   "list-profiles",
+	Use:   "list-profiles [profile]",
 	Short: "List all available profiles",
-	Long:  "Display all configured profiles with their details.",
+	Long: `Display all configured profiles with their details. Given a profile,
+print it with the settings of the profiles it extends merged in.`,
+	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 1 {
+			return showProfile(args[0])
+		}
 		return listProfiles()
 	},
 }
 
+// showProfile prints a profile as resolved by Load
+func showProfile(name string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	profile, exists := cfg.Profiles[name]
+	if !exists {
+		return fmt.Errorf("profile '%s' not found. Available profiles: %v", name, getProfileNames(cfg))
+	}
+
+	return printProfile(profile)
+}
+
+// printProfile prints a profile in the configuration format, with the
+// values of secrets masked
+func printProfile(profile config.Profile) error {
+	secrets := make([]config.EnvVar, len(profile.Secrets))
+	for i, secret := range profile.Secrets {
+		if secret.Value != "" {
+			secret.Value = redact.Mask
+		}
+		secrets[i] = secret
+	}
+	profile.Secrets = secrets
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(map[string]config.Profile{profile.Name: profile}); err != nil {
+		return fmt.Errorf("failed to encode profile: %w", err)
+	}
+	return enc.Close()
+}
+
 func listProfiles() error {
 	cfg, err := config.Load()
 	if err != nil {
@@ -39,14 +82,15 @@ func listProfiles() error {
 	fmt.Printf("Default profile: %s\n\n", defaultProfile)
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintf(w, "Profile\tVCPUs\tMemory (MiB)\tRootFS\tTools\n")
-	fmt.Fprintf(w, "-------\t-----\t------------\t------\t-----\n")
+	fmt.Fprintf(w, "Profile\tExtends\tVCPUs\tMemory (MiB)\tRootFS\tTools\n")
+	fmt.Fprintf(w, "-------\t-------\t-----\t------------\t------\t-----\n")
 
 	for name, profile := range cfg.Profiles {
 		vcpus := "1"
 		memory := "512"
 		rootfs := "default"
 		tools := "0"
+		extends := "-"
 
 		if profile.VM.VCPUs > 0 {
 			vcpus = fmt.Sprintf("%d", profile.VM.VCPUs)
@@ -60,13 +104,16 @@ func listProfiles() error {
 		if len(profile.Tools) > 0 {
 			tools = fmt.Sprintf("%d", len(profile.Tools))
 		}
+		if len(profile.Extends) > 0 {
+			extends = strings.Join(profile.Extends, ",")
+		}
 
 		marker := ""
 		if name == defaultProfile {
 			marker = " *"
 		}
 
-		fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\t%s\n", name, marker, vcpus, memory, rootfs, tools)
+		fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\t%s\t%s\n", name, marker, extends, vcpus, memory, rootfs, tools)
 	}
 
 	if err := w.Flush(); err != nil {
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// logsFollow keeps printing the log as it grows
+	logsFollow bool
+	// logsConsole shows the serial console instead of the Firecracker log
+	logsConsole bool
+)
+
+// logsPollInterval is how often a followed log is checked for new output
+const logsPollInterval = 200 * time.Millisecond
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <vm-id>",
+	Short: "Show the Firecracker log or serial console of a microVM",
+	Long: `Show the Firecracker log of a running microVM, or with --console the
+output of its serial console (kernel messages and the guest login console).
+
+The Firecracker log level is set per profile with vm.log_level. Logs are
+removed together with the VM when it stops.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return showLogs(args[0])
+	},
+}
+
+func init() {
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "keep printing new output until the VM stops")
+	logsCmd.Flags().BoolVar(&logsConsole, "console", false, "show the guest serial console instead of the Firecracker log")
+}
+
+func showLogs(id string) error {
+	vmInstance, err := vm.Open(id)
+	if err != nil {
+		return err
+	}
+	defer vmInstance.Stop()
+
+	path := vmInstance.LogPath()
+	if logsConsole {
+		path = vmInstance.ConsolePath()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && logsConsole {
+			return fmt.Errorf("the serial console of VM '%s' is not captured, its Firecracker process was not started by sear", id)
+		}
+		return fmt.Errorf("failed to open log: %w", err)
+	}
+	defer f.Close()
+
+	for {
+		if _, err := io.Copy(os.Stdout, f); err != nil {
+			return fmt.Errorf("failed to read log: %w", err)
+		}
+		if !logsFollow {
+			return nil
+		}
+
+		// Print what was written until the VM stopped, then give up
+		if _, err := vm.LoadState(id); err != nil {
+			_, err := io.Copy(os.Stdout, f)
+			return err
+		}
+		time.Sleep(logsPollInterval)
+	}
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// prefixWriter writes every line it receives to an underlying writer with
+// a fixed prefix. Partial lines are held back until completed or flushed.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+// newPrefixWriter creates a writer that prefixes each line with prefix
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{
+		w:      w,
+		prefix: []byte(prefix),
+	}
+}
+
+// Write implements io.Writer
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+
+	return len(data), nil
+}
+
+// Flush writes out any incomplete trailing line
+func (p *prefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.writeLine(append(p.buf, '\n'))
+	p.buf = nil
+	return err
+}
+
+// writeLine writes a single complete line with the prefix
+func (p *prefixWriter) writeLine(line []byte) error {
+	out := make([]byte, 0, len(p.prefix)+len(line))
+	out = append(out, p.prefix...)
+	out = append(out, line...)
+	_, err := p.w.Write(out)
+	return err
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var pauseCmd = &cobra.Command{
+	Use:   "pause <vm-id>",
+	Short: "Pause a running microVM",
+	Long: `Pause the vCPUs of a running microVM. The VM keeps its memory and state
+but uses no CPU until it is resumed with 'sear resume'. Commands cannot be
+run in a paused VM.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return pauseVM(args[0])
+	},
+}
+
+var resumeCmd = &cobra.Command{
+	Use:   "resume <vm-id>",
+	Short: "Resume a paused microVM",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return resumeVM(args[0])
+	},
+}
+
+func pauseVM(id string) error {
+	vmInstance, err := vm.Open(id)
+	if err != nil {
+		return err
+	}
+	defer vmInstance.Stop()
+
+	if err := vmInstance.Pause(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Paused VM %s\n", id)
+	return nil
+}
+
+func resumeVM(id string) error {
+	vmInstance, err := vm.Open(id)
+	if err != nil {
+		return err
+	}
+	defer vmInstance.Stop()
+
+	if err := vmInstance.Resume(); err != nil {
+		return err
+	}
+
+	// The guest clock stood still while the VM was paused
+	sshClient, err := vmInstance.GetSSHClient()
+	if err == nil {
+		err = sshClient.ExecuteCommand(fmt.Sprintf("date -s @%d", time.Now().Unix()))
+	}
+	if err != nil {
+		logrus.Warnf("Failed to set the guest clock: %v", err)
+	}
+
+	fmt.Printf("Resumed VM %s\n", id)
+	return nil
+}
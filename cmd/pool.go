@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+var poolCmd = &cobra.Command{
+	Use:   "pool",
+	Short: "Manage the warm pool of pre-booted VMs",
+	Long: `Profiles with a pool size, such as
+
+  pool:
+    size: 3
+
+get that many VMs booted and provisioned ahead of time by the pool daemon.
+'sear run' and 'sear exec' take an idle VM from the pool instead of booting
+one, and the daemon boots a replacement in the background.`,
+}
+
+var poolServeCmd = &cobra.Command{
+	Use:   "serve [profile...]",
+	Short: "Run the pool daemon in the foreground",
+	Long: `Run the pool daemon until it is interrupted, keeping the pools of the given
+profiles, or of all profiles with a pool size, filled. VMs of the pool are
+stopped when the daemon exits, including those in use.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return servePool(args)
+	},
+}
+
+var poolStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the number of idle VMs per pooled profile",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return poolStatus()
+	},
+}
+
+func init() {
+	poolCmd.AddCommand(poolServeCmd)
+	poolCmd.AddCommand(poolStatusCmd)
+}
+
+// pooledProfiles returns the named profiles, or all profiles with a pool
+// size if none are named
+func pooledProfiles(cfg *config.Config, names []string) ([]config.Profile, error) {
+	var profiles []config.Profile
+
+	if len(names) == 0 {
+		for _, profile := range cfg.Profiles {
+			if profile.Pool != nil && profile.Pool.Size > 0 {
+				profiles = append(profiles, profile)
+			}
+		}
+		sort.Slice(profiles, func(i, j int) bool {
+			return profiles[i].Name < profiles[j].Name
+		})
+		return profiles, nil
+	}
+
+	for _, name := range names {
+		profile, ok := cfg.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("profile '%s' not found. Available profiles: %v", name, getProfileNames(cfg))
+		}
+		if profile.Pool == nil || profile.Pool.Size <= 0 {
+			return nil, fmt.Errorf("profile '%s' has no pool size", name)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+func servePool(names []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	profiles, err := pooledProfiles(cfg, names)
+	if err != nil {
+		return err
+	}
+	if len(profiles) == 0 {
+		return fmt.Errorf("no profile has a pool size")
+	}
+
+	if err := checkProjectTrust(cfg); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pool := vm.NewPool(profiles, cfg.SSH, func(v *vm.VM) error {
+		_, err := provision(v, v.Profile(), nil)
+		return err
+	})
+	return pool.Serve(ctx)
+}
+
+func poolStatus() error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	profiles, err := pooledProfiles(cfg, nil)
+	if err != nil {
+		return err
+	}
+	if len(profiles) == 0 {
+		fmt.Println("No profile has a pool size.")
+		return nil
+	}
+
+	states, err := vm.ListStates()
+	if err != nil {
+		return fmt.Errorf("failed to list VMs: %w", err)
+	}
+	idle := make(map[string]int)
+	for _, s := range states {
+		if s.Status == vm.StatusIdle {
+			idle[s.Profile.Name]++
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Profile\tIdle\tSize\n")
+	fmt.Fprintf(w, "-------\t----\t----\n")
+
+	for _, profile := range profiles {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", profile.Name, idle[profile.Name], profile.Pool.Size)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	return nil
+}
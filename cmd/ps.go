@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+var psCmd = &cobra.Command{
+	Use:   "ps",
+	Short: "List running microVMs",
+	Long:  "Display the microVMs started by sear that are currently running.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listVMs()
+	},
+}
+
+func listVMs() error {
+	states, err := vm.ListStates()
+	if err != nil {
+		return fmt.Errorf("failed to list VMs: %w", err)
+	}
+
+	if len(states) == 0 {
+		fmt.Println("No running VMs.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tProfile\tStatus\tUptime\n")
+	fmt.Fprintf(w, "--\t-------\t------\t------\n")
+
+	for _, s := range states {
+		uptime := time.Since(s.CreatedAt).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.ID, s.Profile.Name, s.Status, uptime)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	return nil
+}
@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 
+	"github.com/nikiskaarup/sear/internal/redact"
+	"github.com/nikiskaarup/sear/internal/ssh"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -16,6 +19,53 @@ var rootCmd = &cobra.Command{
 	Long: `sear is a CLI tool to spawn Firecracker microVMs with configured profiles.
 
 Complete documentation is available at https://github.com/nikiskaarup/sear`,
+	// Errors are logged by main, and remote exit codes are not usage errors
+	SilenceErrors: true,
+	SilenceUsage:  true,
+}
+
+// ExitError is returned when a command inside the VM did not succeed. The
+// process should exit with Code without reporting an additional error.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// exitCode maps the result of a remote command to an ExitError, using the
+// shell convention of 128+n for commands killed by a signal
+func exitCode(result *ssh.ExecResult) error {
+	if result.Signal != "" {
+		return &ExitError{Code: 128 + signalNumber(result.Signal)}
+	}
+	return &ExitError{Code: result.ExitCode}
+}
+
+// signalNumber returns the number of an SSH signal name, or 1 if unknown
+func signalNumber(name string) int {
+	switch name {
+	case "HUP":
+		return 1
+	case "INT":
+		return 2
+	case "QUIT":
+		return 3
+	case "ABRT":
+		return 6
+	case "KILL":
+		return 9
+	case "SEGV":
+		return 11
+	case "PIPE":
+		return 13
+	case "ALRM":
+		return 14
+	case "TERM":
+		return 15
+	}
+	return 1
 }
 
 func Execute() error {
@@ -27,9 +77,32 @@ func init() {
 
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
 
+	for _, c := range []*cobra.Command{runCmd, execCmd} {
+		c.Flags().StringArrayVar(&mountFlags, "mount", nil, "share a host directory as SOURCE:TARGET[:ro] (repeatable)")
+		c.Flags().BoolVar(&persistFlag, "persist", false, "keep changes to the rootfs instead of discarding them on exit")
+		c.Flags().BoolVar(&noSnapshotFlag, "no-snapshot", false, "boot and provision from scratch without using or saving a snapshot")
+	}
+
+	for _, c := range []*cobra.Command{runCmd, attachCmd} {
+		c.Flags().BoolVarP(&forwardAgentFlag, "forward-agent", "A", false, "forward the host SSH agent into the shell")
+	}
+
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(listCmd)
 	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(execCmd)
+	rootCmd.AddCommand(psCmd)
+	rootCmd.AddCommand(cpCmd)
+	rootCmd.AddCommand(snapshotCmd)
+	rootCmd.AddCommand(poolCmd)
+	rootCmd.AddCommand(pauseCmd)
+	rootCmd.AddCommand(resumeCmd)
+	rootCmd.AddCommand(attachCmd)
+	rootCmd.AddCommand(balloonCmd)
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(consoleCmd)
+	rootCmd.AddCommand(trustCmd)
 }
 
 func initConfig() {
@@ -57,10 +130,11 @@ func initConfig() {
 }
 
 func setupLogging() {
-	logrus.SetFormatter(&logrus.TextFormatter{
+	// Secret values never reach the log
+	logrus.SetFormatter(&redact.Formatter{Formatter: &logrus.TextFormatter{
 		FullTimestamp: true,
 		ForceColors:   true,
-	})
+	}})
 
 	if verbose {
 		logrus.SetLevel(logrus.DebugLevel)
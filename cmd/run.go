@@ -3,8 +3,12 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/ssh"
 	"github.com/nikiskaarup/sear/internal/vm"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -22,94 +26,250 @@ an interactive shell with the current working directory mounted.`,
 	},
 }
 
+// mountFlags holds the --mount values of run and exec
+var mountFlags []string
+
+// persistFlag keeps the changes made to the rootfs by run and exec
+var persistFlag bool
+
+// noSnapshotFlag boots and provisions from scratch, without restoring or
+// saving a snapshot
+var noSnapshotFlag bool
+
+// forwardAgentFlag forwards the host SSH agent into the shell of run and
+// attach
+var forwardAgentFlag bool
+
+// sshReadyTimeout bounds how long to wait for sshd in a freshly booted guest
+const sshReadyTimeout = 60 * time.Second
+
 func runProfile(profileName string) error {
-	logrus.Infof("Starting profile: %s", profileName)
+	cfg, err := loadTrustedConfig()
+	if err != nil {
+		return err
+	}
+
+	vmInstance, sshClient, err := bootProfile(cfg, profileName)
+	if err != nil {
+		return err
+	}
+
+	// Ensure cleanup on exit
+	defer func() {
+		if err := vmInstance.Stop(); err != nil {
+			logrus.Errorf("Error stopping VM: %v", err)
+		}
+	}()
 
-	// Load configuration
-	cfg, err := config.Load()
+	forwardAgent(cfg, sshClient)
+
+	// Start interactive shell
+	logrus.Info("Starting interactive shell...")
+	result, err := sshClient.Shell()
 	if err != nil {
-		return fmt.Errorf("failed to load configuration: %w", err)
+		return fmt.Errorf("shell session failed: %w", err)
 	}
+	if !result.Success() {
+		return exitCode(result)
+	}
+
+	return nil
+}
+
+// bootProfile starts a VM for the given profile of cfg, provisions it and
+// mounts the current directory. cfg must be trusted, see loadTrustedConfig.
+// The caller owns the returned VM and must stop it.
+func bootProfile(cfg *config.Config, profileName string) (*vm.VM, *vm.SSHClient, error) {
+	logrus.Infof("Starting profile: %s", profileName)
 
 	// Validate profile exists
 	profile, exists := cfg.Profiles[profileName]
 	if !exists {
-		return fmt.Errorf("profile '%s' not found. Available profiles: %v", profileName, getProfileNames(cfg))
+		return nil, nil, fmt.Errorf("profile '%s' not found. Available profiles: %v", profileName, getProfileNames(cfg))
 	}
 
 	// Create and start VM
 	vmInstance, err := vm.NewVM(profile)
 	if err != nil {
-		return fmt.Errorf("failed to create VM: %w", err)
+		return nil, nil, fmt.Errorf("failed to create VM: %w", err)
 	}
+	vmInstance.SetSSH(cfg.SSH)
+	vmInstance.SetPersist(persistFlag)
+	vmInstance.SetSnapshots(!noSnapshotFlag)
 
-	// Start the VM
-	if err := vmInstance.Start(); err != nil {
-		return fmt.Errorf("failed to start VM: %w", err)
+	extra, err := parseMountFlags(mountFlags)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Ensure cleanup on exit
-	defer func() {
+	stop := func() {
 		if err := vmInstance.Stop(); err != nil {
 			logrus.Errorf("Error stopping VM: %v", err)
 		}
-	}()
+	}
 
-	logrus.Info("VM started successfully")
+	// Backends such as image mode set up their directories before boot
+	cwd, err := os.Getwd()
+	if err != nil {
+		logrus.Warnf("Failed to get current directory: %v", err)
+	}
+	mounts := vmInstance.Mounts(cwd, extra...)
 
-	// Get SSH client for the VM
-	sshClient, err := vmInstance.GetSSHClient()
+	// Hand out a VM of the warm pool if the pool daemon has one ready
+	if usePool(vmInstance, profile, mounts) {
+		pooled, sshClient, err := claimPooled(profile, mounts)
+		if err == nil {
+			return pooled, sshClient, nil
+		}
+		logrus.Infof("No pooled VM available, booting one: %v", err)
+	}
+
+	if err := vmInstance.PrepareMounts(mounts); err != nil {
+		stop()
+		return nil, nil, fmt.Errorf("failed to prepare mounts: %w", err)
+	}
+
+	// Start the VM
+	if err := vmInstance.Start(); err != nil {
+		stop()
+		return nil, nil, fmt.Errorf("failed to start VM: %w", err)
+	}
+
+	sshClient, err := provision(vmInstance, profile, mounts)
 	if err != nil {
-		return fmt.Errorf("failed to create SSH client: %w", err)
+		stop()
+		return nil, nil, err
 	}
 
-	// Configure guest networking
-	if err := configureGuestNetworking(sshClient, profile); err != nil {
-		logrus.Warnf("Failed to configure guest networking: %v", err)
+	return vmInstance, sshClient, nil
+}
+
+// usePool reports whether a VM of the profile may be taken from the warm
+// pool. Pooled VMs are booted without the options of this invocation and
+// cannot have drives attached for mounts.
+func usePool(vmInstance *vm.VM, profile config.Profile, mounts []config.MountConfig) bool {
+	if profile.Pool == nil || profile.Pool.Size <= 0 {
+		return false
+	}
+	if persistFlag || noSnapshotFlag {
+		logrus.Debug("Not using the warm pool with --persist or --no-snapshot")
+		return false
 	}
+	if vmInstance.NeedsPreparation(mounts) {
+		logrus.Debug("Not using the warm pool, a mount must be prepared before boot")
+		return false
+	}
+	return true
+}
+
+// claimPooled takes a provisioned VM of the profile from the warm pool and
+// mounts the shared directories in it
+func claimPooled(profile config.Profile, mounts []config.MountConfig) (*vm.VM, *vm.SSHClient, error) {
+	start := time.Now()
 
-	// Run tool commands
-	if err := runToolCommands(sshClient, profile.Tools); err != nil {
-		logrus.Warnf("Some tool commands failed: %v", err)
+	vmInstance, err := vm.Claim(profile)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Mount current directory
-	cwd, err := os.Getwd()
+	sshClient, err := vmInstance.GetSSHClient()
 	if err != nil {
-		logrus.Warnf("Failed to get current directory: %v", err)
-	} else {
-		if err := vmInstance.MountDirectory(sshClient, cwd); err != nil {
-			logrus.Warnf("Failed to mount current directory: %v", err)
-		} else {
-			logrus.Infof("Mounted current directory: %s", cwd)
-		}
+		vmInstance.Stop()
+		return nil, nil, fmt.Errorf("failed to create SSH client: %w", err)
 	}
 
-	// Start interactive shell
-	logrus.Info("Starting interactive shell...")
-	return sshClient.Shell()
+	// Secrets may have changed since the VM joined the pool
+	if err := vmInstance.SetupEnv(sshClient); err != nil {
+		vmInstance.Stop()
+		return nil, nil, fmt.Errorf("failed to set up the guest environment: %w", err)
+	}
+
+	if err := vmInstance.MountDirectory(sshClient, mounts); err != nil {
+		logrus.Errorf("Failed to mount directories: %v", err)
+	}
+
+	logrus.Infof("Using VM %s from the warm pool (%s)", vmInstance.ID(), time.Since(start).Round(time.Millisecond))
+	return vmInstance, sshClient, nil
 }
 
-func configureGuestNetworking(sshClient *vm.SSHClient, profile config.Profile) error {
-	logrus.Info("Configuring guest networking...")
+// provision prepares a freshly started VM: it configures networking, runs
+// the profile tools and mounts the shared directories. VMs restored from a
+// snapshot are already provisioned and only get their files refreshed;
+// freshly provisioned VMs are snapshotted for the next run.
+func provision(vmInstance *vm.VM, profile config.Profile, mounts []config.MountConfig) (*vm.SSHClient, error) {
+	// Get SSH client for the VM
+	sshClient, err := vmInstance.GetSSHClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH client: %w", err)
+	}
+
+	logrus.Info("Waiting for the guest to accept SSH connections...")
+	if err := sshClient.WaitReady(sshReadyTimeout); err != nil {
+		return nil, vmInstance.WithLogs(err)
+	}
+
+	// Tools and sessions see the env and secrets of the profile
+	if err := vmInstance.SetupEnv(sshClient); err != nil {
+		return nil, fmt.Errorf("failed to set up the guest environment: %w", err)
+	}
+
+	if vmInstance.Restored() {
+		// The guest clock stopped when the snapshot was taken
+		if err := sshClient.ExecuteCommand(fmt.Sprintf("date -s @%d", time.Now().Unix())); err != nil {
+			logrus.Warnf("Failed to set the guest clock: %v", err)
+		}
+
+		if err := copyProfileFiles(sshClient, profile.Files); err != nil {
+			logrus.Warnf("Some files could not be copied: %v", err)
+		}
+	} else {
+		// Configure guest networking
+		if network := vmInstance.Network(); network.Mode != config.NetworkModeNone {
+			if err := sshClient.ConfigureNetwork(network); err != nil {
+				logrus.Warnf("Failed to configure guest networking: %v", err)
+			}
+		}
+
+		// Ship files into the guest
+		if err := copyProfileFiles(sshClient, profile.Files); err != nil {
+			logrus.Warnf("Some files could not be copied: %v", err)
+		}
 
-	// Setup DNS (use 1.1.1.1 as default)
-	dnsServer := "1.1.1.1"
-	if profile.Network != nil && profile.Network.DNSServer != "" {
-		dnsServer = profile.Network.DNSServer
+		// Run tool commands; a partially provisioned VM is not worth keeping
+		if err := runToolCommands(sshClient, profile.Tools); err != nil {
+			logrus.Warnf("Some tool commands failed, not saving a snapshot: %v", err)
+		} else if err := vmInstance.SaveSnapshot(); err != nil {
+			logrus.Warnf("Failed to save snapshot: %v", err)
+		}
 	}
 
-	commands := []string{
-		// Setup DNS
-		fmt.Sprintf("echo 'nameserver %s' > /etc/resolv.conf", dnsServer),
-		// Setup default route
-		"ip route add default via 172.16.0.1 dev eth0 2>/dev/null || true",
+	// Mount the current directory and the profile mounts
+	if err := vmInstance.MountDirectory(sshClient, mounts); err != nil {
+		logrus.Errorf("Failed to mount directories: %v", err)
 	}
 
-	for _, cmd := range commands {
-		if err := sshClient.ExecuteCommand(cmd); err != nil {
-			logrus.Warnf("Command failed: %s: %v", cmd, err)
+	return sshClient, nil
+}
+
+func copyProfileFiles(sshClient *vm.SSHClient, files []config.FileConfig) error {
+	failed := 0
+	for _, file := range files {
+		source, err := config.ExpandPath(file.Source)
+		if err != nil {
+			logrus.Warnf("Invalid file source %s: %v", file.Source, err)
+			failed++
+			continue
 		}
+
+		logrus.Infof("Copying %s to %s", source, file.Target)
+		if err := sshClient.Upload(source, file.Target); err != nil {
+			logrus.Warnf("Failed to copy %s: %v", source, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be copied", failed, len(files))
 	}
 
 	return nil
@@ -123,16 +283,55 @@ func runToolCommands(sshClient *vm.SSHClient, tools []string) error {
 
 	logrus.Infof("Running %d tool commands...", len(tools))
 
+	failed := 0
 	for i, toolCmd := range tools {
 		logrus.Infof("Running tool %d/%d: %s", i+1, len(tools), toolCmd)
-		if err := sshClient.ExecuteCommand(toolCmd); err != nil {
-			logrus.Warnf("Tool command failed: %v", err)
+
+		prefix := fmt.Sprintf("[tool %d/%d] ", i+1, len(tools))
+		stdout := newPrefixWriter(os.Stdout, prefix)
+		stderr := newPrefixWriter(os.Stderr, prefix)
+
+		result, err := sshClient.Exec(toolCmd, ssh.ExecOptions{
+			Stdout: stdout,
+			Stderr: stderr,
+		})
+		_ = stdout.Flush()
+		_ = stderr.Flush()
+
+		if err != nil {
+			logrus.Warnf("Tool command could not be run: %v", err)
+			failed++
+			continue
 		}
+		if !result.Success() {
+			logrus.Warnf("Tool command failed: %s", result)
+			failed++
+			continue
+		}
+
+		logrus.Debugf("Tool command finished: %s", result)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tool commands failed", failed, len(tools))
 	}
 
 	return nil
 }
 
+// forwardAgent forwards the host SSH agent into the sessions of sshClient
+// if -A or ssh.forward_agent of cfg asks for it. cfg must be trusted, see
+// loadTrustedConfig.
+func forwardAgent(cfg *config.Config, sshClient *vm.SSHClient) {
+	if !forwardAgentFlag && (cfg.SSH == nil || !cfg.SSH.ForwardAgent) {
+		return
+	}
+
+	if err := sshClient.ForwardAgent(); err != nil {
+		logrus.Warnf("Not forwarding the SSH agent: %v", err)
+	}
+}
+
 func getProfileNames(cfg *config.Config) []string {
 	names := make([]string, 0, len(cfg.Profiles))
 	for name := range cfg.Profiles {
@@ -140,3 +339,30 @@ func getProfileNames(cfg *config.Config) []string {
 	}
 	return names
 }
+
+// parseMountFlags parses --mount values of the form SOURCE:TARGET[:ro|rw]
+func parseMountFlags(specs []string) ([]config.MountConfig, error) {
+	var mounts []config.MountConfig
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid mount '%s', expected SOURCE:TARGET[:ro]", spec)
+		}
+
+		m := config.MountConfig{Source: parts[0], Target: parts[1]}
+		if len(parts) == 3 {
+			switch parts[2] {
+			case "ro":
+				m.ReadOnly = true
+			case "rw":
+			default:
+				return nil, fmt.Errorf("invalid mount option '%s' in '%s', expected ro or rw", parts[2], spec)
+			}
+		}
+		if !path.IsAbs(m.Target) {
+			return nil, fmt.Errorf("mount target '%s' must be an absolute path", m.Target)
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// rootTimeout bounds the wait for the root device to appear
+const rootTimeout = 5 * time.Second
+
+// bootOptions are the kernel command line options the initramfs handles
+type bootOptions struct {
+	root     string
+	fstype   string
+	readOnly bool
+	init     string
+}
+
+// parseCmdline reads the boot options from the kernel command line
+func parseCmdline(cmdline string) bootOptions {
+	opts := bootOptions{root: "/dev/vda", fstype: "ext4", init: "/sbin/init"}
+	for _, field := range strings.Fields(cmdline) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "root":
+			opts.root = value
+		case "rootfstype":
+			opts.fstype = value
+		case "init":
+			opts.init = value
+		case "ro":
+			opts.readOnly = true
+		case "rw":
+			opts.readOnly = false
+		}
+	}
+	return opts
+}
+
+// switchRoot mounts the root file system named on the kernel command line
+// and makes it the root, like switch_root. It returns the init to run.
+func switchRoot() (string, error) {
+	for _, m := range []struct{ source, target, fstype string }{
+		{"devtmpfs", "/dev", "devtmpfs"},
+		{"proc", "/proc", "proc"},
+		{"sysfs", "/sys", "sysfs"},
+	} {
+		if err := unix.Mount(m.source, m.target, m.fstype, 0, ""); err != nil {
+			return "", fmt.Errorf("failed to mount %s: %w", m.target, err)
+		}
+	}
+
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return "", err
+	}
+	opts := parseCmdline(string(cmdline))
+
+	deadline := time.Now().Add(rootTimeout)
+	for {
+		if _, err := os.Stat(opts.root); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("root device %s did not appear", opts.root)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var flags uintptr
+	if opts.readOnly {
+		flags |= unix.MS_RDONLY
+	}
+	if err := unix.Mount(opts.root, "/newroot", opts.fstype, flags, ""); err != nil {
+		return "", fmt.Errorf("failed to mount root file system %s: %w", opts.root, err)
+	}
+
+	// Hand the kernel file systems to the new root; init mounts them
+	// itself where the rootfs lacks the mount point
+	for _, m := range []string{"/dev", "/proc", "/sys"} {
+		if info, err := os.Stat("/newroot" + m); err == nil && info.IsDir() {
+			err = unix.Mount(m, "/newroot"+m, "", unix.MS_MOVE, "")
+			if err == nil {
+				continue
+			}
+		}
+		_ = unix.Unmount(m, unix.MNT_DETACH)
+	}
+
+	// Free the memory of the initramfs copy; the running binary stays
+	// reachable through /proc/self/exe
+	_ = os.Remove("/init")
+
+	if err := unix.Chdir("/newroot"); err != nil {
+		return "", err
+	}
+	if err := unix.Mount(".", "/", "", unix.MS_MOVE, ""); err != nil {
+		return "", fmt.Errorf("failed to move root: %w", err)
+	}
+	if err := unix.Chroot("."); err != nil {
+		return "", fmt.Errorf("failed to change root: %w", err)
+	}
+	if err := unix.Chdir("/"); err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(opts.init); errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("init %s not found on the root file system", opts.init)
+	}
+	return opts.init, nil
+}
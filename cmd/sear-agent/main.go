@@ -0,0 +1,79 @@
+// sear-agent is the guest agent of sear. It serves exec, file transfer,
+// mounts, network configuration and heartbeats to the host over vsock.
+//
+// sear boots VMs of profiles with vm.agent set with an initramfs that runs
+// sear-agent as /init: it mounts the root file system, starts itself as a
+// daemon and hands over to the init of the rootfs. Started any other way,
+// for example by a systemd unit, it serves right away.
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/nikiskaarup/sear/internal/agent"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPath is set when the kernel starts the agent without PATH
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+func main() {
+	if os.Getenv("PATH") == "" {
+		os.Setenv("PATH", defaultPath)
+	}
+
+	if os.Getpid() == 1 {
+		if err := boot(); err != nil {
+			// Exiting makes the kernel panic, which stops the VM
+			logrus.Fatalf("sear-agent: %v", err)
+		}
+	}
+
+	if err := serve(agent.Port); err != nil {
+		logrus.Fatalf("sear-agent: %v", err)
+	}
+}
+
+// boot switches to the root file system, starts the agent daemon and
+// replaces itself with the init of the rootfs
+func boot() error {
+	init, err := switchRoot()
+	if err != nil {
+		return err
+	}
+
+	// /proc/self/exe still reaches the binary in the initramfs
+	daemon := exec.Command("/proc/self/exe", "serve")
+	daemon.Stdout = os.Stderr
+	daemon.Stderr = os.Stderr
+	daemon.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := daemon.Start(); err != nil {
+		logrus.Errorf("sear-agent: failed to start the agent: %v", err)
+	}
+
+	// The kernel passes unknown boot arguments on to init
+	args := append([]string{init}, os.Args[1:]...)
+	return syscall.Exec(init, args, os.Environ())
+}
+
+// serve accepts host connections on a vsock port
+func serve(port uint32) error {
+	l, err := listenVsock(port)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	logrus.Infof("sear-agent listening on vsock port %d", port)
+
+	server := agent.NewServer()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockListener accepts vsock connections. The net package does not know
+// the address family, so connections are plain files.
+type vsockListener struct {
+	fd int
+}
+
+// listenVsock listens on a vsock port for connections from the host
+func listenVsock(port uint32) (*vsockListener, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vsock socket: %w", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind vsock port %d: %w", port, err)
+	}
+	if err := unix.Listen(fd, 16); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to listen on vsock port %d: %w", port, err)
+	}
+
+	return &vsockListener{fd: fd}, nil
+}
+
+// Accept waits for the next connection
+func (l *vsockListener) Accept() (*os.File, error) {
+	for {
+		nfd, _, err := unix.Accept4(l.fd, unix.SOCK_CLOEXEC)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to accept vsock connection: %w", err)
+		}
+		return os.NewFile(uintptr(nfd), "vsock"), nil
+	}
+}
+
+// Close stops listening
+func (l *vsockListener) Close() error {
+	return unix.Close(l.fd)
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage provisioned VM snapshots",
+	Long: `After a profile has been booted and provisioned for the first time, sear
+saves a snapshot of the VM. Later runs of the profile restore it instead of
+booting and running the tools again. Snapshots are discarded automatically
+when the kernel, rootfs, tools or machine configuration of the profile
+change.`,
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List saved snapshots",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listSnapshots()
+	},
+}
+
+var snapshotRmAll bool
+
+var snapshotRmCmd = &cobra.Command{
+	Use:   "rm [profile...]",
+	Short: "Remove the snapshots of profiles",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if snapshotRmAll == (len(args) > 0) {
+			return fmt.Errorf("specify profiles or --all")
+		}
+		return removeSnapshots(args)
+	},
+}
+
+func init() {
+	snapshotRmCmd.Flags().BoolVar(&snapshotRmAll, "all", false, "remove all snapshots")
+
+	snapshotCmd.AddCommand(snapshotListCmd)
+	snapshotCmd.AddCommand(snapshotRmCmd)
+}
+
+func listSnapshots() error {
+	snapshots, err := vm.ListSnapshots()
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	if len(snapshots) == 0 {
+		fmt.Println("No snapshots.")
+		return nil
+	}
+
+	// Without a configuration the status of snapshots is unknown
+	cfg, err := config.Load()
+	if err != nil {
+		logrus.Debugf("Failed to load configuration: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Profile\tStatus\tSize\tCreated\n")
+	fmt.Fprintf(w, "-------\t------\t----\t-------\n")
+
+	for _, s := range snapshots {
+		age := time.Since(s.CreatedAt).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\n", s.Profile, snapshotStatus(cfg, s), formatSize(s.Size()), age)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	return nil
+}
+
+// snapshotStatus tells whether a snapshot would be restored by the next
+// run of its profile
+func snapshotStatus(cfg *config.Config, s *vm.Snapshot) string {
+	if cfg == nil {
+		return "unknown"
+	}
+
+	profile, ok := cfg.Profiles[s.Profile]
+	if !ok {
+		return "orphaned"
+	}
+
+	key, err := vm.SnapshotKey(profile)
+	if err != nil || key != s.Key {
+		return "stale"
+	}
+	return "current"
+}
+
+func removeSnapshots(profiles []string) error {
+	if snapshotRmAll {
+		snapshots, err := vm.ListSnapshots()
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots: %w", err)
+		}
+		for _, s := range snapshots {
+			profiles = append(profiles, s.Profile)
+		}
+	}
+
+	var errs []error
+	for _, profile := range profiles {
+		if err := vm.RemoveSnapshot(profile); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Printf("Removed snapshot of %s\n", profile)
+	}
+	return errors.Join(errs...)
+}
+
+// formatSize formats a byte count for humans
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/metrics"
+	"github.com/nikiskaarup/sear/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// statsPrometheus prints the metrics in Prometheus text format
+var statsPrometheus bool
+
+var statsCmd = &cobra.Command{
+	Use:   "stats <vm-id>",
+	Short: "Show resource statistics of a running microVM",
+	Long: `Show the Firecracker metrics of a running microVM since it started: vCPU
+exits, block I/O, network traffic and API latencies. If the profile has a
+balloon device, its memory statistics are shown as well.
+
+With --prometheus all metrics are printed in Prometheus text format, for
+example for the node exporter textfile collector.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return showStats(args[0])
+	},
+}
+
+func init() {
+	statsCmd.Flags().BoolVar(&statsPrometheus, "prometheus", false, "print all metrics in Prometheus text format")
+}
+
+func showStats(id string) error {
+	vmInstance, err := vm.Open(id)
+	if err != nil {
+		return err
+	}
+	defer vmInstance.Stop()
+
+	m, err := vmInstance.Metrics()
+	if err != nil {
+		return err
+	}
+
+	if statsPrometheus {
+		return m.WritePrometheus(os.Stdout, map[string]string{
+			"vm":      id,
+			"profile": vmInstance.Profile().Name,
+		})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	writeMetrics(w, m)
+
+	if vmInstance.Profile().VM.Balloon != nil {
+		if err := writeBalloonStats(w, vmInstance); err != nil {
+			logrus.Warnf("%v", err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	return nil
+}
+
+// writeMetrics prints the most useful Firecracker metrics
+func writeMetrics(w io.Writer, m *metrics.Metrics) {
+	if !m.Timestamp.IsZero() {
+		fmt.Fprintf(w, "Metrics as of %s\n", m.Timestamp.Local().Format(time.TimeOnly))
+	}
+
+	fmt.Fprintf(w, "vCPU exits\n")
+	fmt.Fprintf(w, "  I/O in/out\t%.0f / %.0f\n", m.Get("vcpu.exit_io_in"), m.Get("vcpu.exit_io_out"))
+	fmt.Fprintf(w, "  MMIO read/write\t%.0f / %.0f\n", m.Get("vcpu.exit_mmio_read"), m.Get("vcpu.exit_mmio_write"))
+	fmt.Fprintf(w, "  Failures\t%.0f\n", m.Get("vcpu.failures"))
+
+	fmt.Fprintf(w, "Block I/O\n")
+	fmt.Fprintf(w, "  Read\t%s (%.0f requests)\n", formatSize(int64(m.Get("block.read_bytes"))), m.Get("block.read_count"))
+	fmt.Fprintf(w, "  Written\t%s (%.0f requests)\n", formatSize(int64(m.Get("block.write_bytes"))), m.Get("block.write_count"))
+
+	fmt.Fprintf(w, "Network\n")
+	fmt.Fprintf(w, "  Received\t%s (%.0f packets)\n", formatSize(int64(m.Get("net.rx_bytes_count"))), m.Get("net.rx_packets_count"))
+	fmt.Fprintf(w, "  Sent\t%s (%.0f packets)\n", formatSize(int64(m.Get("net.tx_bytes_count"))), m.Get("net.tx_packets_count"))
+
+	fmt.Fprintf(w, "API latency\n")
+	if startup := m.Get("api_server.process_startup_time_us"); startup > 0 {
+		fmt.Fprintf(w, "  process startup\t%.0f µs\n", startup)
+	}
+	latencies := m.Group("latencies_us")
+	names := make([]string, 0, len(latencies))
+	for name, value := range latencies {
+		if value > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%.0f µs\n", name, latencies[name])
+	}
+}
+
+// writeBalloonStats prints the memory statistics of the balloon device
+func writeBalloonStats(w io.Writer, vmInstance *vm.VM) error {
+	stats, err := vmInstance.BalloonStats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Balloon\n")
+	fmt.Fprintf(w, "  Target\t%d MiB (%d pages)\n", stats.TargetMiB, stats.TargetPages)
+	fmt.Fprintf(w, "  Actual\t%d MiB (%d pages)\n", stats.ActualMiB, stats.ActualPages)
+
+	// Guest memory statistics are only there once the guest reported them
+	if stats.TotalMemory > 0 {
+		fmt.Fprintf(w, "Guest memory\n")
+		fmt.Fprintf(w, "  Total\t%s\n", formatSize(int64(stats.TotalMemory)))
+		fmt.Fprintf(w, "  Free\t%s\n", formatSize(int64(stats.FreeMemory)))
+		fmt.Fprintf(w, "  Available\t%s\n", formatSize(int64(stats.AvailableMemory)))
+		fmt.Fprintf(w, "  Disk caches\t%s\n", formatSize(int64(stats.DiskCaches)))
+		fmt.Fprintf(w, "  Swap in/out\t%s / %s\n", formatSize(int64(stats.SwapIn)), formatSize(int64(stats.SwapOut)))
+		fmt.Fprintf(w, "  Page faults\t%d major, %d minor\n", stats.MajorFaults, stats.MinorFaults)
+	}
+
+	return nil
+}
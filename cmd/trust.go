@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/tty"
+	"github.com/spf13/cobra"
+)
+
+var trustCmd = &cobra.Command{
+	Use:   "trust",
+	Short: "Trust the project config of the current directory",
+	Long: `Trust the .sear.yaml that applies in the current directory, so that VMs
+are booted with it without asking. A project config that changes has to be
+trusted again.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		project, err := config.FindProjectConfig()
+		if err != nil {
+			return err
+		}
+		if project == "" {
+			return fmt.Errorf("no %s in this directory or its parents", config.ProjectConfigName)
+		}
+		if err := config.Trust(project); err != nil {
+			return err
+		}
+		fmt.Printf("Trusted %s\n", project)
+		return nil
+	},
+}
+
+// loadTrustedConfig loads the configuration, making sure the user trusts
+// the project config merged into it
+func loadTrustedConfig() (*config.Config, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if err := checkProjectTrust(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// checkProjectTrust makes sure the user trusts the project config of cfg
+// before VMs are booted with it: it runs tools in the guest and can run
+// commands on the host, for secrets, and share host files. A project
+// config that is new or changed is shown and confirmed interactively.
+func checkProjectTrust(cfg *config.Config) error {
+	if cfg.Project == "" {
+		return nil
+	}
+
+	trusted, err := config.Trusted(cfg.Project)
+	if err != nil {
+		return err
+	}
+	if trusted {
+		return nil
+	}
+
+	if tty.Open(os.Stdin) == nil {
+		return fmt.Errorf("project config %s is not trusted, review it and run 'sear trust'", cfg.Project)
+	}
+
+	content, err := os.ReadFile(cfg.Project)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "The project config %s is new or changed:\n\n%s\n", cfg.Project, content)
+	fmt.Fprintf(os.Stderr, "It runs its tools in the VM and can run commands on this host and share host files.\nTrust it? [y/N] ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("project config %s is not trusted", cfg.Project)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return config.Trust(cfg.Project)
+	}
+	return fmt.Errorf("project config %s is not trusted", cfg.Project)
+}
@@ -2,17 +2,30 @@ package cmd
 
 import (
 	"fmt"
+	"path"
+	"strings"
 
 	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/vm"
 	"github.com/spf13/cobra"
 )
 
 var validateCmd = &cobra.Command{
-	Use:   "validate-config",
+	Use:   "validate-config [profile]",
 	Short: "Validate the configuration file",
-	Long:  "Check the configuration file for syntax errors and missing required fields.",
+	Long: `Check the configuration file for syntax errors and missing required fields.
+Profiles are checked with the settings of the profiles they extend merged
+in; given a profile, the result is printed.`,
+	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return validateConfig()
+		if err := validateConfig(); err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			fmt.Println()
+			return showProfile(args[0])
+		}
+		return nil
 	},
 }
 
@@ -43,8 +56,12 @@ func validateConfig() error {
 	fmt.Printf("✓ Default profile: %s\n", cfg.DefaultProfile)
 	fmt.Printf("✓ Total profiles: %d\n", len(cfg.Profiles))
 
-	for name := range cfg.Profiles {
-		fmt.Printf("  - %s\n", name)
+	for name, profile := range cfg.Profiles {
+		if len(profile.Extends) > 0 {
+			fmt.Printf("  - %s (extends %s)\n", name, strings.Join(profile.Extends, ", "))
+		} else {
+			fmt.Printf("  - %s\n", name)
+		}
 	}
 
 	return nil
@@ -59,9 +76,95 @@ func validateProfile(name string, profile config.Profile) error {
 		return fmt.Errorf("profile '%s': MemoryMiB must be greater than 0", name)
 	}
 
+	if _, err := vm.LogLevel(profile); err != nil {
+		return fmt.Errorf("profile '%s': %w", name, err)
+	}
+
+	if b := profile.VM.Balloon; b != nil {
+		if b.TargetMiB < 0 || b.TargetMiB > profile.VM.MemoryMiB {
+			return fmt.Errorf("profile '%s': balloon target_mib must be between 0 and memory_mib", name)
+		}
+		if b.StatsInterval < 0 {
+			return fmt.Errorf("profile '%s': balloon stats_interval must not be negative", name)
+		}
+	}
+
+	if n := profile.Network; n != nil {
+		switch n.Mode {
+		case "", config.NetworkModeNone:
+		default:
+			return fmt.Errorf("profile '%s': unknown network mode '%s'", name, n.Mode)
+		}
+		if n.Mode == config.NetworkModeNone && profile.VM.Vsock == nil && !profile.VM.Agent {
+			return fmt.Errorf("profile '%s': network mode none needs vm.vsock or vm.agent to reach the guest", name)
+		}
+	}
+	if v := profile.VM.Vsock; v != nil && v.CID > 0 && v.CID < 3 {
+		return fmt.Errorf("profile '%s': vsock cid must be 3 or greater", name)
+	}
+
+	// Check mounts
+	targets := make(map[string]bool)
+	for i, m := range profile.Mounts {
+		if m.Source == "" || m.Target == "" {
+			return fmt.Errorf("profile '%s': mount %d needs a source and a target", name, i+1)
+		}
+		if !path.IsAbs(m.Target) {
+			return fmt.Errorf("profile '%s': mount target '%s' must be an absolute path", name, m.Target)
+		}
+		if targets[m.Target] {
+			return fmt.Errorf("profile '%s': mount target '%s' is used more than once", name, m.Target)
+		}
+		targets[m.Target] = true
+	}
+
+	// Check env and secrets
+	names := make(map[string]bool)
+	for _, list := range [][]config.EnvVar{profile.Env, profile.Secrets} {
+		for i, e := range list {
+			if !validEnvName(e.Name) {
+				return fmt.Errorf("profile '%s': env entry %d needs a valid name", name, i+1)
+			}
+			if names[e.Name] {
+				return fmt.Errorf("profile '%s': env variable %s is defined more than once", name, e.Name)
+			}
+			names[e.Name] = true
+
+			sources := 0
+			for _, s := range []string{e.Value, e.Env, e.File, e.Command} {
+				if s != "" {
+					sources++
+				}
+			}
+			if sources > 1 {
+				return fmt.Errorf("profile '%s': %s must set only one of value, env, file and command", name, e.Name)
+			}
+		}
+	}
+
+	if profile.Pool != nil && profile.Pool.Size < 0 {
+		return fmt.Errorf("profile '%s': pool size must not be negative", name)
+	}
+
 	return nil
 }
 
+// validEnvName reports whether name can be exported by a shell
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func joinErrors(errors []string) string {
 	result := ""
 	for i, err := range errors {
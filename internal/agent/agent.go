@@ -0,0 +1,192 @@
+// Package agent implements the protocol between sear and sear-agent, a
+// small agent in the guest that replaces sshd as the control channel of a
+// VM.
+//
+// Each operation uses its own vsock connection. The host sends a request
+// as one JSON line and the agent answers with a JSON response line. Exec
+// requests then continue with frames carrying the standard streams, window
+// size changes and finally the exit status; SFTP requests continue with
+// the raw SFTP protocol.
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Port is the vsock port the agent listens on
+const Port = 1024
+
+// Version is the protocol version reported by ping
+const Version = 1
+
+// Operations a request can ask for
+const (
+	OpPing    = "ping"
+	OpExec    = "exec"
+	OpSFTP    = "sftp"
+	OpMount   = "mount"
+	OpNetwork = "network"
+	OpEnv     = "env"
+)
+
+// Request is the first line the host sends on a connection
+type Request struct {
+	Op string `json:"op"`
+
+	// Command is run by /bin/sh -c; an empty command starts a login shell
+	Command string `json:"command,omitempty"`
+	// TTY runs the command on a PTY of the given size and terminal type
+	TTY    bool   `json:"tty,omitempty"`
+	Term   string `json:"term,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+
+	// Source is mounted at Target; LABEL=<label> selects a drive by file
+	// system label
+	Source   string `json:"source,omitempty"`
+	Target   string `json:"target,omitempty"`
+	FSType   string `json:"fstype,omitempty"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+
+	// Gateway and DNSServer configure the guest network
+	Gateway   string `json:"gateway,omitempty"`
+	DNSServer string `json:"dns_server,omitempty"`
+
+	// Env replaces the environment added to later commands, as
+	// NAME=value; the agent keeps it in memory only
+	Env []string `json:"env,omitempty"`
+}
+
+// Response answers a request. Error is set if it failed.
+type Response struct {
+	Error string `json:"error,omitempty"`
+
+	// Version and Uptime answer pings
+	Version int     `json:"version,omitempty"`
+	Uptime  float64 `json:"uptime,omitempty"`
+}
+
+// Exit is the payload of the exit frame
+type Exit struct {
+	Code   int    `json:"code"`
+	Signal string `json:"signal,omitempty"`
+}
+
+// Frame types of an exec connection
+const (
+	// Host to guest
+	frameStdin    byte = 1
+	frameStdinEOF byte = 2
+	frameResize   byte = 3
+
+	// Guest to host
+	frameStdout byte = 10
+	frameStderr byte = 11
+	frameExit   byte = 12
+)
+
+// maxFrame bounds the payload of a frame and maxLine a JSON line
+const (
+	maxFrame = 1 << 20
+	maxLine  = 64 * 1024
+)
+
+// writeFrame writes one frame: its type, the payload length and payload
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(append(header[:], payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// frameWriter serializes frames written from several goroutines
+type frameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (f *frameWriter) write(typ byte, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return writeFrame(f.w, typ, payload)
+}
+
+// readFrame reads one frame
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds the limit", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// resizePayload encodes a window size
+func resizePayload(width, height int) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint16(b[0:], uint16(width))
+	binary.BigEndian.PutUint16(b[2:], uint16(height))
+	return b[:]
+}
+
+// parseResize decodes a window size
+func parseResize(b []byte) (width, height int, ok bool) {
+	if len(b) != 4 {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint16(b[0:])), int(binary.BigEndian.Uint16(b[2:])), true
+}
+
+// writeLine writes v as one JSON line
+func writeLine(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// readLine reads one JSON line into v. It reads byte by byte so that
+// nothing after the line is consumed: the connection may continue with
+// another protocol.
+func readLine(r io.Reader, v interface{}) error {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 0 {
+			if err == nil {
+				continue
+			}
+			if errors.Is(err, io.EOF) && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) >= maxLine {
+			return errors.New("line too long")
+		}
+		line = append(line, b[0])
+	}
+	return json.Unmarshal(line, v)
+}
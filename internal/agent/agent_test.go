@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/ssh"
+)
+
+// pipeClient returns a client connected to a server through in-memory
+// connections
+func pipeClient() *Client {
+	server := NewServer()
+	return NewClient(func(timeout time.Duration) (net.Conn, error) {
+		host, guest := net.Pipe()
+		go server.ServeConn(guest)
+		return host, nil
+	})
+}
+
+func TestPing(t *testing.T) {
+	resp, err := pipeClient().Ping()
+	if err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if resp.Version != Version {
+		t.Errorf("Version = %d, want %d", resp.Version, Version)
+	}
+}
+
+func TestExec(t *testing.T) {
+	c := pipeClient()
+
+	tests := []struct {
+		name, cmd, stdin string
+		stdout, stderr   string
+		exitCode         int
+		signal           string
+		nilStdin         bool
+	}{
+		{name: "streams", cmd: "echo out; echo err >&2; exit 3", stdout: "out\n", stderr: "err\n", exitCode: 3, nilStdin: true},
+		{name: "stdin", cmd: "cat", stdin: "hello", stdout: "hello"},
+		{name: "signal", cmd: "kill -TERM $$", exitCode: -1, signal: "TERM", nilStdin: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			opts := ssh.ExecOptions{Stdout: &stdout, Stderr: &stderr}
+			if !tt.nilStdin {
+				opts.Stdin = strings.NewReader(tt.stdin)
+			}
+
+			result, err := c.Exec(tt.cmd, opts)
+			if err != nil {
+				t.Fatalf("Exec: %v", err)
+			}
+			if result.ExitCode != tt.exitCode || result.Signal != tt.signal {
+				t.Errorf("result = %s, want exit %d signal %q", result, tt.exitCode, tt.signal)
+			}
+			if stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+				t.Errorf("stdout %q stderr %q, want %q and %q", stdout.String(), stderr.String(), tt.stdout, tt.stderr)
+			}
+		})
+	}
+
+	if err := c.ExecuteCommand("echo broken; false"); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("ExecuteCommand error = %v, want one with the output", err)
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	client, err := pipeClient().SFTP()
+	if err != nil {
+		t.Fatalf("SFTP: %v", err)
+	}
+	defer client.Close()
+
+	path := filepath.Join(t.TempDir(), "file")
+	f, err := client.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, "data"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if got, err := os.ReadFile(path); err != nil || string(got) != "data" {
+		t.Errorf("file = %q, %v", got, err)
+	}
+}
+
+func TestWriteInitramfs(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "sear-agent")
+	if err := os.WriteFile(bin, []byte("binary"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "initramfs.cpio")
+	if err := WriteInitramfs(bin, path); err != nil {
+		t.Fatalf("WriteInitramfs: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Walk the entries: every header and data block is 4 byte aligned
+	var names []string
+	for off := 0; ; {
+		if !bytes.HasPrefix(data[off:], []byte("070701")) {
+			t.Fatalf("no header at offset %d", off)
+		}
+		size := parseHex(t, data[off+54:off+62])
+		nameSize := parseHex(t, data[off+94:off+102])
+		name := string(data[off+110 : off+110+nameSize-1])
+		names = append(names, name)
+
+		off = align4(off + 110 + nameSize)
+		if name == "init" && string(data[off:off+size]) != "binary" {
+			t.Errorf("init holds %q", data[off:off+size])
+		}
+		off = align4(off + size)
+		if name == "TRAILER!!!" {
+			if off != len(data) {
+				t.Errorf("%d bytes after the trailer", len(data)-off)
+			}
+			break
+		}
+	}
+
+	want := "dev proc sys newroot dev/console init TRAILER!!!"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("entries = %s, want %s", got, want)
+	}
+}
+
+func parseHex(t *testing.T, b []byte) int {
+	t.Helper()
+	n, err := strconv.ParseInt(string(b), 16, 64)
+	if err != nil {
+		t.Fatalf("invalid header field %q", b)
+	}
+	return int(n)
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
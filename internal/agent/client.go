@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/ssh"
+	"github.com/nikiskaarup/sear/internal/tty"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// dialTimeout bounds the connect and the response to a request
+const dialTimeout = 10 * time.Second
+
+// Client talks to the agent in a guest. It offers the same operations as
+// the SSH client, so sear works the same over either.
+type Client struct {
+	dial ssh.Dialer
+}
+
+// NewClient creates a client that connects to the agent through dial
+func NewClient(dial ssh.Dialer) *Client {
+	return &Client{dial: dial}
+}
+
+// request opens a connection and sends req. On success the connection is
+// returned positioned after the response, for operations that continue
+// with a stream.
+func (c *Client) request(req Request) (net.Conn, *Response, error) {
+	conn, err := c.dial(dialTimeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to the agent: %w", err)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(dialTimeout)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	var resp Response
+	if err := writeLine(conn, req); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if err := readLine(conn, &resp); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("no response from the agent: %w", err)
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return nil, nil, errors.New(resp.Error)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, &resp, nil
+}
+
+// call sends a request that is complete with its response
+func (c *Client) call(req Request) (*Response, error) {
+	conn, resp, err := c.request(req)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return resp, nil
+}
+
+// Ping checks that the agent is alive and returns its version and uptime
+func (c *Client) Ping() (*Response, error) {
+	return c.call(Request{Op: OpPing})
+}
+
+// WaitReady blocks until the agent answers pings or the timeout expires
+func (c *Client) WaitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := c.Ping()
+		if err == nil {
+			logrus.Debugf("Agent version %d up for %.1fs", resp.Version, resp.Uptime)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("guest agent did not answer within %s: %w", timeout, err)
+		}
+		logrus.Debugf("Waiting for the agent: %v", err)
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// Close implements the SSH client interface; the agent uses a connection
+// per operation, so there is nothing to release
+func (c *Client) Close() error {
+	return nil
+}
+
+// Mount mounts a file system in the guest. source may be LABEL=<label>.
+func (c *Client) Mount(source, target string, readOnly bool) error {
+	_, err := c.call(Request{Op: OpMount, Source: source, Target: target, ReadOnly: readOnly})
+	return err
+}
+
+// ConfigureNetwork sets the default route and DNS server of the guest
+func (c *Client) ConfigureNetwork(gateway, dnsServer string) error {
+	_, err := c.call(Request{Op: OpNetwork, Gateway: gateway, DNSServer: dnsServer})
+	return err
+}
+
+// SetEnv sets the environment of all later commands and shells, given as
+// NAME=value
+func (c *Client) SetEnv(env []string) error {
+	_, err := c.call(Request{Op: OpEnv, Env: env})
+	return err
+}
+
+// Exec runs cmd in the guest, streaming its output. Like the SSH client,
+// a non-zero exit status is reported through the result, not as an error.
+func (c *Client) Exec(cmd string, opts ssh.ExecOptions) (*ssh.ExecResult, error) {
+	req := Request{Op: OpExec, Command: cmd}
+
+	var local *tty.Terminal
+	if opts.TTY {
+		local = tty.Open(os.Stdin)
+		req.TTY = true
+		req.Term = tty.Name()
+		req.Width, req.Height = local.Size()
+	}
+
+	conn, _, err := c.request(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start command: %w", err)
+	}
+	defer conn.Close()
+
+	w := &frameWriter{w: conn}
+
+	if local != nil {
+		if err := local.MakeRaw(); err != nil {
+			return nil, fmt.Errorf("failed to set terminal to raw mode: %w", err)
+		}
+		stopResize := local.WatchResize(func(width, height int) {
+			if err := w.write(frameResize, resizePayload(width, height)); err != nil {
+				logrus.Debugf("Failed to forward window size: %v", err)
+			}
+		})
+		defer func() {
+			stopResize()
+			if err := local.Restore(); err != nil {
+				logrus.Warnf("Failed to restore terminal: %v", err)
+			}
+		}()
+	}
+
+	go func() {
+		if opts.Stdin != nil {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := opts.Stdin.Read(buf)
+				if n > 0 {
+					if w.write(frameStdin, buf[:n]) != nil {
+						return
+					}
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+		_ = w.write(frameStdinEOF, nil)
+	}()
+
+	start := time.Now()
+	for {
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			return nil, fmt.Errorf("command exited without reporting a status (connection lost?): %w", err)
+		}
+
+		switch typ {
+		case frameStdout:
+			if opts.Stdout != nil {
+				_, _ = opts.Stdout.Write(payload)
+			}
+		case frameStderr:
+			if opts.Stderr != nil {
+				_, _ = opts.Stderr.Write(payload)
+			}
+		case frameExit:
+			var exit Exit
+			if err := json.Unmarshal(payload, &exit); err != nil {
+				return nil, fmt.Errorf("invalid exit status: %w", err)
+			}
+			result := &ssh.ExecResult{ExitCode: exit.Code, Duration: time.Since(start)}
+			if exit.Signal != "" {
+				result.ExitCode = -1
+				result.Signal = exit.Signal
+			}
+			return result, nil
+		}
+	}
+}
+
+// ExecuteCommand runs a command in the guest, returning an error that
+// includes the command output if it does not exit successfully
+func (c *Client) ExecuteCommand(cmd string) error {
+	var output bytes.Buffer
+	result, err := c.Exec(cmd, ssh.ExecOptions{Stdout: &output, Stderr: &output})
+	if err != nil {
+		return err
+	}
+
+	if !result.Success() {
+		return fmt.Errorf("command failed: %s, output: %s", result, strings.TrimSpace(output.String()))
+	}
+
+	return nil
+}
+
+// Shell starts an interactive login shell and waits for it to exit
+func (c *Client) Shell() (*ssh.ExecResult, error) {
+	return c.Exec("", ssh.ExecOptions{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		TTY:    true,
+	})
+}
+
+// SFTP opens an SFTP session served by the agent. The caller must close
+// the returned client.
+func (c *Client) SFTP() (*sftp.Client, error) {
+	conn, _, err := c.request(Request{Op: OpSFTP})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClientPipe(conn, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+
+	return client, nil
+}
+
+// Upload copies a local file or directory tree to the guest
+func (c *Client) Upload(localPath, remotePath string) error {
+	client, err := c.SFTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return ssh.Upload(client, localPath, remotePath)
+}
+
+// Download copies a file or directory tree from the guest to the host
+func (c *Client) Download(remotePath, localPath string) error {
+	client, err := c.SFTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return ssh.Download(client, remotePath, localPath)
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// cpio mode bits of the entries in the initramfs
+const (
+	cpioDir  = 0o040000
+	cpioFile = 0o100000
+	cpioChar = 0o020000
+)
+
+// WriteInitramfs writes an initramfs that runs the agent binary as /init,
+// with the empty directories it mounts the root file system and the
+// kernel file systems on
+func WriteInitramfs(agentBinary, path string) error {
+	bin, err := os.Open(agentBinary)
+	if err != nil {
+		return fmt.Errorf("failed to open agent binary: %w", err)
+	}
+	defer bin.Close()
+
+	info, err := bin.Stat()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create initramfs: %w", err)
+	}
+	defer f.Close()
+
+	w := &cpioWriter{w: bufio.NewWriter(f)}
+	for _, dir := range []string{"dev", "proc", "sys", "newroot"} {
+		w.header(dir, cpioDir|0o755, 0, 0, 0)
+	}
+	// The kernel opens the console for init before running it
+	w.header("dev/console", cpioChar|0o600, 0, 5, 1)
+	w.header("init", cpioFile|0o755, info.Size(), 0, 0)
+	if w.err == nil {
+		_, w.err = io.Copy(w.w, bin)
+		w.pad(info.Size())
+	}
+	w.header("TRAILER!!!", 0, 0, 0, 0)
+
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	if w.err != nil {
+		return fmt.Errorf("failed to write initramfs: %w", w.err)
+	}
+	return f.Close()
+}
+
+// cpioWriter writes an archive in the newc format the kernel unpacks
+type cpioWriter struct {
+	w     *bufio.Writer
+	inode int
+	err   error
+}
+
+// header writes the header of an entry; a file's data follows it
+func (c *cpioWriter) header(name string, mode uint32, size int64, rdevMajor, rdevMinor int) {
+	if c.err != nil {
+		return
+	}
+
+	c.inode++
+	nlink := 1
+	if mode&cpioDir != 0 {
+		nlink = 2
+	}
+
+	// Fields: magic, inode, mode, uid, gid, nlink, mtime, size, device
+	// major and minor, rdev major and minor, name size, checksum
+	_, c.err = fmt.Fprintf(c.w, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%s\x00",
+		c.inode, mode, 0, 0, nlink, 0, size, 0, 0, rdevMajor, rdevMinor, len(name)+1, 0, name)
+	// The 110 byte header and the name are padded to 4 bytes together
+	c.pad(int64(110 + len(name) + 1))
+}
+
+// pad aligns the archive to 4 bytes after n bytes were written
+func (c *cpioWriter) pad(n int64) {
+	if c.err != nil {
+		return
+	}
+	if rem := n % 4; rem != 0 {
+		_, c.err = c.w.Write(make([]byte, 4-rem))
+	}
+}
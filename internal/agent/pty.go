@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// startPTY starts cmd as session leader with a new PTY as its controlling
+// terminal and returns the master side
+func startPTY(cmd *exec.Cmd, width, height int) (*os.File, error) {
+	ptmx, pts, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	defer pts.Close()
+
+	if width > 0 && height > 0 {
+		if err := setWindowSize(ptmx, width, height); err != nil {
+			ptmx.Close()
+			return nil, err
+		}
+	}
+
+	cmd.Stdin = pts
+	cmd.Stdout = pts
+	cmd.Stderr = pts
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	if err := cmd.Start(); err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+
+	return ptmx, nil
+}
+
+// openPTY allocates a PTY pair. The master is used through the runtime
+// poller, so closing it interrupts pending reads.
+func openPTY() (ptmx, pts *os.File, err error) {
+	ptmx, err = os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open PTY: %w", err)
+	}
+
+	var n int
+	err = control(ptmx, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return err
+		}
+		n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		return err
+	})
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, fmt.Errorf("failed to unlock PTY: %w", err)
+	}
+
+	pts, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, fmt.Errorf("failed to open PTY: %w", err)
+	}
+
+	return ptmx, pts, nil
+}
+
+// setWindowSize sets the window size of a PTY
+func setWindowSize(ptmx *os.File, width, height int) error {
+	return control(ptmx, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{
+			Col: uint16(width),
+			Row: uint16(height),
+		})
+	})
+}
+
+// control runs fn on the descriptor of f without switching f to blocking
+// mode, which f.Fd would do
+func control(f *os.File, fn func(fd int) error) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var fnErr error
+	if err := conn.Control(func(fd uintptr) {
+		fnErr = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+	return fnErr
+}
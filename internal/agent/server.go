@@ -0,0 +1,381 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// guestPath is the PATH of commands run by the agent
+const guestPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Server is the guest side of the protocol, run by sear-agent
+type Server struct {
+	started time.Time
+
+	mu  sync.Mutex
+	env []string
+}
+
+// NewServer creates a server
+func NewServer() *Server {
+	return &Server{started: time.Now()}
+}
+
+// ServeConn handles one connection from the host and closes it
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	defer conn.Close()
+
+	var req Request
+	if err := readLine(conn, &req); err != nil {
+		logrus.Debugf("Invalid request: %v", err)
+		return
+	}
+
+	switch req.Op {
+	case OpPing:
+		_ = writeLine(conn, Response{Version: Version, Uptime: time.Since(s.started).Seconds()})
+	case OpExec:
+		s.exec(conn, req)
+	case OpSFTP:
+		s.sftp(conn)
+	case OpMount:
+		respond(conn, mount(req))
+	case OpNetwork:
+		respond(conn, configureNetwork(req))
+	case OpEnv:
+		s.mu.Lock()
+		s.env = req.Env
+		s.mu.Unlock()
+		respond(conn, nil)
+	default:
+		respond(conn, fmt.Errorf("unknown operation '%s'", req.Op))
+	}
+}
+
+// respond answers a request that is complete with its response
+func respond(w io.Writer, err error) {
+	var resp Response
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	_ = writeLine(w, resp)
+}
+
+// sftp serves the SFTP protocol on the rest of the connection
+func (s *Server) sftp(conn io.ReadWriteCloser) {
+	server, err := sftp.NewServer(conn)
+	if err != nil {
+		respond(conn, err)
+		return
+	}
+	respond(conn, nil)
+
+	if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+		logrus.Debugf("SFTP session ended: %v", err)
+	}
+}
+
+// exec runs a command and relays its streams as frames until it exits
+func (s *Server) exec(conn io.ReadWriteCloser, req Request) {
+	s.mu.Lock()
+	cmd := command(req, s.env)
+	s.mu.Unlock()
+	w := &frameWriter{w: conn}
+
+	var (
+		input  io.WriteCloser
+		resize func(width, height int)
+		copies sync.WaitGroup
+		err    error
+	)
+	if req.TTY {
+		var ptmx *os.File
+		ptmx, err = startPTY(cmd, req.Width, req.Height)
+		if err == nil {
+			input = ptmx
+			resize = func(width, height int) {
+				if err := setWindowSize(ptmx, width, height); err != nil {
+					logrus.Debugf("Failed to resize PTY: %v", err)
+				}
+			}
+			copies.Add(1)
+			go relay(w, frameStdout, ptmx, &copies)
+		}
+	} else {
+		var stdout, stderr io.ReadCloser
+		input, stdout, stderr, err = startPipes(cmd)
+		if err == nil {
+			copies.Add(2)
+			go relay(w, frameStdout, stdout, &copies)
+			go relay(w, frameStderr, stderr, &copies)
+		}
+	}
+	if err != nil {
+		respond(conn, fmt.Errorf("failed to start command: %w", err))
+		return
+	}
+	respond(conn, nil)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			typ, payload, err := readFrame(conn)
+			if err != nil {
+				// The host went away: hang up like sshd does
+				select {
+				case <-done:
+				default:
+					_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGHUP)
+				}
+				return
+			}
+
+			switch typ {
+			case frameStdin:
+				_, _ = input.Write(payload)
+			case frameStdinEOF:
+				// A PTY has no end of input; its session ends with the shell
+				if !req.TTY {
+					input.Close()
+				}
+			case frameResize:
+				if width, height, ok := parseResize(payload); ok && resize != nil {
+					resize(width, height)
+				}
+			}
+		}
+	}()
+
+	if req.TTY {
+		// Reading the PTY fails once the command and everything it started
+		// closed it; do not wait forever for background processes
+		_ = cmd.Wait()
+		waitTimeout(&copies, time.Second)
+		input.Close()
+		copies.Wait()
+	} else {
+		copies.Wait()
+		_ = cmd.Wait()
+	}
+	close(done)
+
+	payload, _ := json.Marshal(exitStatus(cmd.ProcessState))
+	_ = w.write(frameExit, payload)
+}
+
+// startPipes starts cmd with its standard streams connected to pipes
+func startPipes(cmd *exec.Cmd) (io.WriteCloser, io.ReadCloser, io.ReadCloser, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, nil, err
+	}
+	return stdin, stdout, stderr, nil
+}
+
+// relay sends everything read from r as frames of type typ
+func relay(w *frameWriter, typ byte, r io.Reader, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if w.write(typ, buf[:n]) != nil {
+				// Keep draining so that the command does not block
+				_, _ = io.Copy(io.Discard, r)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// waitTimeout waits for wg, at most for timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// command builds the command of an exec request, run as root in its home
+// directory like an SSH session, with env added to its environment
+func command(req Request, env []string) *exec.Cmd {
+	shell := loginShell()
+
+	var cmd *exec.Cmd
+	if req.Command == "" {
+		cmd = exec.Command(shell)
+		// A leading dash makes the shell a login shell
+		cmd.Args = []string{"-" + filepath.Base(shell)}
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", req.Command)
+	}
+
+	cmd.Env = []string{
+		"HOME=/root",
+		"USER=root",
+		"LOGNAME=root",
+		"SHELL=" + shell,
+		"PATH=" + guestPath,
+	}
+	if req.TTY {
+		cmd.Env = append(cmd.Env, "TERM="+req.Term)
+	}
+	cmd.Env = append(cmd.Env, env...)
+	if info, err := os.Stat("/root"); err == nil && info.IsDir() {
+		cmd.Dir = "/root"
+	}
+
+	return cmd
+}
+
+// loginShell returns the shell of root from /etc/passwd
+func loginShell() string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "/bin/sh"
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == "root" && fields[6] != "" {
+			return fields[6]
+		}
+	}
+	return "/bin/sh"
+}
+
+// exitStatus describes how a command terminated
+func exitStatus(state *os.ProcessState) Exit {
+	if state == nil {
+		return Exit{Code: -1}
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return Exit{Code: -1, Signal: strings.TrimPrefix(unix.SignalName(ws.Signal()), "SIG")}
+	}
+	return Exit{Code: state.ExitCode()}
+}
+
+// mount mounts the file system of a mount request
+func mount(req Request) error {
+	source := req.Source
+	if label, ok := strings.CutPrefix(source, "LABEL="); ok {
+		dev, err := findLabel(label)
+		if err != nil {
+			return err
+		}
+		source = dev
+	}
+
+	fstype := req.FSType
+	if fstype == "" {
+		fstype = "ext4"
+	}
+
+	if err := os.MkdirAll(req.Target, 0o755); err != nil {
+		return err
+	}
+
+	var flags uintptr
+	if req.ReadOnly {
+		flags |= unix.MS_RDONLY
+	}
+	if err := unix.Mount(source, req.Target, fstype, flags, ""); err != nil {
+		return fmt.Errorf("failed to mount %s on %s: %w", source, req.Target, err)
+	}
+	return nil
+}
+
+// findLabel returns the block device holding the ext2/3/4 file system
+// with the given label
+func findLabel(label string) (string, error) {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		dev := "/dev/" + entry.Name()
+		if l, err := extLabel(dev); err == nil && l == label {
+			return dev, nil
+		}
+	}
+	return "", fmt.Errorf("no drive with label %s", label)
+}
+
+// extLabel reads the volume label from the superblock of an ext file
+// system
+func extLabel(dev string) (string, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The superblock starts at byte 1024; the magic number is at offset
+	// 56 and the 16 byte volume name at offset 120
+	sb := make([]byte, 136)
+	if _, err := f.ReadAt(sb, 1024); err != nil {
+		return "", err
+	}
+	if sb[56] != 0x53 || sb[57] != 0xef {
+		return "", errors.New("not an ext file system")
+	}
+	return strings.TrimRight(string(sb[120:136]), "\x00"), nil
+}
+
+// configureNetwork sets the DNS server and default route of a network
+// request
+func configureNetwork(req Request) error {
+	if req.DNSServer != "" {
+		if err := os.WriteFile("/etc/resolv.conf", []byte("nameserver "+req.DNSServer+"\n"), 0o644); err != nil {
+			return fmt.Errorf("failed to configure DNS: %w", err)
+		}
+	}
+
+	if req.Gateway != "" {
+		out, err := exec.Command("ip", "route", "replace", "default", "via", req.Gateway, "dev", "eth0").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to add default route: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	return nil
+}
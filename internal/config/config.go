@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -22,12 +23,36 @@ func Load() (*Config, error) {
 	v.AddConfigPath(configHome)
 	v.AddConfigPath(".")
 
-	// Read config file
+	project, err := FindProjectConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for a project config: %w", err)
+	}
+
+	// Read config file; a project config can do without it
 	if err := v.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		if project == "" {
 			return nil, fmt.Errorf("config file not found. Searched in: %s/config.yaml", configHome)
 		}
-		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	// The project config is merged over the user config, key by key
+	if project != "" {
+		if err := mergeProjectConfig(v, project); err != nil {
+			return nil, err
+		}
+		logrus.Debugf("Using project config %s", project)
+	}
+
+	// Profiles inherit the settings of the profiles they extend
+	if raw, ok := v.Get("profiles").(map[string]interface{}); ok {
+		profiles, err := resolveExtends(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving profiles: %w", err)
+		}
+		v.Set("profiles", profiles)
 	}
 
 	var cfg Config
@@ -35,6 +60,12 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("error parsing config: %w", err)
 	}
 
+	for name, profile := range cfg.Profiles {
+		profile.Name = name
+		cfg.Profiles[name] = profile
+	}
+	cfg.Project = project
+
 	// Apply environment variable overrides
 	applyEnvOverrides(&cfg)
 
@@ -42,6 +73,58 @@ func Load() (*Config, error) {
 	return &cfg, nil
 }
 
+// mergeProjectConfig merges the project config at path into v. Relative
+// host paths in its profiles are relative to the directory holding it.
+func mergeProjectConfig(v *viper.Viper, path string) error {
+	pv := viper.New()
+	pv.SetConfigFile(path)
+	pv.SetConfigType("yaml")
+	if err := pv.ReadInConfig(); err != nil {
+		return fmt.Errorf("error reading project config %s: %w", path, err)
+	}
+
+	settings := pv.AllSettings()
+	if profiles, ok := settings["profiles"].(map[string]interface{}); ok {
+		for _, profile := range profiles {
+			if p, ok := profile.(map[string]interface{}); ok {
+				resolveProjectPaths(p, filepath.Dir(path))
+			}
+		}
+	}
+
+	if err := v.MergeConfigMap(settings); err != nil {
+		return fmt.Errorf("error reading project config %s: %w", path, err)
+	}
+	return nil
+}
+
+// resolveProjectPaths makes the relative host paths of a profile from a
+// project config relative to dir: the kernel and rootfs images, the
+// sources of files and mounts and the files env and secrets are read from
+func resolveProjectPaths(profile map[string]interface{}, dir string) {
+	resolve := func(m map[string]interface{}, key string) {
+		p, ok := m[key].(string)
+		if !ok || p == "" || filepath.IsAbs(p) || strings.HasPrefix(p, "~") || strings.HasPrefix(p, "$") {
+			return
+		}
+		m[key] = filepath.Join(dir, p)
+	}
+
+	if vm, ok := profile["vm"].(map[string]interface{}); ok {
+		resolve(vm, "kernel")
+		resolve(vm, "rootfs")
+	}
+
+	for list, key := range map[string]string{"files": "source", "mounts": "source", "env": "file", "secrets": "file"} {
+		entries, _ := profile[list].([]interface{})
+		for _, entry := range entries {
+			if m, ok := entry.(map[string]interface{}); ok {
+				resolve(m, key)
+			}
+		}
+	}
+}
+
 func setDefaults(v *viper.Viper) {
 	// Network defaults
 	v.SetDefault("network.tap_device", "tap0")
@@ -50,8 +133,7 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("network.gateway_ip", "172.16.0.1")
 	v.SetDefault("network.dns_server", "1.1.1.1")
 
-	// SSH defaults
-	v.SetDefault("ssh.key_path", "sear_key")
+	// SSH defaults; without a key_path sear generates a key per VM
 	v.SetDefault("ssh.username", "root")
 }
 
@@ -82,3 +164,19 @@ func applyEnvOverrides(cfg *Config) {
 		cfg.SSH.KeyPath = sshKey
 	}
 }
+
+// ExpandPath expands a leading ~ and environment variables in path and
+// makes it absolute relative to the current working directory
+func ExpandPath(path string) (string, error) {
+	path = os.ExpandEnv(path)
+
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to expand %s: %w", path, err)
+		}
+		path = filepath.Join(home, path[1:])
+	}
+
+	return filepath.Abs(path)
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// profileLists are the list settings of a profile that are joined with
+// those of the profiles it extends instead of replacing them, with the
+// field that identifies an entry. Entries of the extending profile replace
+// inherited ones with the same identity; tools are identified by the
+// command itself.
+var profileLists = map[string]string{
+	"tools":   "",
+	"files":   "target",
+	"mounts":  "target",
+	"env":     "name",
+	"secrets": "name",
+}
+
+// resolveExtends returns the profiles with the settings of the profiles
+// they extend merged in. A profile extends one profile or a list of them;
+// they are applied in order, so later ones override earlier ones, and the
+// profile itself overrides all of them.
+func resolveExtends(profiles map[string]interface{}) (map[string]interface{}, error) {
+	r := &resolver{
+		raw:      profiles,
+		resolved: make(map[string]map[string]interface{}),
+	}
+
+	out := make(map[string]interface{}, len(profiles))
+	for name := range profiles {
+		p, err := r.resolve(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = p
+	}
+	return out, nil
+}
+
+// resolver resolves the profiles of a configuration, each once
+type resolver struct {
+	raw      map[string]interface{}
+	resolved map[string]map[string]interface{}
+}
+
+// resolve returns a profile merged with the profiles it extends. chain
+// holds the profiles being resolved that lead to it.
+func (r *resolver) resolve(name string, chain []string) (map[string]interface{}, error) {
+	if p, ok := r.resolved[name]; ok {
+		return p, nil
+	}
+	for _, c := range chain {
+		if c == name {
+			return nil, fmt.Errorf("profile '%s' extends itself: %s", name, strings.Join(append(chain, name), " -> "))
+		}
+	}
+	chain = append(chain, name)
+
+	profile, ok := r.raw[name].(map[string]interface{})
+	if !ok {
+		if r.raw[name] != nil {
+			return nil, fmt.Errorf("profile '%s' is not a mapping", name)
+		}
+		profile = map[string]interface{}{}
+	}
+
+	parents, err := extendsList(profile["extends"])
+	if err != nil {
+		return nil, fmt.Errorf("profile '%s': %w", name, err)
+	}
+
+	merged := map[string]interface{}{}
+	for _, parent := range parents {
+		if _, ok := r.raw[parent]; !ok {
+			return nil, fmt.Errorf("profile '%s' extends unknown profile '%s'", name, parent)
+		}
+		p, err := r.resolve(parent, chain)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeProfile(merged, p)
+	}
+	merged = mergeProfile(merged, profile)
+	if len(parents) > 0 {
+		merged["extends"] = parents
+	}
+
+	r.resolved[name] = merged
+	return merged, nil
+}
+
+// extendsList returns the profiles named by an extends setting, a single
+// name or a list of them
+func extendsList(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		names := make([]string, 0, len(v))
+		for _, item := range v {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("extends must list profile names, got %v", item)
+			}
+			names = append(names, name)
+		}
+		return names, nil
+	case []string:
+		return v, nil
+	}
+	return nil, fmt.Errorf("extends must be a profile name or a list of them, got %v", v)
+}
+
+// mergeProfile returns the settings of child merged over those of parent.
+// Mappings such as vm and network are merged key by key, the lists in
+// profileLists are joined and anything else set in child replaces the
+// setting of parent. extends is not inherited.
+func mergeProfile(parent, child map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(parent)+len(child))
+	for k, v := range parent {
+		if k != "extends" {
+			out[k] = v
+		}
+	}
+
+	for k, v := range child {
+		if k == "extends" {
+			continue
+		}
+		if id, ok := profileLists[k]; ok {
+			out[k] = mergeList(out[k], v, id)
+			continue
+		}
+		out[k] = mergeValue(out[k], v)
+	}
+	return out
+}
+
+// mergeValue merges mappings key by key; any other value of child
+// replaces that of parent
+func mergeValue(parent, child interface{}) interface{} {
+	p, ok1 := parent.(map[string]interface{})
+	c, ok2 := child.(map[string]interface{})
+	if !ok1 || !ok2 {
+		return child
+	}
+
+	out := make(map[string]interface{}, len(p)+len(c))
+	for k, v := range p {
+		out[k] = v
+	}
+	for k, v := range c {
+		out[k] = mergeValue(out[k], v)
+	}
+	return out
+}
+
+// mergeList appends the entries of child to those of parent. An entry of
+// child whose id field, or whole value if id is empty, equals that of an
+// entry of parent replaces it in place.
+func mergeList(parent, child interface{}, id string) interface{} {
+	p, ok1 := parent.([]interface{})
+	c, ok2 := child.([]interface{})
+	if !ok1 || !ok2 {
+		if child == nil {
+			return parent
+		}
+		return child
+	}
+
+	out := append([]interface{}{}, p...)
+	for _, entry := range c {
+		replaced := false
+		for i, existing := range out {
+			if sameEntry(existing, entry, id) {
+				out[i] = entry
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// sameEntry reports whether two list entries have the same identity
+func sameEntry(a, b interface{}, id string) bool {
+	if id == "" {
+		return reflect.DeepEqual(a, b)
+	}
+	ma, ok1 := a.(map[string]interface{})
+	mb, ok2 := b.(map[string]interface{})
+	if !ok1 || !ok2 || ma[id] == nil {
+		return false
+	}
+	return reflect.DeepEqual(ma[id], mb[id])
+}
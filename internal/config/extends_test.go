@@ -0,0 +1,104 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveExtends(t *testing.T) {
+	profiles := map[string]interface{}{
+		"base": map[string]interface{}{
+			"vm":    map[string]interface{}{"vcpus": 1, "kernel": "/k", "agent": true},
+			"tools": []interface{}{"apt-get update"},
+			"mounts": []interface{}{
+				map[string]interface{}{"source": "/a", "target": "/x"},
+			},
+		},
+		"net": map[string]interface{}{
+			"network": map[string]interface{}{"dns_server": "1.1.1.1"},
+			"tools":   []interface{}{"ping -c1 example.com"},
+		},
+		"rust": map[string]interface{}{
+			"extends": []interface{}{"base", "net"},
+			"vm":      map[string]interface{}{"vcpus": 2, "agent": false},
+			"tools":   []interface{}{"cargo --version", "apt-get update"},
+			"mounts": []interface{}{
+				map[string]interface{}{"source": "/b", "target": "/x"},
+				map[string]interface{}{"source": "/c", "target": "/y"},
+			},
+		},
+	}
+
+	resolved, err := resolveExtends(profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"extends": []string{"base", "net"},
+		"vm":      map[string]interface{}{"vcpus": 2, "kernel": "/k", "agent": false},
+		"network": map[string]interface{}{"dns_server": "1.1.1.1"},
+		"tools":   []interface{}{"apt-get update", "ping -c1 example.com", "cargo --version"},
+		"mounts": []interface{}{
+			map[string]interface{}{"source": "/b", "target": "/x"},
+			map[string]interface{}{"source": "/c", "target": "/y"},
+		},
+	}
+	if got := resolved["rust"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("rust resolved to\n%v\nwant\n%v", got, want)
+	}
+
+	// The profiles extended are left as they are
+	if got := resolved["base"].(map[string]interface{})["vm"]; !reflect.DeepEqual(got, profiles["base"].(map[string]interface{})["vm"]) {
+		t.Errorf("base changed to %v", got)
+	}
+}
+
+func TestResolveExtendsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		profiles map[string]interface{}
+		want     string
+	}{
+		{
+			name: "cycle",
+			profiles: map[string]interface{}{
+				"a": map[string]interface{}{"extends": "b"},
+				"b": map[string]interface{}{"extends": []interface{}{"c"}},
+				"c": map[string]interface{}{"extends": "a"},
+			},
+			want: "extends itself",
+		},
+		{
+			name: "self",
+			profiles: map[string]interface{}{
+				"a": map[string]interface{}{"extends": "a"},
+			},
+			want: "a -> a",
+		},
+		{
+			name: "unknown",
+			profiles: map[string]interface{}{
+				"a": map[string]interface{}{"extends": "missing"},
+			},
+			want: "unknown profile 'missing'",
+		},
+		{
+			name: "invalid",
+			profiles: map[string]interface{}{
+				"a": map[string]interface{}{"extends": 3},
+			},
+			want: "profile name or a list",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := resolveExtends(tt.profiles)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -1,18 +1,109 @@
 package config
 
+import "time"
+
 // Config represents the main configuration structure
 type Config struct {
 	DefaultProfile string             `yaml:"default_profile"`
 	Profiles       map[string]Profile `yaml:"profiles"`
 	Network        *NetworkConfig     `yaml:"network,omitempty"`
 	SSH            *SSHConfig         `yaml:"ssh,omitempty"`
+
+	// Project is the path of the project config merged over the user
+	// config, if any
+	Project string `mapstructure:"-" yaml:"-"`
 }
 
 // Profile represents a VM profile configuration
 type Profile struct {
+	// Name is the key of the profile in the configuration, filled in by Load
+	Name string `mapstructure:"-" yaml:"-"`
+
+	// Extends names the profiles this one is based on; Load merges their
+	// settings in and keeps the names for display
+	Extends []string `mapstructure:"extends" yaml:"extends,omitempty"`
+
 	VM      VMConfig       `yaml:"vm"`
+	Files   []FileConfig   `yaml:"files,omitempty"`
 	Tools   []string       `yaml:"tools"`
 	Network *NetworkConfig `yaml:"network,omitempty"`
+
+	Workspace *WorkspaceConfig `mapstructure:"workspace" yaml:"workspace,omitempty"`
+	Mounts    []MountConfig    `mapstructure:"mounts" yaml:"mounts,omitempty"`
+	Pool      *PoolConfig      `mapstructure:"pool" yaml:"pool,omitempty"`
+
+	// Metadata is published to the guest through the metadata service
+	Metadata map[string]interface{} `mapstructure:"metadata" yaml:"metadata,omitempty"`
+	MMDS     *MMDSConfig            `mapstructure:"mmds" yaml:"mmds,omitempty"`
+
+	// Env and Secrets are set in every command and shell in the guest;
+	// secret values are kept out of logs and snapshots
+	Env     []EnvVar `mapstructure:"env" yaml:"env,omitempty"`
+	Secrets []EnvVar `mapstructure:"secrets" yaml:"secrets,omitempty"`
+}
+
+// EnvVar is an environment variable of guest sessions. Its value is
+// Value, or read from a host environment variable, a file or the output
+// of a command; exactly one of them is set.
+type EnvVar struct {
+	Name    string `mapstructure:"name" yaml:"name"`
+	Value   string `mapstructure:"value" yaml:"value,omitempty"`
+	Env     string `mapstructure:"env" yaml:"env,omitempty"`
+	File    string `mapstructure:"file" yaml:"file,omitempty"`
+	Command string `mapstructure:"command" yaml:"command,omitempty"`
+}
+
+// MMDSConfig controls what the metadata service offers the guest besides
+// the VM description and the profile metadata
+type MMDSConfig struct {
+	// Secrets names secrets of the profile, or host environment
+	// variables, published with their values; any process in the guest
+	// can read them
+	Secrets []string `mapstructure:"secrets" yaml:"secrets,omitempty"`
+}
+
+// PoolConfig controls the warm pool of a profile kept by 'sear pool serve'
+type PoolConfig struct {
+	// Size is the number of idle, provisioned VMs to keep ready
+	Size int `mapstructure:"size" yaml:"size"`
+}
+
+// WorkspaceConfig controls how the current directory is shared with the guest
+type WorkspaceConfig struct {
+	// Mode selects the sharing backend, defaults to sshfs
+	Mode string `mapstructure:"mode" yaml:"mode,omitempty"`
+	// Target is the mount point in the guest, defaults to /host
+	Target string `mapstructure:"target" yaml:"target,omitempty"`
+	// Conflict is the sync mode conflict rule: newer (default), host or guest
+	Conflict string `mapstructure:"conflict" yaml:"conflict,omitempty"`
+	// Pull is when sync mode copies guest changes back: exit (default) or
+	// continuous
+	Pull string `mapstructure:"pull" yaml:"pull,omitempty"`
+	// PullInterval is the guest scan interval in continuous pull mode
+	PullInterval time.Duration `mapstructure:"pull_interval" yaml:"pull_interval,omitempty"`
+	// Extract copies guest changes back to the host on exit in image mode
+	Extract bool `mapstructure:"extract" yaml:"extract,omitempty"`
+}
+
+// MountConfig describes a host directory shared with the guest in
+// addition to the current directory
+type MountConfig struct {
+	// Source is the host directory; ~, environment variables and paths
+	// relative to the current directory are expanded
+	Source string `mapstructure:"source" yaml:"source"`
+	// Target is the mount point in the guest
+	Target string `mapstructure:"target" yaml:"target"`
+	// ReadOnly keeps the guest from changing the host directory
+	ReadOnly bool `mapstructure:"read_only" yaml:"read_only,omitempty"`
+	// Mode selects the sharing backend, defaults to the workspace mode
+	Mode string `mapstructure:"mode" yaml:"mode,omitempty"`
+}
+
+// FileConfig describes a host file or directory copied into the guest
+// during provisioning, before the tools are run
+type FileConfig struct {
+	Source string `mapstructure:"source" yaml:"source"`
+	Target string `mapstructure:"target" yaml:"target"`
 }
 
 // VMConfig represents Firecracker VM configuration
@@ -22,20 +113,64 @@ type VMConfig struct {
 	RootFS     string `mapstructure:"rootfs" yaml:"rootfs"`
 	Kernel     string `mapstructure:"kernel" yaml:"kernel"`
 	KernelArgs string `mapstructure:"kernel_args" yaml:"kernel_args"`
+	// LogLevel is the Firecracker log level: error, warning, info
+	// (default), debug, trace or off
+	LogLevel string `mapstructure:"log_level" yaml:"log_level,omitempty"`
+
+	Balloon *BalloonConfig `mapstructure:"balloon" yaml:"balloon,omitempty"`
+	Vsock   *VsockConfig   `mapstructure:"vsock" yaml:"vsock,omitempty"`
+	// Agent boots the VM with sear-agent as init helper and controls it
+	// through the agent instead of SSH; it implies a vsock device
+	Agent bool `mapstructure:"agent" yaml:"agent,omitempty"`
 }
 
-// NetworkConfig represents network configuration
+// VsockConfig adds a virtio-vsock device to the VM. sear then reaches
+// sshd in the guest over vsock instead of the network.
+type VsockConfig struct {
+	// CID is the context ID of the guest, defaults to 3
+	CID uint32 `mapstructure:"cid" yaml:"cid,omitempty"`
+	// SSHPort is the vsock port sshd listens on in the guest, defaults
+	// to 22
+	SSHPort uint32 `mapstructure:"ssh_port" yaml:"ssh_port,omitempty"`
+}
+
+// BalloonConfig adds a memory balloon device to the VM, which returns
+// guest memory to the host
+type BalloonConfig struct {
+	// TargetMiB is the memory taken from the guest at boot; it can be
+	// changed at runtime with 'sear balloon'
+	TargetMiB int `mapstructure:"target_mib" yaml:"target_mib"`
+	// DeflateOnOOM lets the guest reclaim memory from the balloon when it
+	// runs out
+	DeflateOnOOM bool `mapstructure:"deflate_on_oom" yaml:"deflate_on_oom,omitempty"`
+	// StatsInterval is how often the guest reports memory statistics,
+	// rounded to seconds; statistics are disabled if unset
+	StatsInterval time.Duration `mapstructure:"stats_interval" yaml:"stats_interval,omitempty"`
+}
+
+// NetworkModeNone gives a VM no network device at all
+const NetworkModeNone = "none"
+
+// NetworkConfig represents network configuration. Profiles that do not
+// set a TAP device get a network allocated per VM.
 type NetworkConfig struct {
-	TAPDevice     string `yaml:"tap_device,omitempty"`
-	TAPIP         string `yaml:"tap_ip,omitempty"`
-	GuestIP       string `yaml:"guest_ip,omitempty"`
-	GatewayIP     string `yaml:"gateway_ip,omitempty"`
-	HostInterface string `yaml:"host_interface,omitempty"`
-	DNSServer     string `yaml:"dns_server,omitempty"`
+	// Mode is "none" for a VM without network device, which needs a
+	// vsock device to be reachable; otherwise the VM gets a TAP device
+	Mode string `mapstructure:"mode" yaml:"mode,omitempty"`
+
+	TAPDevice     string `mapstructure:"tap_device" yaml:"tap_device,omitempty"`
+	TAPIP         string `mapstructure:"tap_ip" yaml:"tap_ip,omitempty"`
+	GuestIP       string `mapstructure:"guest_ip" yaml:"guest_ip,omitempty"`
+	GatewayIP     string `mapstructure:"gateway_ip" yaml:"gateway_ip,omitempty"`
+	HostInterface string `mapstructure:"host_interface" yaml:"host_interface,omitempty"`
+	DNSServer     string `mapstructure:"dns_server" yaml:"dns_server,omitempty"`
 }
 
 // SSHConfig represents SSH configuration
 type SSHConfig struct {
-	KeyPath  string `yaml:"key_path,omitempty"`
-	Username string `yaml:"username,omitempty"`
+	KeyPath  string `mapstructure:"key_path" yaml:"key_path,omitempty"`
+	Username string `mapstructure:"username" yaml:"username,omitempty"`
+	// ForwardAgent forwards the host SSH agent into shells and commands,
+	// like sear run -A
+	ForwardAgent bool `mapstructure:"forward_agent" yaml:"forward_agent,omitempty"`
 }
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ProjectConfigName is the file name of project configurations
+const ProjectConfigName = ".sear.yaml"
+
+// trustFile lists the project configurations the user trusts, in the
+// user configuration directory
+const trustFile = "trusted-projects.json"
+
+// FindProjectConfig returns the project configuration that applies in the
+// current directory, or "" if there is none
+func FindProjectConfig() (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	home, _ := os.UserHomeDir()
+	return findProjectConfig(cwd, home), nil
+}
+
+// findProjectConfig searches dir and its parents for a project
+// configuration. The search stops at the root of the git repository dir
+// is in, or at home.
+func findProjectConfig(dir, home string) string {
+	for {
+		path := filepath.Join(dir, ProjectConfigName)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if dir == home || parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Trusted reports whether the user trusts the project configuration at
+// path in its current content
+func Trusted(path string) (bool, error) {
+	sum, err := fileSum(path)
+	if err != nil {
+		return false, err
+	}
+	trusted, err := loadTrusted()
+	if err != nil {
+		return false, err
+	}
+	return trusted[path] == sum, nil
+}
+
+// Trust records that the user trusts the project configuration at path
+// in its current content; any change to it needs to be trusted again
+func Trust(path string) error {
+	sum, err := fileSum(path)
+	if err != nil {
+		return err
+	}
+	trusted, err := loadTrusted()
+	if err != nil {
+		return err
+	}
+	trusted[path] = sum
+
+	data, err := json.MarshalIndent(trusted, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := getConfigHome()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	tmp := filepath.Join(dir, trustFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to record trusted project: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, trustFile)); err != nil {
+		return fmt.Errorf("failed to record trusted project: %w", err)
+	}
+	return nil
+}
+
+// loadTrusted reads the trusted project configurations, as a map from
+// path to the SHA-256 of their content
+func loadTrusted() (map[string]string, error) {
+	trusted := make(map[string]string)
+
+	data, err := os.ReadFile(filepath.Join(getConfigHome(), trustFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return trusted, nil
+		}
+		return nil, fmt.Errorf("failed to read trusted projects: %w", err)
+	}
+	if err := json.Unmarshal(data, &trusted); err != nil {
+		return nil, fmt.Errorf("failed to parse trusted projects: %w", err)
+	}
+	return trusted, nil
+}
+
+// fileSum returns the SHA-256 of the content of a file
+func fileSum(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
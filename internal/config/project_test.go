@@ -0,0 +1,115 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindProjectConfig(t *testing.T) {
+	root := t.TempDir()
+	home := filepath.Join(root, "home")
+	repo := filepath.Join(home, "repo")
+	sub := filepath.Join(repo, "src", "pkg")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(path string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte("profiles: {}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing up to the home directory
+	if got := findProjectConfig(sub, home); got != "" {
+		t.Errorf("found %s without a project config", got)
+	}
+
+	// The home directory is the last one searched
+	write(filepath.Join(root, ProjectConfigName))
+	if got := findProjectConfig(sub, home); got != "" {
+		t.Errorf("found %s above the home directory", got)
+	}
+	write(filepath.Join(home, ProjectConfigName))
+	if got, want := findProjectConfig(sub, home), filepath.Join(home, ProjectConfigName); got != want {
+		t.Errorf("found %q, want %q", got, want)
+	}
+
+	// So is the root of a git repository
+	if err := os.Mkdir(filepath.Join(repo, ".git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := findProjectConfig(sub, home); got != "" {
+		t.Errorf("found %s outside the git repository", got)
+	}
+	write(filepath.Join(repo, ProjectConfigName))
+	if got, want := findProjectConfig(sub, home), filepath.Join(repo, ProjectConfigName); got != want {
+		t.Errorf("found %q, want %q", got, want)
+	}
+
+	// The nearest one wins
+	write(filepath.Join(sub, ProjectConfigName))
+	if got, want := findProjectConfig(sub, home), filepath.Join(sub, ProjectConfigName); got != want {
+		t.Errorf("found %q, want %q", got, want)
+	}
+}
+
+func TestTrust(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), ProjectConfigName)
+	if err := os.WriteFile(path, []byte("profiles: {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := Trusted(path); err != nil || ok {
+		t.Fatalf("Trusted before Trust = %v, %v", ok, err)
+	}
+	if err := Trust(path); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Trusted(path); err != nil || !ok {
+		t.Fatalf("Trusted after Trust = %v, %v", ok, err)
+	}
+
+	// A change needs to be trusted again
+	if err := os.WriteFile(path, []byte("profiles: {evil: {}}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Trusted(path); err != nil || ok {
+		t.Fatalf("Trusted after change = %v, %v", ok, err)
+	}
+}
+
+func TestResolveProjectPaths(t *testing.T) {
+	profile := map[string]interface{}{
+		"vm": map[string]interface{}{"kernel": "images/vmlinux", "rootfs": "/abs/rootfs.ext4"},
+		"files": []interface{}{
+			map[string]interface{}{"source": "conf/cargo.toml", "target": "/root/.cargo/config.toml"},
+		},
+		"mounts": []interface{}{
+			map[string]interface{}{"source": "~/cache", "target": "/cache"},
+			map[string]interface{}{"source": "$HOME/data", "target": "/data"},
+		},
+		"secrets": []interface{}{
+			map[string]interface{}{"name": "TOKEN", "file": "../token"},
+		},
+	}
+	resolveProjectPaths(profile, "/repo")
+
+	checks := []struct {
+		got, want interface{}
+	}{
+		{profile["vm"].(map[string]interface{})["kernel"], "/repo/images/vmlinux"},
+		{profile["vm"].(map[string]interface{})["rootfs"], "/abs/rootfs.ext4"},
+		{profile["files"].([]interface{})[0].(map[string]interface{})["source"], "/repo/conf/cargo.toml"},
+		{profile["mounts"].([]interface{})[0].(map[string]interface{})["source"], "~/cache"},
+		{profile["mounts"].([]interface{})[1].(map[string]interface{})["source"], "$HOME/data"},
+		{profile["secrets"].([]interface{})[0].(map[string]interface{})["file"], "/token"},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("got %v, want %v", c.got, c.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package console
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/nikiskaarup/sear/internal/tty"
+)
+
+// EscapeChar detaches from the console: Ctrl-]
+const EscapeChar = 0x1d
+
+// Attach connects in and out to the console served at socketPath until
+// EscapeChar is typed or the console goes away. If in is a terminal it is
+// put into raw mode meanwhile.
+func Attach(socketPath string, in *os.File, out io.Writer) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to console: %w", err)
+	}
+	defer conn.Close()
+
+	if local := tty.Open(in); local != nil {
+		if err := local.MakeRaw(); err != nil {
+			return fmt.Errorf("failed to set terminal to raw mode: %w", err)
+		}
+		defer local.Restore()
+	}
+
+	done := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(out, conn)
+		if err == nil {
+			err = errors.New("console closed")
+		}
+		done <- err
+	}()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := in.Read(buf)
+			if i := bytes.IndexByte(buf[:n], EscapeChar); i >= 0 {
+				_, _ = conn.Write(buf[:i])
+				done <- nil
+				return
+			}
+			if n > 0 {
+				if _, err := conn.Write(buf[:n]); err != nil {
+					done <- err
+					return
+				}
+			}
+			if err != nil {
+				done <- nil
+				return
+			}
+		}
+	}()
+
+	return <-done
+}
@@ -0,0 +1,167 @@
+// Package console captures the serial console of a VM and lets terminals
+// attach to it.
+//
+// The sear process owning a VM runs a Relay on the output and input of
+// its Firecracker process. The relay writes everything to a log file,
+// keeps the most recent output in a ring buffer and serves the console on
+// a Unix socket; Attach connects a terminal to that socket. Attached
+// clients first receive the buffered output, then the live console.
+package console
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ringSize is the amount of recent output replayed to new clients
+	ringSize = 64 * 1024
+
+	// clientWriteTimeout drops clients that stop reading, so that a stuck
+	// terminal cannot stall the guest console
+	clientWriteTimeout = time.Second
+)
+
+// Relay serves the serial console of a VM
+type Relay struct {
+	socketPath string
+	input      io.Writer
+	log        io.WriteCloser
+	ln         net.Listener
+
+	mu      sync.Mutex
+	ring    *Ring
+	clients map[net.Conn]struct{}
+	closed  bool
+}
+
+// Serve starts relaying output, the serial output of a VM, to log and to
+// clients of the socket at socketPath. Input from clients is written to
+// input. Clients are served until output reaches EOF or Close is called,
+// but output is read until EOF in any case; output and log are closed
+// then.
+func Serve(socketPath string, output io.ReadCloser, input io.Writer, log io.WriteCloser) (*Relay, error) {
+	_ = os.Remove(socketPath)
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	r := &Relay{
+		socketPath: socketPath,
+		input:      input,
+		log:        log,
+		ln:         ln,
+		ring:       NewRing(ringSize),
+		clients:    make(map[net.Conn]struct{}),
+	}
+	go r.copyOutput(output)
+	go r.accept()
+
+	return r, nil
+}
+
+// copyOutput distributes the console output until it ends
+func (r *Relay) copyOutput(output io.ReadCloser) {
+	defer output.Close()
+	defer r.log.Close()
+	defer r.Close()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := output.Read(buf)
+		if n > 0 {
+			r.broadcast(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// broadcast writes console output to the log, the ring buffer and all
+// clients
+func (r *Relay) broadcast(p []byte) {
+	if _, err := r.log.Write(p); err != nil {
+		logrus.Debugf("Failed to write console log: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ring.Write(p)
+	for conn := range r.clients {
+		_ = conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+		if _, err := conn.Write(p); err != nil {
+			logrus.Debugf("Dropping console client: %v", err)
+			conn.Close()
+			delete(r.clients, conn)
+		}
+	}
+}
+
+// accept adds clients until the listener is closed
+func (r *Relay) accept() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			conn.Close()
+			return
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+		if _, err := conn.Write(r.ring.Bytes()); err != nil {
+			r.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		r.clients[conn] = struct{}{}
+		r.mu.Unlock()
+
+		go r.copyInput(conn)
+	}
+}
+
+// copyInput forwards what a client types to the guest
+func (r *Relay) copyInput(conn net.Conn) {
+	_, _ = io.Copy(r.input, conn)
+
+	r.mu.Lock()
+	if _, ok := r.clients[conn]; ok {
+		conn.Close()
+		delete(r.clients, conn)
+	}
+	r.mu.Unlock()
+}
+
+// Close stops serving the console and disconnects all clients
+func (r *Relay) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	r.closed = true
+
+	r.ln.Close()
+	_ = os.Remove(r.socketPath)
+	for conn := range r.clients {
+		conn.Close()
+	}
+	r.clients = nil
+}
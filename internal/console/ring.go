@@ -0,0 +1,45 @@
+package console
+
+// Ring is a fixed-size buffer keeping the most recent bytes written to it
+type Ring struct {
+	buf  []byte
+	next int
+	full bool
+}
+
+// NewRing creates a ring buffer holding up to size bytes
+func NewRing(size int) *Ring {
+	return &Ring{buf: make([]byte, size)}
+}
+
+// Write appends p, overwriting the oldest bytes once the buffer is full
+func (r *Ring) Write(p []byte) (int, error) {
+	n := len(p)
+	if n >= len(r.buf) {
+		copy(r.buf, p[n-len(r.buf):])
+		r.next = 0
+		r.full = true
+		return n, nil
+	}
+
+	c := copy(r.buf[r.next:], p)
+	if c < n {
+		copy(r.buf, p[c:])
+		r.full = true
+	}
+	r.next = (r.next + n) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+	return n, nil
+}
+
+// Bytes returns the buffered bytes, oldest first
+func (r *Ring) Bytes() []byte {
+	if !r.full {
+		return append([]byte(nil), r.buf[:r.next]...)
+	}
+	out := make([]byte, 0, len(r.buf))
+	out = append(out, r.buf[r.next:]...)
+	return append(out, r.buf[:r.next]...)
+}
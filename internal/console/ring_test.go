@@ -0,0 +1,32 @@
+package console
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"abc"}, "abc"},
+		{[]string{"abcdefgh"}, "abcdefgh"},
+		{[]string{"abcde", "fgh"}, "abcdefgh"},
+		{[]string{"abcdef", "ghij"}, "cdefghij"},
+		{[]string{"abc", "defghijklmn"}, "ghijklmn"},
+		{[]string{"abcdefg", "hi", "jk"}, "defghijk"},
+	}
+	for _, tt := range tests {
+		r := NewRing(8)
+		for _, w := range tt.writes {
+			if n, err := r.Write([]byte(w)); n != len(w) || err != nil {
+				t.Fatalf("Write(%q) = %d, %v", w, n, err)
+			}
+		}
+		if got := string(r.Bytes()); got != tt.want {
+			t.Errorf("after %s: Bytes() = %q, want %q", strings.Join(tt.writes, "+"), got, tt.want)
+		}
+	}
+}
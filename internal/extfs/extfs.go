@@ -0,0 +1,303 @@
+// Package extfs builds and reads ext2 file system images without relying
+// on mkfs or a loop mount on the host.
+//
+// Images are plain ext2 (no journal, no extents, no hashed directories).
+// The guest kernel mounts them with its ext4 driver, which leaves the
+// on-disk format untouched, so images written to by the guest can be read
+// back by this package.
+package extfs
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+const (
+	blockSize     = 4096
+	logBlockSize  = 2 // blockSize = 1024 << logBlockSize
+	inodeSize     = 128
+	groupDescSize = 32
+	superblockOff = 1024
+
+	blocksPerGroup = blockSize * 8
+	inodesPerBlock = blockSize / inodeSize
+	ptrsPerBlock   = blockSize / 4
+
+	magic = 0xEF53
+
+	rootIno      = 2
+	lostFoundIno = 11
+	firstIno     = 11
+
+	directBlocks = 12
+	indBlock     = 12
+	dindBlock    = 13
+	tindBlock    = 14
+	nBlocks      = 15
+
+	// fastSymlinkMax is the longest symlink target stored in the inode
+	fastSymlinkMax = nBlocks*4 - 1
+)
+
+// Feature flags
+const (
+	featureIncompatFiletype  = 0x0002
+	featureRoCompatLargeFile = 0x0002
+
+	// Incompatible features the reader understands
+	supportedIncompat = featureIncompatFiletype
+)
+
+// Inode mode file types
+const (
+	modeFIFO    = 0x1000
+	modeCharDev = 0x2000
+	modeDir     = 0x4000
+	modeBlkDev  = 0x6000
+	modeRegular = 0x8000
+	modeSymlink = 0xA000
+	modeSocket  = 0xC000
+	modeTypeMsk = 0xF000
+)
+
+// Directory entry file types
+const (
+	ftUnknown = 0
+	ftRegular = 1
+	ftDir     = 2
+	ftSymlink = 7
+)
+
+// Inode flags the reader cannot handle
+const (
+	inodeFlagIndex   = 0x1000
+	inodeFlagExtents = 0x80000
+	inodeFlagInline  = 0x10000000
+)
+
+var le = binary.LittleEndian
+
+// superblock holds the fields of the ext2 superblock used here
+type superblock struct {
+	inodesCount     uint32
+	blocksCount     uint32
+	freeBlocks      uint32
+	freeInodes      uint32
+	firstDataBlock  uint32
+	logBlockSize    uint32
+	blocksPerGroup  uint32
+	inodesPerGroup  uint32
+	mtime, wtime    uint32
+	magic           uint16
+	revLevel        uint32
+	firstIno        uint32
+	inodeSize       uint16
+	blockGroupNr    uint16
+	featureCompat   uint32
+	featureIncompat uint32
+	featureRoCompat uint32
+	uuid            [16]byte
+	volumeName      [16]byte
+}
+
+func (sb *superblock) marshal() []byte {
+	b := make([]byte, 1024)
+	le.PutUint32(b[0:], sb.inodesCount)
+	le.PutUint32(b[4:], sb.blocksCount)
+	le.PutUint32(b[12:], sb.freeBlocks)
+	le.PutUint32(b[16:], sb.freeInodes)
+	le.PutUint32(b[20:], sb.firstDataBlock)
+	le.PutUint32(b[24:], sb.logBlockSize)
+	le.PutUint32(b[28:], sb.logBlockSize) // s_log_frag_size
+	le.PutUint32(b[32:], sb.blocksPerGroup)
+	le.PutUint32(b[36:], sb.blocksPerGroup) // s_frags_per_group
+	le.PutUint32(b[40:], sb.inodesPerGroup)
+	le.PutUint32(b[44:], sb.mtime)
+	le.PutUint32(b[48:], sb.wtime)
+	le.PutUint16(b[54:], 0xFFFF) // s_max_mnt_count: no forced checks
+	le.PutUint16(b[56:], sb.magic)
+	le.PutUint16(b[58:], 1) // s_state: clean
+	le.PutUint16(b[60:], 1) // s_errors: continue
+	le.PutUint32(b[64:], sb.wtime)
+	le.PutUint32(b[76:], sb.revLevel)
+	le.PutUint32(b[84:], sb.firstIno)
+	le.PutUint16(b[88:], sb.inodeSize)
+	le.PutUint16(b[90:], sb.blockGroupNr)
+	le.PutUint32(b[92:], sb.featureCompat)
+	le.PutUint32(b[96:], sb.featureIncompat)
+	le.PutUint32(b[100:], sb.featureRoCompat)
+	copy(b[104:120], sb.uuid[:])
+	copy(b[120:136], sb.volumeName[:])
+	return b
+}
+
+func unmarshalSuperblock(b []byte) *superblock {
+	sb := &superblock{
+		inodesCount:     le.Uint32(b[0:]),
+		blocksCount:     le.Uint32(b[4:]),
+		freeBlocks:      le.Uint32(b[12:]),
+		freeInodes:      le.Uint32(b[16:]),
+		firstDataBlock:  le.Uint32(b[20:]),
+		logBlockSize:    le.Uint32(b[24:]),
+		blocksPerGroup:  le.Uint32(b[32:]),
+		inodesPerGroup:  le.Uint32(b[40:]),
+		mtime:           le.Uint32(b[44:]),
+		wtime:           le.Uint32(b[48:]),
+		magic:           le.Uint16(b[56:]),
+		revLevel:        le.Uint32(b[76:]),
+		firstIno:        le.Uint32(b[84:]),
+		inodeSize:       le.Uint16(b[88:]),
+		featureCompat:   le.Uint32(b[92:]),
+		featureIncompat: le.Uint32(b[96:]),
+		featureRoCompat: le.Uint32(b[100:]),
+	}
+	copy(sb.uuid[:], b[104:120])
+	copy(sb.volumeName[:], b[120:136])
+	if sb.revLevel == 0 {
+		sb.inodeSize = inodeSize
+		sb.firstIno = firstIno
+	}
+	return sb
+}
+
+// groupDesc is an ext2 block group descriptor
+type groupDesc struct {
+	blockBitmap uint32
+	inodeBitmap uint32
+	inodeTable  uint32
+	freeBlocks  uint16
+	freeInodes  uint16
+	usedDirs    uint16
+}
+
+func (gd *groupDesc) marshal(b []byte) {
+	le.PutUint32(b[0:], gd.blockBitmap)
+	le.PutUint32(b[4:], gd.inodeBitmap)
+	le.PutUint32(b[8:], gd.inodeTable)
+	le.PutUint16(b[12:], gd.freeBlocks)
+	le.PutUint16(b[14:], gd.freeInodes)
+	le.PutUint16(b[16:], gd.usedDirs)
+}
+
+func unmarshalGroupDesc(b []byte) groupDesc {
+	return groupDesc{
+		blockBitmap: le.Uint32(b[0:]),
+		inodeBitmap: le.Uint32(b[4:]),
+		inodeTable:  le.Uint32(b[8:]),
+		freeBlocks:  le.Uint16(b[12:]),
+		freeInodes:  le.Uint16(b[14:]),
+		usedDirs:    le.Uint16(b[16:]),
+	}
+}
+
+// inode holds the fields of an ext2 inode used here
+type inode struct {
+	mode       uint16
+	uid, gid   uint32
+	size       uint64
+	atime      uint32
+	ctime      uint32
+	mtime      uint32
+	linksCount uint16
+	blocks     uint32 // in 512 byte units
+	flags      uint32
+	block      [nBlocks]uint32
+}
+
+func (in *inode) marshal(b []byte) {
+	le.PutUint16(b[0:], in.mode)
+	le.PutUint16(b[2:], uint16(in.uid))
+	le.PutUint32(b[4:], uint32(in.size))
+	le.PutUint32(b[8:], in.atime)
+	le.PutUint32(b[12:], in.ctime)
+	le.PutUint32(b[16:], in.mtime)
+	le.PutUint16(b[24:], uint16(in.gid))
+	le.PutUint16(b[26:], in.linksCount)
+	le.PutUint32(b[28:], in.blocks)
+	le.PutUint32(b[32:], in.flags)
+	for i, blk := range in.block {
+		le.PutUint32(b[40+4*i:], blk)
+	}
+	le.PutUint32(b[108:], uint32(in.size>>32))
+	le.PutUint16(b[120:], uint16(in.uid>>16))
+	le.PutUint16(b[122:], uint16(in.gid>>16))
+}
+
+func unmarshalInode(b []byte) *inode {
+	in := &inode{
+		mode:       le.Uint16(b[0:]),
+		uid:        uint32(le.Uint16(b[2:])) | uint32(le.Uint16(b[120:]))<<16,
+		gid:        uint32(le.Uint16(b[24:])) | uint32(le.Uint16(b[122:]))<<16,
+		size:       uint64(le.Uint32(b[4:])),
+		atime:      le.Uint32(b[8:]),
+		ctime:      le.Uint32(b[12:]),
+		mtime:      le.Uint32(b[16:]),
+		linksCount: le.Uint16(b[26:]),
+		blocks:     le.Uint32(b[28:]),
+		flags:      le.Uint32(b[32:]),
+	}
+	if in.mode&modeTypeMsk == modeRegular {
+		in.size |= uint64(le.Uint32(b[108:])) << 32
+	}
+	for i := range in.block {
+		in.block[i] = le.Uint32(b[40+4*i:])
+	}
+	return in
+}
+
+// fileMode converts an inode mode into an os.FileMode
+func fileMode(mode uint16) os.FileMode {
+	m := os.FileMode(mode & 0o777)
+	if mode&0o4000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		m |= os.ModeSticky
+	}
+	switch mode & modeTypeMsk {
+	case modeDir:
+		m |= os.ModeDir
+	case modeSymlink:
+		m |= os.ModeSymlink
+	case modeFIFO:
+		m |= os.ModeNamedPipe
+	case modeSocket:
+		m |= os.ModeSocket
+	case modeCharDev:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case modeBlkDev:
+		m |= os.ModeDevice
+	}
+	return m
+}
+
+// inodeMode converts an os.FileMode into an inode mode
+func inodeMode(m os.FileMode) uint16 {
+	mode := uint16(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	switch {
+	case m.IsDir():
+		mode |= modeDir
+	case m&os.ModeSymlink != 0:
+		mode |= modeSymlink
+	default:
+		mode |= modeRegular
+	}
+	return mode
+}
+
+// ceilDiv returns a/b rounded up
+func ceilDiv(a, b uint64) uint64 {
+	return (a + b - 1) / b
+}
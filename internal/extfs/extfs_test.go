@@ -0,0 +1,295 @@
+package extfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	src := t.TempDir()
+
+	// A file large enough to need double indirect blocks
+	big := bytes.Repeat([]byte("0123456789abcdef"), (directBlocks+ptrsPerBlock+10)*blockSize/16)
+	files := map[string][]byte{
+		"empty":              nil,
+		"hello.txt":          []byte("hello\n"),
+		"dir/nested/big.bin": big,
+		"dir/skipped.log":    []byte("skip me"),
+	}
+	for name, data := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("hello.txt", filepath.Join(src, "short")); err != nil {
+		t.Fatal(err)
+	}
+	longTarget := strings.Repeat("x/", 40) + "target"
+	if err := os.Symlink(longTarget, filepath.Join(src, "long")); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(t.TempDir(), "image.ext2")
+	err := Build(src, image, Options{
+		Label:     "test",
+		Skip:      func(rel string, isDir bool) bool { return strings.HasSuffix(rel, ".log") },
+		FreeBytes: 1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	img, err := Open(image)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer img.Close()
+
+	if img.Label() != "test" {
+		t.Errorf("Label() = %q, want %q", img.Label(), "test")
+	}
+
+	got := make(map[string]*Entry)
+	contents := make(map[string][]byte)
+	err = img.Walk(func(rel string, e *Entry) error {
+		got[rel] = e
+		if e.Mode.IsRegular() {
+			var buf bytes.Buffer
+			if err := img.WriteTo(e, &buf); err != nil {
+				return err
+			}
+			contents[rel] = buf.Bytes()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+
+	for _, rel := range []string{"dir", "dir/nested"} {
+		if e, ok := got[rel]; !ok || !e.Mode.IsDir() {
+			t.Errorf("%s: missing or not a directory", rel)
+		}
+	}
+	for name, data := range files {
+		if name == "dir/skipped.log" {
+			if _, ok := got[name]; ok {
+				t.Errorf("%s: should have been skipped", name)
+			}
+			continue
+		}
+		e, ok := got[name]
+		if !ok {
+			t.Errorf("%s: missing", name)
+			continue
+		}
+		if e.Mode.Perm() != 0o640 {
+			t.Errorf("%s: mode %v, want 0640", name, e.Mode)
+		}
+		if !bytes.Equal(contents[name], data) {
+			t.Errorf("%s: content mismatch (%d bytes, want %d)", name, len(contents[name]), len(data))
+		}
+	}
+	if e := got["short"]; e == nil || e.Link != "hello.txt" {
+		t.Errorf("short: got %+v, want link to hello.txt", e)
+	}
+	if e := got["long"]; e == nil || e.Link != longTarget {
+		t.Errorf("long: got %+v, want link to %s", e, longTarget)
+	}
+	if _, ok := got["lost+found"]; ok {
+		t.Errorf("lost+found should not be walked")
+	}
+}
+
+func TestIndirectBlocks(t *testing.T) {
+	tests := []struct {
+		data, want uint64
+	}{
+		{0, 0},
+		{directBlocks, 0},
+		{directBlocks + 1, 1},
+		{directBlocks + ptrsPerBlock, 1},
+		{directBlocks + ptrsPerBlock + 1, 3},
+		{directBlocks + ptrsPerBlock + ptrsPerBlock*ptrsPerBlock, 2 + ptrsPerBlock},
+		{directBlocks + ptrsPerBlock + ptrsPerBlock*ptrsPerBlock + 1, 2 + ptrsPerBlock + 3},
+	}
+	for _, tt := range tests {
+		if got := indirectBlocks(tt.data); got != tt.want {
+			t.Errorf("indirectBlocks(%d) = %d, want %d", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestWalkRejectsCraftedNames(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "..Xescape"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(t.TempDir(), "image.ext2")
+	if err := Build(src, image, Options{Label: "test"}); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	// Rename the entry in place to a name holding a slash, as a guest
+	// writing to the block device could
+	data, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(data, []byte("..Xescape")) != 1 {
+		t.Fatal("directory entry not found in the image")
+	}
+	data = bytes.Replace(data, []byte("..Xescape"), []byte("../escape"), 1)
+	if err := os.WriteFile(image, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := Open(image)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer img.Close()
+
+	err = img.Walk(func(rel string, e *Entry) error {
+		t.Errorf("Walk yielded %s", rel)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Walk accepted a name with a slash")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	src := t.TempDir()
+	write := func(name string, data []byte) {
+		t.Helper()
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keep := bytes.Repeat([]byte("keep"), 3*blockSize)
+	write("dir/keep.bin", keep)
+	write("change.txt", []byte("before"))
+	write("gone/file", []byte("gone"))
+
+	image := filepath.Join(t.TempDir(), "image.ext2")
+	opts := Options{Label: "test", FreeBytes: 1 << 20, FreeInodes: 16}
+	if err := Build(src, image, opts); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	entries := func() map[string]*Entry {
+		t.Helper()
+		img, err := Open(image)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer img.Close()
+
+		got := make(map[string]*Entry)
+		if err := img.Walk(func(rel string, e *Entry) error {
+			got[rel] = e
+			return nil
+		}); err != nil {
+			t.Fatalf("Walk: %v", err)
+		}
+		return got
+	}
+	before := entries()["dir/keep.bin"]
+
+	write("change.txt", bytes.Repeat([]byte("after"), blockSize))
+	write("dir/new.txt", []byte("new"))
+	if err := os.RemoveAll(filepath.Join(src, "gone")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Update(src, image, opts, func(rel string) bool { return rel == "dir/keep.bin" })
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	got := entries()
+	after := got["dir/keep.bin"]
+	if after == nil {
+		t.Fatal("dir/keep.bin is missing after the update")
+	}
+	if after.ino != before.ino || after.in.block != before.in.block {
+		t.Errorf("dir/keep.bin moved from inode %d %v to inode %d %v", before.ino, before.in.block, after.ino, after.in.block)
+	}
+	for _, rel := range []string{"gone", "gone/file"} {
+		if _, ok := got[rel]; ok {
+			t.Errorf("%s was not removed", rel)
+		}
+	}
+
+	img, err := Open(image)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer img.Close()
+	for rel, want := range map[string][]byte{
+		"dir/keep.bin": keep,
+		"change.txt":   bytes.Repeat([]byte("after"), blockSize),
+		"dir/new.txt":  []byte("new"),
+	} {
+		e := got[rel]
+		if e == nil {
+			t.Errorf("%s is missing", rel)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := img.WriteTo(e, &buf); err != nil {
+			t.Fatalf("%s: %v", rel, err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%s: content differs after the update", rel)
+		}
+	}
+}
+
+func TestUpdateNoRoom(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "small"), []byte("small"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(t.TempDir(), "image.ext2")
+	opts := Options{Label: "test", FreeBytes: 64 * blockSize}
+	if err := Build(src, image, opts); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	before, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, 48*blockSize)
+	if err := os.WriteFile(filepath.Join(src, "big"), big, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = Update(src, image, opts, func(string) bool { return true })
+	if !errors.Is(err, ErrNoRoom) {
+		t.Fatalf("Update = %v, want ErrNoRoom", err)
+	}
+
+	after, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("Update changed the image although it had no room")
+	}
+}
@@ -0,0 +1,359 @@
+package extfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Image is an ext2 image opened for reading
+type Image struct {
+	f              *os.File
+	sb             *superblock
+	bs             uint64
+	inodesPerGroup uint64
+	groups         []groupDesc
+}
+
+// Entry describes a file, directory or symlink in an image
+type Entry struct {
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+	// Link is the target of a symlink
+	Link string
+
+	ino uint32
+	in  *inode
+}
+
+// Open opens an ext2 image for reading
+func Open(image string) (*Image, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := newImage(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", image, err)
+	}
+	return img, nil
+}
+
+func newImage(f *os.File) (*Image, error) {
+	buf := make([]byte, 1024)
+	if _, err := f.ReadAt(buf, superblockOff); err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	sb := unmarshalSuperblock(buf)
+	if sb.magic != magic {
+		return nil, fmt.Errorf("not an ext2 file system")
+	}
+	if sb.featureIncompat&^supportedIncompat != 0 {
+		return nil, fmt.Errorf("unsupported file system features 0x%x", sb.featureIncompat&^supportedIncompat)
+	}
+	if sb.inodesPerGroup == 0 || sb.blocksPerGroup == 0 || sb.inodeSize < inodeSize {
+		return nil, fmt.Errorf("corrupt superblock")
+	}
+
+	img := &Image{
+		f:              f,
+		sb:             sb,
+		bs:             1024 << sb.logBlockSize,
+		inodesPerGroup: uint64(sb.inodesPerGroup),
+	}
+
+	groups := ceilDiv(uint64(sb.blocksCount-sb.firstDataBlock), uint64(sb.blocksPerGroup))
+	gdt := make([]byte, groups*groupDescSize)
+	if _, err := f.ReadAt(gdt, int64((uint64(sb.firstDataBlock)+1)*img.bs)); err != nil {
+		return nil, fmt.Errorf("failed to read group descriptors: %w", err)
+	}
+	for g := uint64(0); g < groups; g++ {
+		img.groups = append(img.groups, unmarshalGroupDesc(gdt[g*groupDescSize:]))
+	}
+
+	return img, nil
+}
+
+// Close closes the image file
+func (img *Image) Close() error {
+	return img.f.Close()
+}
+
+// Label returns the volume name of the image
+func (img *Image) Label() string {
+	name := img.sb.volumeName[:]
+	for i, c := range name {
+		if c == 0 {
+			return string(name[:i])
+		}
+	}
+	return string(name)
+}
+
+// readInode reads an inode from the inode tables
+func (img *Image) readInode(ino uint32) (*inode, error) {
+	if ino == 0 || ino > img.sb.inodesCount {
+		return nil, fmt.Errorf("invalid inode number %d", ino)
+	}
+
+	g := uint64(ino-1) / img.inodesPerGroup
+	idx := uint64(ino-1) % img.inodesPerGroup
+	buf := make([]byte, inodeSize)
+	off := int64(uint64(img.groups[g].inodeTable)*img.bs + idx*uint64(img.sb.inodeSize))
+	if _, err := img.f.ReadAt(buf, off); err != nil {
+		return nil, fmt.Errorf("failed to read inode %d: %w", ino, err)
+	}
+
+	in := unmarshalInode(buf)
+	if in.flags&(inodeFlagExtents|inodeFlagInline) != 0 {
+		return nil, fmt.Errorf("inode %d uses unsupported extents or inline data", ino)
+	}
+	return in, nil
+}
+
+// readBlock reads a whole block
+func (img *Image) readBlock(blk uint32, buf []byte) error {
+	if blk >= img.sb.blocksCount {
+		return fmt.Errorf("block %d out of range", blk)
+	}
+	_, err := img.f.ReadAt(buf[:img.bs], int64(uint64(blk)*img.bs))
+	return err
+}
+
+// blockMap resolves logical block numbers of an inode to physical blocks,
+// caching the indirect blocks it reads
+type blockMap struct {
+	img   *Image
+	in    *inode
+	cache map[uint32][]uint32
+}
+
+// ptrs returns the pointers stored in an indirect block
+func (m *blockMap) ptrs(blk uint32) ([]uint32, error) {
+	if p, ok := m.cache[blk]; ok {
+		return p, nil
+	}
+
+	buf := make([]byte, m.img.bs)
+	if err := m.img.readBlock(blk, buf); err != nil {
+		return nil, err
+	}
+	p := make([]uint32, m.img.bs/4)
+	for i := range p {
+		p[i] = le.Uint32(buf[4*i:])
+	}
+
+	if len(m.cache) > 64 {
+		clear(m.cache)
+	}
+	m.cache[blk] = p
+	return p, nil
+}
+
+// lookup returns the physical block of logical block n, or 0 for a hole
+func (m *blockMap) lookup(n uint64) (uint32, error) {
+	per := m.img.bs / 4
+	if n < directBlocks {
+		return m.in.block[n], nil
+	}
+	n -= directBlocks
+
+	// Walk down from the top level indirect block that covers n
+	var root uint32
+	var depth int
+	switch {
+	case n < per:
+		root, depth = m.in.block[indBlock], 1
+	case n < per+per*per:
+		n -= per
+		root, depth = m.in.block[dindBlock], 2
+	default:
+		n -= per + per*per
+		root, depth = m.in.block[tindBlock], 3
+	}
+
+	blk := root
+	for level := depth - 1; level >= 0; level-- {
+		if blk == 0 {
+			return 0, nil
+		}
+		p, err := m.ptrs(blk)
+		if err != nil {
+			return 0, err
+		}
+		span := uint64(1)
+		for i := 0; i < level; i++ {
+			span *= per
+		}
+		idx := n / span
+		if idx >= per {
+			return 0, fmt.Errorf("file too large")
+		}
+		blk = p[idx]
+		n %= span
+	}
+	return blk, nil
+}
+
+// readData writes the first size bytes of an inode's data to w
+func (img *Image) readData(in *inode, size uint64, w io.Writer) error {
+	m := &blockMap{img: img, in: in, cache: make(map[uint32][]uint32)}
+	buf := make([]byte, img.bs)
+
+	for n := uint64(0); n*img.bs < size; n++ {
+		blk, err := m.lookup(n)
+		if err != nil {
+			return err
+		}
+		if blk == 0 {
+			clear(buf)
+		} else if err := img.readBlock(blk, buf); err != nil {
+			return err
+		}
+
+		chunk := buf[:min(img.bs, size-n*img.bs)]
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry converts an inode into an Entry
+func (img *Image) entry(in *inode) (*Entry, error) {
+	e := &Entry{
+		Mode:    fileMode(in.mode),
+		Size:    int64(in.size),
+		ModTime: time.Unix(int64(in.mtime), 0),
+		in:      in,
+	}
+
+	if e.Mode&os.ModeSymlink != 0 {
+		// Fast symlinks keep the target in the block map, slow ones in a
+		// data block
+		if in.blocks == 0 && in.size <= fastSymlinkMax {
+			raw := make([]byte, nBlocks*4)
+			for i, blk := range in.block {
+				le.PutUint32(raw[4*i:], blk)
+			}
+			e.Link = string(raw[:in.size])
+		} else {
+			var buf bytes.Buffer
+			if err := img.readData(in, in.size, &buf); err != nil {
+				return nil, err
+			}
+			e.Link = buf.String()
+		}
+	}
+
+	return e, nil
+}
+
+// dirent is a raw directory entry
+type dirent struct {
+	ino  uint32
+	name string
+}
+
+// readDir returns the entries of a directory, without "." and "..". Names
+// that could not be a single path element are rejected.
+func (img *Image) readDir(in *inode) ([]dirent, error) {
+	var buf bytes.Buffer
+	if err := img.readData(in, in.size, &buf); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+
+	var entries []dirent
+	for off := 0; off+8 <= len(data); {
+		ino := le.Uint32(data[off:])
+		recLen := int(le.Uint16(data[off+4:]))
+		nameLen := int(data[off+6])
+		if recLen < 8 || off+recLen > len(data) || 8+nameLen > recLen {
+			return nil, fmt.Errorf("corrupt directory entry at offset %d", off)
+		}
+
+		name := string(data[off+8 : off+8+nameLen])
+		if ino != 0 && strings.ContainsAny(name, "/\x00") {
+			return nil, fmt.Errorf("invalid directory entry name %q", name)
+		}
+		if ino != 0 && name != "." && name != ".." {
+			entries = append(entries, dirent{ino, name})
+		}
+		off += recLen
+	}
+	return entries, nil
+}
+
+// WalkFunc is called for every entry of an image with its slash separated
+// path relative to the root
+type WalkFunc func(rel string, e *Entry) error
+
+// Walk calls fn for every file, directory and symlink in the image,
+// parents before their children. lost+found is left out. A directory
+// reached twice, as in a crafted cycle, is an error.
+func (img *Image) Walk(fn WalkFunc) error {
+	root, err := img.readInode(rootIno)
+	if err != nil {
+		return err
+	}
+	visited := map[uint32]bool{rootIno: true}
+	return img.walk(".", root, visited, fn)
+}
+
+func (img *Image) walk(dir string, in *inode, visited map[uint32]bool, fn WalkFunc) error {
+	entries, err := img.readDir(in)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+
+	for _, d := range entries {
+		if dir == "." && d.name == "lost+found" {
+			continue
+		}
+
+		child, err := img.readInode(d.ino)
+		if err != nil {
+			return err
+		}
+		e, err := img.entry(child)
+		if err != nil {
+			return err
+		}
+		e.ino = d.ino
+
+		rel := path.Join(dir, d.name)
+		if e.Mode.IsDir() {
+			if visited[d.ino] {
+				return fmt.Errorf("%s: directory inode %d is linked more than once", rel, d.ino)
+			}
+			visited[d.ino] = true
+		}
+
+		if err := fn(rel, e); err != nil {
+			return err
+		}
+		if e.Mode.IsDir() {
+			if err := img.walk(rel, child, visited, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteTo copies the content of a regular file entry to w
+func (img *Image) WriteTo(e *Entry, w io.Writer) error {
+	if !e.Mode.IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+	return img.readData(e.in, e.in.size, w)
+}
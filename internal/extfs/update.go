@@ -0,0 +1,307 @@
+package extfs
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+)
+
+// ErrNoRoom is returned by Update when the image cannot take the changes
+// and still leave the requested room; it has to be rebuilt instead
+var ErrNoRoom = errors.New("not enough room in the image for an update")
+
+// Update brings an image built by Build from src up to date in place.
+// Files for which unchanged returns true keep their inode and data blocks
+// untouched; other files are written anew and the inodes and blocks of
+// removed ones are freed. Directories are always rewritten. The geometry
+// of the image stays the same, so if the changes would leave less than
+// half of opts.FreeBytes or opts.FreeInodes free, nothing is written and
+// ErrNoRoom is returned.
+func Update(src, image string, opts Options, unchanged func(rel string) bool) error {
+	if len(opts.Label) > 16 {
+		return fmt.Errorf("volume label %q is longer than 16 bytes", opts.Label)
+	}
+
+	rootInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !rootInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", src)
+	}
+
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	img, err := newImage(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", image, err)
+	}
+	b, err := loadBuilder(img)
+	if err != nil {
+		return fmt.Errorf("%s: %w", image, err)
+	}
+
+	old := make(map[string]*Entry)
+	if err := img.Walk(func(rel string, e *Entry) error {
+		old[rel] = e
+		return nil
+	}); err != nil {
+		return err
+	}
+	oldRoot, err := img.readInode(rootIno)
+	if err != nil {
+		return err
+	}
+
+	// lost+found is kept as it is
+	root := &node{rel: ".", hostPath: src, info: rootInfo, ino: rootIno}
+	lostFound := &node{rel: "lost+found", info: dirInfo{name: "lost+found", mode: os.ModeDir | 0o700}, ino: lostFoundIno, parent: root, keep: true}
+	root.children = append(root.children, lostFound)
+	b.nodes = append(b.nodes, lostFound)
+
+	if err := b.scan(root, opts.Skip); err != nil {
+		return err
+	}
+
+	// Unchanged files keep their inode, directories keep their inode
+	// number but get their entries rewritten
+	kept := make(map[uint32]bool)
+	claimed := make(map[uint32]bool)
+	var added []*node
+	for _, n := range b.nodes[1:] {
+		n.ino = 0
+		if o := old[n.rel]; o != nil {
+			switch {
+			case n.isDir() && o.Mode.IsDir():
+				n.ino = o.ino
+			case !n.isDir() && sameType(n, o) && unchanged(n.rel):
+				n.ino, n.keep = o.ino, true
+				kept[o.ino] = true
+			}
+		}
+		if n.ino == 0 {
+			added = append(added, n)
+		} else {
+			claimed[n.ino] = true
+		}
+	}
+
+	// Free what is rewritten or gone
+	if err := b.freeBlocks(img, oldRoot); err != nil {
+		return err
+	}
+	var freed []uint32
+	for _, o := range old {
+		if kept[o.ino] {
+			continue
+		}
+		if err := b.freeBlocks(img, o.in); err != nil {
+			return err
+		}
+		if !claimed[o.ino] {
+			b.inodes[(o.ino-1)/64] &^= 1 << ((o.ino - 1) % 64)
+			freed = append(freed, o.ino)
+		}
+	}
+
+	for _, n := range added {
+		ino, err := b.allocInode()
+		if err != nil {
+			return err
+		}
+		n.ino = ino
+	}
+
+	write := []*node{root}
+	for _, n := range b.nodes {
+		if !n.keep {
+			write = append(write, n)
+		}
+	}
+
+	var dataBlocks uint64
+	for _, n := range write {
+		if err := n.prepare(); err != nil {
+			return err
+		}
+		dataBlocks += n.nData + n.nMeta
+	}
+
+	// Check for room before the first write, so that the image is left
+	// untouched when it has to be rebuilt
+	freeBlocks := b.layout.blocksCount - countUsed(b.used)
+	reserve := ceilDiv(uint64(max(opts.FreeBytes, 0)), blockSize) / 2
+	if dataBlocks+reserve > freeBlocks {
+		return ErrNoRoom
+	}
+	freeInodes := b.layout.groups*b.layout.inodesPerGroup - countUsed(b.inodes)
+	if freeInodes < uint64(max(opts.FreeInodes, 0))/2 {
+		return ErrNoRoom
+	}
+
+	zero := make([]byte, inodeSize)
+	for _, ino := range freed {
+		if _, err := b.out.WriteAt(zero, b.inodeOffset(ino)); err != nil {
+			return err
+		}
+	}
+
+	for _, n := range write {
+		if err := b.writeNode(n); err != nil {
+			return fmt.Errorf("%s: %w", n.rel, err)
+		}
+	}
+	if err := b.writeInodes(write); err != nil {
+		return err
+	}
+
+	// writeNode only counted the directories it wrote
+	clear(b.dirs)
+	b.dirs[0]++ // the root
+	for _, n := range b.nodes {
+		if n.isDir() {
+			b.dirs[uint64(n.ino-1)/b.layout.inodesPerGroup]++
+		}
+	}
+	if err := b.writeMetadata(opts.Label); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// loadBuilder returns a builder for an image written by Build, with the
+// block and inode bitmaps read from it
+func loadBuilder(img *Image) (*builder, error) {
+	sb := img.sb
+	if img.bs != blockSize || sb.blocksPerGroup != blocksPerGroup || sb.inodeSize != inodeSize || sb.firstDataBlock != 0 {
+		return nil, errors.New("image was not built by sear")
+	}
+
+	l := layout{
+		blocksCount:    uint64(sb.blocksCount),
+		groups:         uint64(len(img.groups)),
+		inodesPerGroup: img.inodesPerGroup,
+	}
+	l.itBlocks = ceilDiv(l.inodesPerGroup, inodesPerBlock)
+	l.gdtBlocks = ceilDiv(l.groups*groupDescSize, blockSize)
+
+	b := &builder{
+		out:    img.f,
+		layout: l,
+		used:   make([]uint64, ceilDiv(l.blocksCount, 64)),
+		inodes: make([]uint64, ceilDiv(l.groups*l.inodesPerGroup, 64)),
+		dirs:   make([]uint64, l.groups),
+		uuid:   sb.uuid,
+	}
+
+	bitmap := make([]byte, blockSize)
+	for g, gd := range img.groups {
+		g := uint64(g)
+		if uint64(gd.blockBitmap) != l.blockBitmap(g) || uint64(gd.inodeBitmap) != l.inodeBitmap(g) || uint64(gd.inodeTable) != l.inodeTable(g) {
+			return nil, errors.New("image was not built by sear")
+		}
+
+		if err := img.readBlock(gd.blockBitmap, bitmap); err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < l.blocksInGroup(g); i++ {
+			if bitmap[i/8]&(1<<(i%8)) != 0 {
+				b.markUsed(l.groupStart(g) + i)
+			}
+		}
+
+		if err := img.readBlock(gd.inodeBitmap, bitmap); err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < l.inodesPerGroup; i++ {
+			if bitmap[i/8]&(1<<(i%8)) != 0 {
+				b.markInode(uint32(g*l.inodesPerGroup + i + 1))
+			}
+		}
+	}
+
+	return b, nil
+}
+
+// sameType reports whether a host node and an image entry are both
+// regular files or both symlinks
+func sameType(n *node, e *Entry) bool {
+	if n.link != "" {
+		return e.Mode&os.ModeSymlink != 0
+	}
+	return e.Mode.IsRegular()
+}
+
+// freeBlocks marks the data and indirect blocks of an inode free
+func (b *builder) freeBlocks(img *Image, in *inode) error {
+	// Fast symlinks keep their target in the block map
+	if in.blocks == 0 {
+		return nil
+	}
+
+	free := func(blk uint32) {
+		b.used[blk/64] &^= 1 << (blk % 64)
+	}
+	for _, blk := range in.block[:directBlocks] {
+		if blk != 0 {
+			free(blk)
+		}
+	}
+
+	var indirect func(blk uint32, level int) error
+	indirect = func(blk uint32, level int) error {
+		if blk == 0 {
+			return nil
+		}
+		buf := make([]byte, blockSize)
+		if err := img.readBlock(blk, buf); err != nil {
+			return err
+		}
+		free(blk)
+		for i := 0; i < ptrsPerBlock; i++ {
+			ptr := le.Uint32(buf[4*i:])
+			if ptr == 0 {
+				continue
+			}
+			if level == 0 {
+				free(ptr)
+			} else if err := indirect(ptr, level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for level, slot := range []int{indBlock, dindBlock, tindBlock} {
+		if err := indirect(in.block[slot], level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocInode returns the lowest free inode for a new file
+func (b *builder) allocInode() (uint32, error) {
+	count := uint32(b.layout.groups * b.layout.inodesPerGroup)
+	for ino := uint32(firstIno + 1); ino <= count; ino++ {
+		if !b.inodeUsed(ino) {
+			b.markInode(ino)
+			return ino, nil
+		}
+	}
+	return 0, ErrNoRoom
+}
+
+// countUsed returns the number of bits set in a bitmap
+func countUsed(bitmap []uint64) uint64 {
+	var n int
+	for _, w := range bitmap {
+		n += bits.OnesCount64(w)
+	}
+	return uint64(n)
+}
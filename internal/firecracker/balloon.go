@@ -0,0 +1,63 @@
+package firecracker
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// BalloonStats are the memory statistics reported by the balloon device.
+// Fields other than the page counts are only reported by guests that
+// support them.
+type BalloonStats struct {
+	TargetPages        uint64 `json:"target_pages"`
+	ActualPages        uint64 `json:"actual_pages"`
+	TargetMiB          uint64 `json:"target_mib"`
+	ActualMiB          uint64 `json:"actual_mib"`
+	SwapIn             uint64 `json:"swap_in,omitempty"`
+	SwapOut            uint64 `json:"swap_out,omitempty"`
+	MajorFaults        uint64 `json:"major_faults,omitempty"`
+	MinorFaults        uint64 `json:"minor_faults,omitempty"`
+	FreeMemory         uint64 `json:"free_memory,omitempty"`
+	TotalMemory        uint64 `json:"total_memory,omitempty"`
+	AvailableMemory    uint64 `json:"available_memory,omitempty"`
+	DiskCaches         uint64 `json:"disk_caches,omitempty"`
+	HugetlbAllocations uint64 `json:"hugetlb_allocations,omitempty"`
+	HugetlbFailures    uint64 `json:"hugetlb_failures,omitempty"`
+}
+
+// ConfigureBalloon adds a balloon device that reclaims amountMiB of guest
+// memory. With deflateOnOOM the guest may take memory back from the
+// balloon when it runs out. Statistics are collected every
+// statsIntervalS seconds, or not at all if it is 0. It must be called
+// before the instance starts.
+func (c *Client) ConfigureBalloon(amountMiB int, deflateOnOOM bool, statsIntervalS int) error {
+	logrus.Infof("Configuring balloon: %d MiB", amountMiB)
+
+	data := map[string]interface{}{
+		"amount_mib":               amountMiB,
+		"deflate_on_oom":           deflateOnOOM,
+		"stats_polling_interval_s": statsIntervalS,
+	}
+
+	return c.request("PUT", "/balloon", data)
+}
+
+// UpdateBalloon changes the amount of memory the balloon of a running VM
+// reclaims
+func (c *Client) UpdateBalloon(amountMiB int) error {
+	logrus.Debugf("Resizing balloon to %d MiB", amountMiB)
+
+	data := map[string]interface{}{
+		"amount_mib": amountMiB,
+	}
+
+	return c.request("PATCH", "/balloon", data)
+}
+
+// GetBalloonStats returns the latest balloon statistics
+func (c *Client) GetBalloonStats() (*BalloonStats, error) {
+	var stats BalloonStats
+	if err := c.get("/balloon/statistics", &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
@@ -38,6 +38,16 @@ func NewClient(socketPath string) (*Client, error) {
 
 // request makes an HTTP request to the Firecracker API via Unix socket
 func (c *Client) request(method, endpoint string, data interface{}) error {
+	return c.do(method, endpoint, data, nil)
+}
+
+// get fetches an API resource and decodes it into out
+func (c *Client) get(endpoint string, out interface{}) error {
+	return c.do("GET", endpoint, nil, out)
+}
+
+// do makes an API request, decoding the response body into out if set
+func (c *Client) do(method, endpoint string, data, out interface{}) error {
 	u := &url.URL{
 		Scheme: "http",
 		Host:   "localhost",
@@ -75,9 +85,22 @@ func (c *Client) request(method, endpoint string, data interface{}) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		// Firecracker explains rejected requests in fault_message
+		var fault struct {
+			FaultMessage string `json:"fault_message"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&fault); err == nil && fault.FaultMessage != "" {
+			return fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, fault.FaultMessage)
+		}
 		return fmt.Errorf("API request failed with status: %d", resp.StatusCode)
 	}
 
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -95,8 +118,31 @@ func (c *Client) ConfigureLogger(logPath, level string) error {
 	return c.request("PUT", "/logger", data)
 }
 
-// SetBootSource sets the kernel and boot arguments
-func (c *Client) SetBootSource(kernelPath, bootArgs string) error {
+// ConfigureMetrics makes Firecracker write its metrics to metricsPath,
+// which must exist. A JSON object is appended every minute and on
+// FlushMetrics.
+func (c *Client) ConfigureMetrics(metricsPath string) error {
+	logrus.Debugf("Configuring Firecracker metrics: %s", metricsPath)
+
+	data := map[string]interface{}{
+		"metrics_path": metricsPath,
+	}
+
+	return c.request("PUT", "/metrics", data)
+}
+
+// FlushMetrics makes Firecracker write its current metrics
+func (c *Client) FlushMetrics() error {
+	data := map[string]interface{}{
+		"action_type": "FlushMetrics",
+	}
+
+	return c.request("PUT", "/actions", data)
+}
+
+// SetBootSource sets the kernel, the initrd if initrdPath is not empty,
+// and the boot arguments
+func (c *Client) SetBootSource(kernelPath, initrdPath, bootArgs string) error {
 	logrus.Infof("Setting boot source: %s", kernelPath)
 
 	// Expand home directory
@@ -106,10 +152,25 @@ func (c *Client) SetBootSource(kernelPath, bootArgs string) error {
 		"kernel_image_path": kernelPath,
 		"boot_args":         bootArgs,
 	}
+	if initrdPath != "" {
+		data["initrd_path"] = initrdPath
+	}
 
 	return c.request("PUT", "/boot-source", data)
 }
 
+// SetMachineConfig sets the number of vCPUs and the memory of the VM
+func (c *Client) SetMachineConfig(vcpus, memoryMiB int) error {
+	logrus.Infof("Setting machine config: %d vCPUs, %d MiB", vcpus, memoryMiB)
+
+	data := map[string]interface{}{
+		"vcpu_count":   vcpus,
+		"mem_size_mib": memoryMiB,
+	}
+
+	return c.request("PUT", "/machine-config", data)
+}
+
 // AttachRootfs attaches a drive to the VM
 func (c *Client) AttachRootfs(driveID, pathOnHost string, isRoot, isReadOnly bool) error {
 	logrus.Infof("Attaching rootfs: %s", pathOnHost)
@@ -151,6 +212,63 @@ func (c *Client) StartInstance() error {
 	return c.request("PUT", "/actions", data)
 }
 
+// PauseVM pauses the vCPUs of a running instance
+func (c *Client) PauseVM() error {
+	logrus.Debug("Pausing Firecracker instance")
+
+	data := map[string]interface{}{
+		"state": "Paused",
+	}
+
+	return c.request("PATCH", "/vm", data)
+}
+
+// ResumeVM resumes a paused instance
+func (c *Client) ResumeVM() error {
+	logrus.Debug("Resuming Firecracker instance")
+
+	data := map[string]interface{}{
+		"state": "Resumed",
+	}
+
+	return c.request("PATCH", "/vm", data)
+}
+
+// CreateSnapshot writes a full snapshot of a paused instance: the device
+// and vCPU state to snapshotPath and the guest memory to memPath
+func (c *Client) CreateSnapshot(snapshotPath, memPath string) error {
+	logrus.Infof("Creating snapshot: %s", snapshotPath)
+
+	data := map[string]interface{}{
+		"snapshot_type": "Full",
+		"snapshot_path": snapshotPath,
+		"mem_file_path": memPath,
+	}
+
+	return c.request("PUT", "/snapshot/create", data)
+}
+
+// LoadSnapshot restores an instance from a snapshot. It must be called on
+// a freshly started Firecracker process, instead of configuring and
+// starting it. The guest memory file is mapped privately, so it can back
+// several instances at once. The instance is left paused unless resume is
+// set.
+func (c *Client) LoadSnapshot(snapshotPath, memPath string, resume bool) error {
+	logrus.Infof("Loading snapshot: %s", snapshotPath)
+
+	data := map[string]interface{}{
+		"snapshot_path": snapshotPath,
+		"mem_backend": map[string]interface{}{
+			"backend_type": "File",
+			"backend_path": memPath,
+		},
+		"enable_diff_snapshots": false,
+		"resume_vm":             resume,
+	}
+
+	return c.request("PUT", "/snapshot/load", data)
+}
+
 // Helper function to expand home directory
 func expandPath(path string) string {
 	if len(path) > 1 && path[0] == '~' {
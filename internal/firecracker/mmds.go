@@ -0,0 +1,26 @@
+package firecracker
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// ConfigureMMDS enables the metadata service on the given network
+// interfaces. Guests must fetch a session token first (MMDS version 2).
+// It must be called after the interfaces are attached and before the
+// instance starts.
+func (c *Client) ConfigureMMDS(ifaceIDs ...string) error {
+	logrus.Debugf("Enabling MMDS on %v", ifaceIDs)
+
+	data := map[string]interface{}{
+		"version":            "V2",
+		"network_interfaces": ifaceIDs,
+	}
+
+	return c.request("PUT", "/mmds/config", data)
+}
+
+// PutMMDS replaces the document served by the metadata service. It can be
+// called before and after the instance starts.
+func (c *Client) PutMMDS(data interface{}) error {
+	return c.request("PUT", "/mmds", data)
+}
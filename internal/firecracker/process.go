@@ -0,0 +1,148 @@
+package firecracker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// socketTimeout bounds how long a new Firecracker process may take to
+// create its API socket
+const socketTimeout = 5 * time.Second
+
+// Process is a Firecracker process started by sear for a single VM
+type Process struct {
+	cmd        *exec.Cmd
+	socketPath string
+	done       chan struct{}
+
+	input  io.WriteCloser
+	output *os.File
+}
+
+// Binary returns the Firecracker binary to start: $SEAR_FIRECRACKER if
+// set, otherwise firecracker from PATH
+func Binary() (string, error) {
+	if bin := os.Getenv("SEAR_FIRECRACKER"); bin != "" {
+		return bin, nil
+	}
+	return exec.LookPath("firecracker")
+}
+
+// StartProcess starts Firecracker with its API socket at socketPath and
+// waits until the socket accepts requests. The guest serial console is
+// connected to Input and Output, and the caller must keep reading Output
+// or the VM stalls.
+func StartProcess(binary, socketPath string) (*Process, error) {
+	_ = os.Remove(socketPath)
+
+	cmd := exec.Command(binary, "--api-sock", socketPath)
+	// Relative paths given to the API, such as the vsock socket, resolve
+	// next to the API socket
+	cmd.Dir = filepath.Dir(socketPath)
+	// Keep terminal signals meant for sear away from the VM
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// Standard output and error share a pipe, like they share a terminal
+	output, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		output.Close()
+		return nil, fmt.Errorf("failed to start %s: %w", binary, err)
+	}
+
+	p := &Process{
+		cmd:        cmd,
+		socketPath: socketPath,
+		done:       make(chan struct{}),
+		input:      input,
+		output:     output,
+	}
+	go func() {
+		_ = cmd.Wait()
+		close(p.done)
+	}()
+
+	deadline := time.Now().Add(socketTimeout)
+	for {
+		if _, err := os.Stat(socketPath); err == nil {
+			logrus.Debugf("Firecracker %d listening on %s", cmd.Process.Pid, socketPath)
+			return p, nil
+		}
+
+		select {
+		case <-p.done:
+			msg, _ := io.ReadAll(io.LimitReader(output, 4096))
+			output.Close()
+			return nil, fmt.Errorf("firecracker exited during startup (%v): %s", cmd.ProcessState, bytes.TrimSpace(msg))
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		if time.Now().After(deadline) {
+			p.Kill()
+			output.Close()
+			return nil, errors.New("timed out waiting for the Firecracker API socket")
+		}
+	}
+}
+
+// PID returns the process ID of Firecracker
+func (p *Process) PID() int {
+	return p.cmd.Process.Pid
+}
+
+// Input returns the input of the guest serial console
+func (p *Process) Input() io.Writer {
+	return p.input
+}
+
+// Output returns the output of the guest serial console and of
+// Firecracker itself. It reaches EOF when the process exits; the reader
+// must close it then.
+func (p *Process) Output() io.ReadCloser {
+	return p.output
+}
+
+// SocketPath returns the path of the API socket
+func (p *Process) SocketPath() string {
+	return p.socketPath
+}
+
+// Exited reports whether the process has exited
+func (p *Process) Exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Kill terminates the process and its VM and waits for it to exit
+func (p *Process) Kill() {
+	if !p.Exited() {
+		_ = p.cmd.Process.Kill()
+	}
+	<-p.done
+	_ = os.Remove(p.socketPath)
+}
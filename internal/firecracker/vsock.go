@@ -0,0 +1,71 @@
+package firecracker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SetVsock adds a virtio-vsock device with the given guest context ID.
+// Firecracker exposes it on the host as the Unix socket udsPath; see
+// DialVsock. It must be called before the instance starts.
+func (c *Client) SetVsock(guestCID uint32, udsPath string) error {
+	logrus.Infof("Attaching vsock device: %s", udsPath)
+
+	data := map[string]interface{}{
+		"guest_cid": guestCID,
+		"uds_path":  udsPath,
+	}
+
+	return c.request("PUT", "/vsock", data)
+}
+
+// DialVsock connects to a vsock port in the guest through the host socket
+// of the vsock device, using the CONNECT handshake of Firecracker
+func DialVsock(udsPath string, port uint32, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", udsPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("vsock handshake failed: %w", err)
+	}
+
+	// Read the reply byte by byte, the guest stream follows right after it
+	var reply strings.Builder
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("vsock port %d refused the connection: %w", port, err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if reply.Len() > 64 {
+			conn.Close()
+			return nil, fmt.Errorf("invalid vsock handshake reply")
+		}
+		reply.WriteByte(b[0])
+	}
+	if !strings.HasPrefix(reply.String(), "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("vsock handshake failed: %s", reply.String())
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,68 @@
+package firecracker
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveVsock accepts one connection on a fake vsock host socket, checks
+// the CONNECT line and answers with reply followed by payload
+func serveVsock(t *testing.T, reply, payload string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "vsock.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "CONNECT 22\n" {
+			return
+		}
+		_, _ = io.WriteString(conn, reply+payload)
+	}()
+
+	return path
+}
+
+func TestDialVsock(t *testing.T) {
+	path := serveVsock(t, "OK 1073741824\n", "SSH-2.0-OpenSSH\r\n")
+
+	conn, err := DialVsock(path, 22, time.Second)
+	if err != nil {
+		t.Fatalf("DialVsock: %v", err)
+	}
+	defer conn.Close()
+
+	// The guest stream must start right after the handshake reply
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "SSH-2.0-OpenSSH\r\n" {
+		t.Errorf("stream = %q", got)
+	}
+}
+
+func TestDialVsockRefused(t *testing.T) {
+	// Firecracker closes the connection if nothing listens on the port
+	path := serveVsock(t, "", "")
+
+	if conn, err := DialVsock(path, 22, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("DialVsock succeeded without an OK reply")
+	}
+}
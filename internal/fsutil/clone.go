@@ -0,0 +1,97 @@
+// Package fsutil holds host file system helpers shared by the VM and
+// workspace code.
+package fsutil
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// CloneFile copies src to dst as cheaply as the file system allows: a
+// reflink on file systems that share extents (btrfs, XFS), otherwise a
+// copy of the data regions only, so that holes in sparse images stay
+// holes. It returns whether a reflink was made.
+func CloneFile(src, dst string) (bool, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm()|0o600)
+	if err != nil {
+		return false, err
+	}
+	defer out.Close()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err == nil {
+		return true, out.Close()
+	}
+
+	if err := copySparse(in, out, info.Size()); err != nil {
+		os.Remove(dst)
+		return false, err
+	}
+	return false, out.Close()
+}
+
+// copySparse copies the data regions of in to out and extends out to size.
+// On file systems that cannot report data regions the whole file is
+// copied instead.
+func copySparse(in, out *os.File, size int64) error {
+	for off := int64(0); off < size; {
+		data, err := in.Seek(off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// No data past off
+			break
+		}
+		if seekUnsupported(err) {
+			return copyAll(in, out, size)
+		}
+		if err != nil {
+			return err
+		}
+		hole, err := in.Seek(data, unix.SEEK_HOLE)
+		if seekUnsupported(err) {
+			return copyAll(in, out, size)
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := out.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, io.NewSectionReader(in, data, hole-data)); err != nil {
+			return err
+		}
+		off = hole
+	}
+
+	return out.Truncate(size)
+}
+
+// seekUnsupported reports whether a SEEK_DATA or SEEK_HOLE error means the
+// file system does not support them, as some overlay and NFS setups do
+func seekUnsupported(err error) bool {
+	return errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP)
+}
+
+// copyAll copies all of in to out, overwriting what was copied so far
+func copyAll(in, out *os.File, size int64) error {
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(in, 0, size)); err != nil {
+		return err
+	}
+	return out.Truncate(size)
+}
@@ -0,0 +1,162 @@
+// Package metrics reads the metrics Firecracker writes as one JSON object
+// per flush and exports them in Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metrics are the values of all flushes of a Firecracker process,
+// flattened to dotted names such as "block.read_bytes"
+type Metrics struct {
+	Values map[string]float64
+	// Timestamp is the time of the last flush
+	Timestamp time.Time
+	// Flushes is the number of flushes read
+	Flushes int
+}
+
+// Parse reads Firecracker metrics lines. Most metrics are counters that
+// Firecracker reports as the change since the previous flush; they are
+// summed into totals. Gauges keep the value of the last flush.
+func Parse(r io.Reader) (*Metrics, error) {
+	m := &Metrics{Values: make(map[string]float64)}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &doc); err != nil {
+			// A line being written while we read is incomplete
+			continue
+		}
+
+		flush := make(map[string]float64)
+		flatten("", doc, flush)
+		for key, value := range flush {
+			if IsGauge(key) {
+				m.Values[key] = value
+			} else {
+				m.Values[key] += value
+			}
+		}
+		if ts, ok := flush["utc_timestamp_ms"]; ok {
+			m.Timestamp = time.UnixMilli(int64(ts))
+		}
+		m.Flushes++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read metrics: %w", err)
+	}
+
+	return m, nil
+}
+
+// flatten adds the numbers in v to out under their dotted path
+func flatten(prefix string, v interface{}, out map[string]float64) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flatten(key, child, out)
+		}
+	case float64:
+		out[prefix] = v
+	}
+}
+
+// IsGauge reports whether a metric holds a current value rather than a
+// count since the previous flush
+func IsGauge(key string) bool {
+	switch {
+	case key == "utc_timestamp_ms":
+		return true
+	case strings.HasPrefix(key, "latencies_us."):
+		return true
+	case strings.HasPrefix(key, "api_server.process_startup_time"):
+		return true
+	case strings.HasSuffix(key, ".min_us"), strings.HasSuffix(key, ".max_us"):
+		return true
+	}
+	return false
+}
+
+// Get returns the value of a metric, 0 if it was never reported
+func (m *Metrics) Get(key string) float64 {
+	return m.Values[key]
+}
+
+// Group returns the metrics below a prefix such as "latencies_us", keyed
+// by the rest of their name
+func (m *Metrics) Group(prefix string) map[string]float64 {
+	group := make(map[string]float64)
+	for key, value := range m.Values {
+		if rest, ok := strings.CutPrefix(key, prefix+"."); ok {
+			group[rest] = value
+		}
+	}
+	return group
+}
+
+// WritePrometheus writes all metrics in Prometheus text format, named
+// firecracker_<group>_<metric> and labelled with labels
+func (m *Metrics) WritePrometheus(w io.Writer, labels map[string]string) error {
+	keys := make([]string, 0, len(m.Values))
+	for key := range m.Values {
+		if key != "utc_timestamp_ms" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	labelSet := ""
+	if len(pairs) > 0 {
+		labelSet = "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	for _, key := range keys {
+		name := "firecracker_" + sanitize(key)
+		kind := "counter"
+		if IsGauge(key) {
+			kind = "gauge"
+		}
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n%s%s %v\n", name, kind, name, labelSet, m.Values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sanitize turns a dotted metric path into a Prometheus metric name
+func sanitize(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, key)
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const flushes = `{"utc_timestamp_ms":1700000000000,"block":{"read_bytes":4096,"write_count":1},"latencies_us":{"pause_vm":120},"vcpu":{"exit_io_in":3,"exit_io_in_agg":{"min_us":1,"max_us":9,"sum_us":20}}}
+{"utc_timestamp_ms":1700000060000,"block":{"read_bytes":1024,"write_count":2},"latencies_us":{"pause_vm":80},"vcpu":{"exit_io_in":4,"exit_io_in_agg":{"min_us":2,"max_us":5,"sum_us":10}}}
+{"utc_timestamp_ms":17000001`
+
+func TestParse(t *testing.T) {
+	m, err := Parse(strings.NewReader(flushes))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	if m.Flushes != 2 {
+		t.Errorf("Flushes = %d, want 2 (the truncated line is skipped)", m.Flushes)
+	}
+	if got := m.Timestamp.UnixMilli(); got != 1700000060000 {
+		t.Errorf("Timestamp = %d, want the last flush", got)
+	}
+
+	tests := map[string]float64{
+		"block.read_bytes":           5120,
+		"block.write_count":          3,
+		"vcpu.exit_io_in":            7,
+		"vcpu.exit_io_in_agg.sum_us": 30,
+		"vcpu.exit_io_in_agg.max_us": 5,
+		"latencies_us.pause_vm":      80,
+		"net.rx_bytes_count":         0,
+	}
+	for key, want := range tests {
+		if got := m.Get(key); got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+
+	if group := m.Group("latencies_us"); len(group) != 1 || group["pause_vm"] != 80 {
+		t.Errorf("Group(latencies_us) = %v", group)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	m, err := Parse(strings.NewReader(flushes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := m.WritePrometheus(&buf, map[string]string{"vm": "3f9a1c2e", "profile": "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"# TYPE firecracker_block_read_bytes counter\n",
+		`firecracker_block_read_bytes{profile="dev",vm="3f9a1c2e"} 5120` + "\n",
+		"# TYPE firecracker_latencies_us_pause_vm gauge\n",
+		`firecracker_vcpu_exit_io_in_agg_sum_us{profile="dev",vm="3f9a1c2e"} 30` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "utc_timestamp_ms") {
+		t.Errorf("timestamp should not be exported")
+	}
+}
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// MaxSlots is the number of VM networks the allocator hands out. Slot n
+// uses the /30 subnet at 172.16.0.0 + 4n, so all of them fit in
+// 172.16.0.0/16.
+const MaxSlots = 16384
+
+// ErrSlotBusy is returned when a slot is leased by another VM
+var ErrSlotBusy = errors.New("network slot is in use")
+
+// Allocator hands out a TAP device and a /30 subnet per VM, so that
+// several VMs can run side by side. Leases are file locks in dir: they
+// are held for as long as the VM runs and released by the kernel if the
+// sear process owning the VM dies.
+type Allocator struct {
+	dir string
+}
+
+// Lease is the network of a single VM
+type Lease struct {
+	Slot      int
+	TAPDevice string
+	TAPIP     string
+	GuestIP   string
+	GatewayIP string
+
+	file *os.File
+}
+
+// NewAllocator creates an allocator keeping its leases in dir
+func NewAllocator(dir string) *Allocator {
+	return &Allocator{dir: dir}
+}
+
+// Acquire leases a specific slot, failing with ErrSlotBusy if another VM
+// holds it
+func (a *Allocator) Acquire(slot int) (*Lease, error) {
+	if slot < 0 || slot >= MaxSlots {
+		return nil, fmt.Errorf("invalid network slot %d", slot)
+	}
+	if err := os.MkdirAll(a.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create lease directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(a.dir, fmt.Sprintf("slot-%d", slot)), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network lease: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, ErrSlotBusy
+		}
+		return nil, fmt.Errorf("failed to lock network lease: %w", err)
+	}
+
+	// 172.16.0.0 + 4*slot is the network address of the subnet
+	base := slot * 4
+	addr := func(host int) string {
+		n := base + host
+		return fmt.Sprintf("172.16.%d.%d", n>>8, n&0xff)
+	}
+
+	return &Lease{
+		Slot:      slot,
+		TAPDevice: fmt.Sprintf("tap%d", slot),
+		TAPIP:     addr(1),
+		GuestIP:   addr(2),
+		GatewayIP: addr(1),
+		file:      f,
+	}, nil
+}
+
+// AcquireAny leases the lowest free slot
+func (a *Allocator) AcquireAny() (*Lease, error) {
+	for slot := 0; slot < MaxSlots; slot++ {
+		lease, err := a.Acquire(slot)
+		if errors.Is(err, ErrSlotBusy) {
+			continue
+		}
+		return lease, err
+	}
+	return nil, errors.New("all network slots are in use")
+}
+
+// Release gives the slot back
+func (l *Lease) Release() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
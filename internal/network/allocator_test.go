@@ -0,0 +1,65 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAllocatorAddresses(t *testing.T) {
+	a := NewAllocator(t.TempDir())
+
+	tests := []struct {
+		slot             int
+		tap, host, guest string
+	}{
+		{0, "tap0", "172.16.0.1", "172.16.0.2"},
+		{1, "tap1", "172.16.0.5", "172.16.0.6"},
+		{64, "tap64", "172.16.1.1", "172.16.1.2"},
+		{MaxSlots - 1, "tap16383", "172.16.255.253", "172.16.255.254"},
+	}
+	for _, tt := range tests {
+		lease, err := a.Acquire(tt.slot)
+		if err != nil {
+			t.Fatalf("Acquire(%d): %v", tt.slot, err)
+		}
+		if lease.TAPDevice != tt.tap || lease.TAPIP != tt.host || lease.GatewayIP != tt.host || lease.GuestIP != tt.guest {
+			t.Errorf("slot %d: got %+v, want %s %s %s", tt.slot, lease, tt.tap, tt.host, tt.guest)
+		}
+		lease.Release()
+	}
+
+	if _, err := a.Acquire(MaxSlots); err == nil {
+		t.Errorf("Acquire(%d) succeeded", MaxSlots)
+	}
+}
+
+func TestAllocatorLeases(t *testing.T) {
+	a := NewAllocator(t.TempDir())
+
+	first, err := a.AcquireAny()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := a.AcquireAny()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Slot != 0 || second.Slot != 1 {
+		t.Fatalf("got slots %d and %d, want 0 and 1", first.Slot, second.Slot)
+	}
+
+	if _, err := a.Acquire(0); !errors.Is(err, ErrSlotBusy) {
+		t.Errorf("Acquire(0) while leased: got %v, want ErrSlotBusy", err)
+	}
+
+	first.Release()
+	third, err := a.AcquireAny()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Slot != 0 {
+		t.Errorf("released slot was not reused, got slot %d", third.Slot)
+	}
+	second.Release()
+	third.Release()
+}
@@ -3,6 +3,7 @@ package network
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
@@ -14,15 +15,17 @@ import (
 type Manager struct {
 	TAPDevice     string
 	TAPIP         string
+	GuestIP       string
 	GatewayIP     string
 	HostInterface string
 }
 
 // NewManager creates a new network manager
-func NewManager(tapDevice, tapIP, gatewayIP string) *Manager {
+func NewManager(tapDevice, tapIP, guestIP, gatewayIP string) *Manager {
 	return &Manager{
 		TAPDevice: tapDevice,
 		TAPIP:     tapIP,
+		GuestIP:   guestIP,
 		GatewayIP: gatewayIP,
 	}
 }
@@ -158,13 +161,14 @@ func (m *Manager) enableIPForwarding() error {
 	return nil
 }
 
-// configureNAT sets up NAT for the VM
+// configureNAT sets up NAT for the VM. The rule only matches the subnet
+// of this VM, so that tearing down one VM leaves the others connected.
 func (m *Manager) configureNAT() error {
 	// Remove existing NAT rule
-	_ = m.runCommand("iptables", "-t", "nat", "-D", "POSTROUTING", "-o", m.HostInterface, "-j", "MASQUERADE")
+	_ = m.runCommand("iptables", m.natRule("-D")...)
 
 	// Add NAT rule
-	if err := m.runCommand("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", m.HostInterface, "-j", "MASQUERADE"); err != nil {
+	if err := m.runCommand("iptables", m.natRule("-A")...); err != nil {
 		return fmt.Errorf("failed to configure NAT: %w", err)
 	}
 
@@ -173,7 +177,12 @@ func (m *Manager) configureNAT() error {
 
 // removeNAT removes NAT configuration
 func (m *Manager) removeNAT() error {
-	return m.runCommand("iptables", "-t", "nat", "-D", "POSTROUTING", "-o", m.HostInterface, "-j", "MASQUERADE")
+	return m.runCommand("iptables", m.natRule("-D")...)
+}
+
+// natRule returns the iptables arguments to add or delete the NAT rule
+func (m *Manager) natRule(op string) []string {
+	return []string{"-t", "nat", op, "POSTROUTING", "-s", m.TAPIP + "/30", "-o", m.HostInterface, "-j", "MASQUERADE"}
 }
 
 // detectHostInterface detects the default host network interface
@@ -228,7 +237,11 @@ func (m *Manager) runCommand(name string, args ...string) error {
 
 // GetMACAddress generates a MAC address for the VM
 func (m *Manager) GetMACAddress() string {
-	// Generate MAC address based on gateway IP
-	// Gateway IP: 172.16.0.1 -> MAC: 06:00:AC:10:00:02
-	return "06:00:AC:10:00:02"
+	// Generate MAC address based on guest IP, the guest derives its
+	// address from it. Guest IP: 172.16.0.2 -> MAC: 06:00:AC:10:00:02
+	ip := net.ParseIP(m.GuestIP).To4()
+	if ip == nil {
+		return "06:00:AC:10:00:02"
+	}
+	return fmt.Sprintf("06:00:%02X:%02X:%02X:%02X", ip[0], ip[1], ip[2], ip[3])
 }
@@ -0,0 +1,75 @@
+// Package redact keeps secret values out of the log output of sear.
+package redact
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Mask replaces secret values
+const Mask = "[REDACTED]"
+
+// minLength is the length of the shortest value redacted; masking shorter
+// ones would mangle unrelated output
+const minLength = 4
+
+var (
+	mu       sync.RWMutex
+	values   = make(map[string]bool)
+	replacer = strings.NewReplacer()
+)
+
+// Add registers secret values. Each line of a multi-line value is
+// registered as well, since output often shows only part of it.
+func Add(secrets ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, s := range secrets {
+		for _, v := range append([]string{s}, strings.Split(s, "\n")...) {
+			v = strings.TrimSpace(v)
+			if len(v) >= minLength {
+				values[v] = true
+			}
+		}
+	}
+
+	// Replace longer values first so that a value containing another is
+	// masked as a whole
+	sorted := make([]string, 0, len(values))
+	for v := range values {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, v := range sorted {
+		pairs = append(pairs, v, Mask)
+	}
+	replacer = strings.NewReplacer(pairs...)
+}
+
+// String returns s with all registered secret values masked
+func String(s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return replacer.Replace(s)
+}
+
+// Formatter wraps a logrus formatter and masks secret values in the
+// entries it formats, including the errors they carry
+type Formatter struct {
+	logrus.Formatter
+}
+
+// Format implements logrus.Formatter
+func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	out, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(String(string(out))), nil
+}
@@ -0,0 +1,34 @@
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestFormatter(t *testing.T) {
+	Add("ghp_secret", "abc", "line-one\nline-two")
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&Formatter{Formatter: &logrus.TextFormatter{DisableTimestamp: true}})
+
+	logger.WithError(errors.New("auth with ghp_secret failed")).Errorf("token ghp_secret, key line-two, short abc")
+	out := buf.String()
+
+	for _, leaked := range []string{"ghp_secret", "line-two"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("output contains %q: %s", leaked, out)
+		}
+	}
+	if !strings.Contains(out, "short abc") {
+		t.Errorf("values shorter than %d bytes should be kept: %s", minLength, out)
+	}
+	if got := strings.Count(out, Mask); got != 3 {
+		t.Errorf("got %d masks, want 3: %s", got, out)
+	}
+}
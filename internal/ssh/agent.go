@@ -0,0 +1,34 @@
+package ssh
+
+import (
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// requestAgent forwards the host SSH agent over session if forwarding is
+// enabled. The guest may refuse it; the session then runs without agent.
+func (c *Client) requestAgent(conn *ssh.Client, session *ssh.Session) {
+	c.mu.Lock()
+	forward, socket := c.forwardAgent, c.agentSocket
+	// Agent channels opened by the guest are accepted once per connection
+	register := forward && c.agentConn != conn
+	if register {
+		c.agentConn = conn
+	}
+	c.mu.Unlock()
+
+	if !forward {
+		return
+	}
+
+	if register {
+		if err := agent.ForwardToRemote(conn, socket); err != nil {
+			logrus.Warnf("Failed to forward SSH agent: %v", err)
+			return
+		}
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		logrus.Warnf("Guest refused SSH agent forwarding: %v", err)
+	}
+}
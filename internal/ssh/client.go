@@ -1,21 +1,62 @@
 package ssh
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/nikiskaarup/sear/internal/tty"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 )
 
-// Client represents an SSH client for connecting to the VM
+const (
+	// dialTimeout bounds the TCP connect and SSH handshake
+	dialTimeout = 10 * time.Second
+
+	// keepaliveInterval is how often an idle connection is probed
+	keepaliveInterval = 15 * time.Second
+
+	// keepaliveTimeout is how long a keepalive reply is waited for
+	keepaliveTimeout = 10 * time.Second
+
+	// keepaliveMaxMissed is the number of unanswered keepalives after
+	// which the connection is considered dead
+	keepaliveMaxMissed = 3
+)
+
+// Client represents an SSH client for connecting to the VM.
+//
+// A single SSH connection is kept open and shared by all commands and
+// shells; each of them runs in its own session multiplexed over it. The
+// connection is probed with keepalives and transparently re-established
+// when it drops.
 type Client struct {
 	host       string
 	port       int
 	username   string
 	privateKey string
+	dialer     Dialer
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	stopKA chan struct{}
+
+	// forwardAgent forwards the agent at agentSocket into shells and
+	// commands; agentConn is the connection that forwards it already
+	forwardAgent bool
+	agentSocket  string
+	agentConn    *ssh.Client
 }
 
+// Dialer opens the transport connection to sshd, for guests reached
+// without TCP
+type Dialer func(timeout time.Duration) (net.Conn, error)
+
 // NewClient creates a new SSH client
 func NewClient(host string, port int, username, privateKey string) *Client {
 	return &Client{
@@ -26,8 +67,85 @@ func NewClient(host string, port int, username, privateKey string) *Client {
 	}
 }
 
-// Connect establishes an SSH connection
+// SetDialer makes the client connect through dial instead of TCP to host
+// and port
+func (c *Client) SetDialer(dial Dialer) {
+	c.dialer = dial
+}
+
+// SetForwardAgent makes later shells and commands forward the host SSH
+// agent found through $SSH_AUTH_SOCK
+func (c *Client) SetForwardAgent(forward bool) error {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if forward && socket == "" {
+		return errors.New("SSH_AUTH_SOCK is not set, no SSH agent to forward")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forwardAgent = forward
+	c.agentSocket = socket
+	return nil
+}
+
+// Connect returns the shared SSH connection, establishing it if needed
 func (c *Client) Connect() (*ssh.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		return c.conn, nil
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	c.conn = conn
+	c.stopKA = make(chan struct{})
+	go c.keepalive(conn, c.stopKA)
+
+	return conn, nil
+}
+
+// WaitReady blocks until an SSH connection can be established or the
+// timeout expires. It is used right after boot, while sshd in the guest
+// is still coming up.
+func (c *Client) WaitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := c.Connect()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("guest did not accept SSH connections within %s: %w", timeout, err)
+		}
+		logrus.Debugf("Waiting for SSH: %v", err)
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// Close closes the shared SSH connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	close(c.stopKA)
+	err := c.conn.Close()
+	c.conn = nil
+	c.stopKA = nil
+
+	return err
+}
+
+// dial performs the TCP connect and SSH handshake
+func (c *Client) dial() (*ssh.Client, error) {
 	keyPath := c.expandPath(c.privateKey)
 
 	// Read private key
@@ -49,68 +167,217 @@ func (c *Client) Connect() (*ssh.Client, error) {
 			ssh.PublicKeys(signer),
 		},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         dialTimeout,
 	}
 
 	// Connect
-	addr := fmt.Sprintf("%s:%d", c.host, c.port)
-	client, err := ssh.Dial("tcp", addr, config)
+	addr := net.JoinHostPort(c.host, fmt.Sprintf("%d", c.port))
+	if c.dialer != nil {
+		addr = "vsock"
+	}
+	client, err := c.connect(addr, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
 	}
 
+	logrus.Debugf("SSH connection established to %s", addr)
 	return client, nil
 }
 
-// ExecuteCommand executes a command on the VM
-func (c *Client) ExecuteCommand(cmd string) error {
-	client, err := c.Connect()
-	if err != nil {
-		return err
+// connect opens the SSH connection over TCP or through the dialer
+func (c *Client) connect(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if c.dialer == nil {
+		return ssh.Dial("tcp", addr, config)
 	}
-	defer client.Close()
 
-	session, err := client.NewSession()
+	conn, err := c.dialer(dialTimeout)
 	if err != nil {
-		return fmt.Errorf("failed to create session: %w", err)
+		return nil, err
 	}
-	defer session.Close()
 
-	// Run command
-	output, err := session.CombinedOutput(cmd)
+	// ssh.Dial only bounds the TCP connect; bound the handshake as well
+	if err := conn.SetDeadline(time.Now().Add(dialTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
-		return fmt.Errorf("command failed: %w, output: %s", err, output)
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		sshConn.Close()
+		return nil, err
 	}
 
-	return nil
+	return ssh.NewClient(sshConn, chans, reqs), nil
 }
 
-// Shell starts an interactive shell session
-func (c *Client) Shell() error {
-	client, err := c.Connect()
+// keepalive periodically probes conn and drops it once it fails or misses
+// keepaliveMaxMissed replies in a row, so that the next session triggers a
+// reconnect. A probe still waiting for its reply is not sent again.
+func (c *Client) keepalive(conn *ssh.Client, stop chan struct{}) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	var (
+		reply  chan error
+		missed int
+	)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if reply == nil {
+			reply = make(chan error, 1)
+			go func(reply chan<- error) {
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}(reply)
+		}
+
+		timeout := time.NewTimer(keepaliveTimeout)
+		select {
+		case <-stop:
+			timeout.Stop()
+			return
+		case err := <-reply:
+			timeout.Stop()
+			reply = nil
+			if err != nil {
+				logrus.Debugf("SSH keepalive failed, dropping connection: %v", err)
+				c.drop(conn)
+				return
+			}
+			missed = 0
+		case <-timeout.C:
+			missed++
+			logrus.Debugf("SSH keepalive not answered within %s (%d/%d)", keepaliveTimeout, missed, keepaliveMaxMissed)
+			if missed >= keepaliveMaxMissed {
+				// Closing the connection also unblocks the pending request
+				logrus.Debug("SSH connection stopped answering keepalives, dropping it")
+				c.drop(conn)
+				return
+			}
+		}
+	}
+}
+
+// drop discards conn if it is still the shared connection
+func (c *Client) drop(conn *ssh.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != conn {
+		return
+	}
+
+	close(c.stopKA)
+	_ = conn.Close()
+	c.conn = nil
+	c.stopKA = nil
+}
+
+// newSession opens a session on the shared connection and returns it with
+// the connection. If the connection turns out to be dead it is
+// re-established once before giving up.
+func (c *Client) newSession() (*ssh.Session, *ssh.Client, error) {
+	conn, err := c.Connect()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err := conn.NewSession()
+	if err == nil {
+		return session, conn, nil
+	}
+
+	logrus.Debugf("Failed to open SSH session, reconnecting: %v", err)
+	c.drop(conn)
+
+	conn, err = c.Connect()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer client.Close()
 
-	session, err := client.NewSession()
+	session, err = conn.NewSession()
 	if err != nil {
-		return fmt.Errorf("failed to create session: %w", err)
+		return nil, nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	return session, conn, nil
+}
+
+// Shell starts an interactive shell session and waits for it to exit.
+//
+// When stdin is a terminal it is switched to raw mode for the duration of
+// the session and window size changes are forwarded to the guest.
+func (c *Client) Shell() (*ExecResult, error) {
+	session, conn, err := c.newSession()
+	if err != nil {
+		return nil, err
 	}
 	defer session.Close()
 
-	// Set up PTY
-	if err := session.RequestPty("xterm", 80, 40, ssh.TerminalModes{
-		ssh.ECHO: 1,
-	}); err != nil {
-		return fmt.Errorf("failed to request PTY: %w", err)
+	cleanup, err := requestPty(session)
+	if err != nil {
+		return nil, err
 	}
+	defer cleanup()
+
+	c.requestAgent(conn, session)
 
 	// Start interactive shell
 	session.Stdin = os.Stdin
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
 
-	return session.Shell()
+	start := time.Now()
+	if err := session.Shell(); err != nil {
+		return nil, fmt.Errorf("failed to start shell: %w", err)
+	}
+
+	return waitResult(session.Wait(), start)
+}
+
+// requestPty allocates a remote PTY matching the local terminal. If stdin
+// is a terminal it is put into raw mode and resizes are forwarded until
+// the returned cleanup function is called.
+func requestPty(session *ssh.Session) (func(), error) {
+	local := tty.Open(os.Stdin)
+	width, height := local.Size()
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(tty.Name(), height, width, modes); err != nil {
+		return nil, fmt.Errorf("failed to request PTY: %w", err)
+	}
+
+	if local == nil {
+		return func() {}, nil
+	}
+
+	if err := local.MakeRaw(); err != nil {
+		return nil, fmt.Errorf("failed to set terminal to raw mode: %w", err)
+	}
+
+	stopResize := local.WatchResize(func(width, height int) {
+		if err := session.WindowChange(height, width); err != nil {
+			logrus.Debugf("Failed to forward window size: %v", err)
+		}
+	})
+
+	return func() {
+		stopResize()
+		if err := local.Restore(); err != nil {
+			logrus.Warnf("Failed to restore terminal: %v", err)
+		}
+	}, nil
 }
 
 // expandPath expands home directory in path
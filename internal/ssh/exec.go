@@ -0,0 +1,125 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ExecOptions controls how a remote command is run
+type ExecOptions struct {
+	// Stdin is fed to the remote command; nil means no input
+	Stdin io.Reader
+	// Stdout and Stderr receive the command output as it arrives; nil
+	// discards the stream
+	Stdout io.Writer
+	Stderr io.Writer
+	// TTY allocates a remote PTY for the command. Stderr is merged into
+	// Stdout by the guest in that case.
+	TTY bool
+}
+
+// ExecResult describes how a remote command terminated
+type ExecResult struct {
+	// ExitCode is the exit status of the command, or -1 if it was killed
+	// by a signal
+	ExitCode int
+	// Signal is the name of the signal that killed the command, if any
+	Signal string
+	// Duration is the wall time between starting the command and its exit
+	Duration time.Duration
+}
+
+// Success reports whether the command exited with status 0
+func (r *ExecResult) Success() bool {
+	return r.ExitCode == 0 && r.Signal == ""
+}
+
+// String returns a short human readable description of the result
+func (r *ExecResult) String() string {
+	if r.Signal != "" {
+		return fmt.Sprintf("killed by signal %s after %s", r.Signal, r.Duration.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("exit status %d after %s", r.ExitCode, r.Duration.Round(time.Millisecond))
+}
+
+// Exec runs cmd on the VM, streaming its output to the writers in opts.
+//
+// A non-zero exit status is not an error: it is reported through the
+// returned ExecResult. An error is only returned when the command could
+// not be run or its exit status could not be determined, for example
+// because the connection dropped.
+func (c *Client) Exec(cmd string, opts ExecOptions) (*ExecResult, error) {
+	session, conn, err := c.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	c.requestAgent(conn, session)
+
+	if opts.TTY {
+		cleanup, err := requestPty(session)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+	}
+
+	session.Stdin = opts.Stdin
+	session.Stdout = opts.Stdout
+	session.Stderr = opts.Stderr
+
+	start := time.Now()
+	if err := session.Start(cmd); err != nil {
+		return nil, fmt.Errorf("failed to start command: %w", err)
+	}
+
+	return waitResult(session.Wait(), start)
+}
+
+// waitResult converts the error returned by Session.Wait into an ExecResult
+func waitResult(err error, start time.Time) (*ExecResult, error) {
+	result := &ExecResult{Duration: time.Since(start)}
+	if err == nil {
+		return result, nil
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitStatus()
+		if exitErr.Signal() != "" {
+			result.ExitCode = -1
+			result.Signal = exitErr.Signal()
+		}
+		return result, nil
+	}
+
+	var missingErr *ssh.ExitMissingError
+	if errors.As(err, &missingErr) {
+		return nil, fmt.Errorf("command exited without reporting a status (connection lost?)")
+	}
+
+	return nil, fmt.Errorf("command failed: %w", err)
+}
+
+// ExecuteCommand executes a command on the VM, returning an error that
+// includes the command output if it does not exit successfully
+func (c *Client) ExecuteCommand(cmd string) error {
+	var output bytes.Buffer
+	result, err := c.Exec(cmd, ExecOptions{Stdout: &output, Stderr: &output})
+	if err != nil {
+		return err
+	}
+
+	if !result.Success() {
+		return fmt.Errorf("command failed: %s, output: %s", result, strings.TrimSpace(output.String()))
+	}
+
+	return nil
+}
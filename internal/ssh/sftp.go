@@ -0,0 +1,236 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// SFTP opens an SFTP session over the shared connection. The caller must
+// close the returned client.
+func (c *Client) SFTP() (*sftp.Client, error) {
+	conn, err := c.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+
+	return client, nil
+}
+
+// Upload copies a local file or directory tree to the VM
+func (c *Client) Upload(localPath, remotePath string) error {
+	client, err := c.SFTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return Upload(client, localPath, remotePath)
+}
+
+// Download copies a file or directory tree from the VM to the host
+func (c *Client) Download(remotePath, localPath string) error {
+	client, err := c.SFTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return Download(client, remotePath, localPath)
+}
+
+// Upload copies localPath to remotePath over an SFTP session, recursing
+// into directories. Like cp -r, if remotePath is an existing directory the
+// source is copied into it. File modes and modification times are
+// preserved and symbolic links are recreated rather than followed.
+func Upload(client *sftp.Client, localPath, remotePath string) error {
+	if info, err := client.Stat(remotePath); err == nil && info.IsDir() {
+		remotePath = path.Join(remotePath, filepath.Base(localPath))
+	}
+
+	// Directory attributes are set once their contents are written: writing
+	// a child bumps the modification time, and a read-only mode would keep
+	// the children from being created
+	type dirAttrs struct {
+		target string
+		info   os.FileInfo
+	}
+	var dirs []dirAttrs
+
+	err := filepath.Walk(localPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(remotePath, filepath.ToSlash(rel))
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			_ = client.Remove(target)
+			if err := client.Symlink(link, target); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %w", target, err)
+			}
+			return nil
+
+		case info.IsDir():
+			if err := client.MkdirAll(target); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", target, err)
+			}
+			dirs = append(dirs, dirAttrs{target, info})
+			return nil
+
+		case info.Mode().IsRegular():
+			if err := uploadFile(client, p, target); err != nil {
+				return err
+			}
+
+		default:
+			logrus.Warnf("Skipping special file %s", p)
+			return nil
+		}
+
+		return setAttrs(client, target, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Walk visits parents first, so in reverse the deepest come first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setAttrs(client, dirs[i].target, dirs[i].info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setAttrs copies the mode and modification time of info to remotePath
+func setAttrs(client *sftp.Client, remotePath string, info os.FileInfo) error {
+	if err := client.Chmod(remotePath, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", remotePath, err)
+	}
+	if err := client.Chtimes(remotePath, info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("failed to set times of %s: %w", remotePath, err)
+	}
+	return nil
+}
+
+// uploadFile copies the contents of a single regular file
+func uploadFile(client *sftp.Client, localPath, remotePath string) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", remotePath, err)
+	}
+
+	if _, err := dst.ReadFrom(src); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to write %s: %w", remotePath, err)
+	}
+
+	return dst.Close()
+}
+
+// Download copies remotePath to localPath over an SFTP session, with the
+// same semantics as Upload
+func Download(client *sftp.Client, remotePath, localPath string) error {
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		localPath = filepath.Join(localPath, path.Base(remotePath))
+	}
+
+	root, err := client.Lstat(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", remotePath, err)
+	}
+
+	return download(client, remotePath, localPath, root)
+}
+
+// download copies a single remote entry, recursing into directories
+func download(client *sftp.Client, remotePath, localPath string, info os.FileInfo) error {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := client.ReadLink(remotePath)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %s: %w", remotePath, err)
+		}
+		if err := os.Remove(localPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return os.Symlink(link, localPath)
+
+	case info.IsDir():
+		if err := os.MkdirAll(localPath, 0o755); err != nil {
+			return err
+		}
+		entries, err := client.ReadDir(remotePath)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", remotePath, err)
+		}
+		for _, entry := range entries {
+			err := download(client, path.Join(remotePath, entry.Name()), filepath.Join(localPath, entry.Name()), entry)
+			if err != nil {
+				return err
+			}
+		}
+
+	case info.Mode().IsRegular():
+		if err := downloadFile(client, remotePath, localPath); err != nil {
+			return err
+		}
+
+	default:
+		logrus.Warnf("Skipping special file %s", remotePath)
+		return nil
+	}
+
+	if err := os.Chmod(localPath, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(localPath, info.ModTime(), info.ModTime())
+}
+
+// downloadFile copies the contents of a single regular file
+func downloadFile(client *sftp.Client, remotePath, localPath string) error {
+	src, err := client.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", remotePath, err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to read %s: %w", remotePath, err)
+	}
+
+	return dst.Close()
+}
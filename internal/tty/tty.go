@@ -0,0 +1,96 @@
+package tty
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+const (
+	// DefaultTerm is used when the host does not set $TERM
+	DefaultTerm = "xterm-256color"
+
+	// Fallback dimensions when the size of the terminal is unknown
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+// Terminal wraps a local terminal file descriptor
+type Terminal struct {
+	fd    int
+	state *term.State
+}
+
+// Open returns the terminal attached to f, or nil if f is not a terminal
+func Open(f *os.File) *Terminal {
+	fd := int(f.Fd())
+	if !term.IsTerminal(fd) {
+		return nil
+	}
+	return &Terminal{fd: fd}
+}
+
+// Name returns the terminal type to request from the remote side
+func Name() string {
+	if t := os.Getenv("TERM"); t != "" {
+		return t
+	}
+	return DefaultTerm
+}
+
+// Size returns the current terminal width and height
+func (t *Terminal) Size() (width, height int) {
+	if t != nil {
+		if w, h, err := term.GetSize(t.fd); err == nil && w > 0 && h > 0 {
+			return w, h
+		}
+	}
+	return defaultWidth, defaultHeight
+}
+
+// MakeRaw switches the terminal into raw mode. The previous mode is
+// restored by Restore.
+func (t *Terminal) MakeRaw() error {
+	state, err := term.MakeRaw(t.fd)
+	if err != nil {
+		return err
+	}
+	t.state = state
+	return nil
+}
+
+// Restore puts the terminal back into the mode it had before MakeRaw
+func (t *Terminal) Restore() error {
+	if t == nil || t.state == nil {
+		return nil
+	}
+	err := term.Restore(t.fd, t.state)
+	t.state = nil
+	return err
+}
+
+// WatchResize calls fn with the new terminal size every time the window
+// is resized, until the returned stop function is called
+func (t *Terminal) WatchResize(fn func(width, height int)) (stop func()) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGWINCH)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigCh:
+				fn(t.Size())
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigCh)
+		close(done)
+	}
+}
@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/agent"
+	"github.com/nikiskaarup/sear/internal/firecracker"
+)
+
+// agentInitramfs is the initramfs starting sear-agent in the runtime
+// directory of a VM
+const agentInitramfs = "initramfs.cpio"
+
+// AgentBinary returns the sear-agent binary booted with VMs of profiles
+// that use the agent: $SEAR_AGENT if set, otherwise sear-agent next to
+// the sear executable or from PATH
+func AgentBinary() (string, error) {
+	if bin := os.Getenv("SEAR_AGENT"); bin != "" {
+		return bin, nil
+	}
+
+	if exe, err := os.Executable(); err == nil {
+		bin := filepath.Join(filepath.Dir(exe), "sear-agent")
+		if _, err := os.Stat(bin); err == nil {
+			return bin, nil
+		}
+	}
+
+	bin, err := exec.LookPath("sear-agent")
+	if err != nil {
+		return "", fmt.Errorf("sear-agent not found, set SEAR_AGENT or install it next to sear")
+	}
+	return bin, nil
+}
+
+// prepareAgent writes the initramfs that runs sear-agent as init helper
+// and returns its path
+func (v *VM) prepareAgent() (string, error) {
+	bin, err := AgentBinary()
+	if err != nil {
+		return "", err
+	}
+
+	dir := vmDir(v.id)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+
+	path := filepath.Join(dir, agentInitramfs)
+	if err := agent.WriteInitramfs(bin, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// dialAgent connects to sear-agent in the guest over the vsock device
+func (v *VM) dialAgent(timeout time.Duration) (net.Conn, error) {
+	return firecracker.DialVsock(v.VsockPath(), agent.Port, timeout)
+}
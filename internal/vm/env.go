@@ -0,0 +1,188 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/redact"
+	"github.com/nikiskaarup/sear/internal/ssh"
+	"github.com/pkg/sftp"
+)
+
+// Env returns the environment of guest sessions as NAME=value: the env of
+// the profile followed by its secrets. Values are resolved once; secret
+// values are registered for redaction.
+func (v *VM) Env() ([]string, error) {
+	if v.env != nil {
+		return v.env, nil
+	}
+
+	env := []string{}
+	secrets := make(map[string]string)
+	for _, e := range v.profile.Env {
+		value, err := resolveEnvVar(e)
+		if err != nil {
+			return nil, fmt.Errorf("env %s: %w", e.Name, err)
+		}
+		env = append(env, e.Name+"="+value)
+	}
+	for _, e := range v.profile.Secrets {
+		value, err := resolveEnvVar(e)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", e.Name, err)
+		}
+		redact.Add(value)
+		secrets[e.Name] = value
+		env = append(env, e.Name+"="+value)
+	}
+
+	v.env = env
+	v.secrets = secrets
+	return env, nil
+}
+
+// secret returns the value of a secret of the profile
+func (v *VM) secret(name string) (string, bool) {
+	if _, err := v.Env(); err != nil {
+		return "", false
+	}
+	value, ok := v.secrets[name]
+	return value, ok
+}
+
+// SetupEnv makes the environment of the profile available to all
+// commands and shells run through sshClient
+func (v *VM) SetupEnv(sshClient *SSHClient) error {
+	env, err := v.Env()
+	if err != nil {
+		return err
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	return sshClient.SetEnv(env)
+}
+
+// hasEnv reports whether guest sessions of a profile get an environment
+func hasEnv(profile config.Profile) bool {
+	return len(profile.Env) > 0 || len(profile.Secrets) > 0
+}
+
+// resolveEnvVar returns the value of an environment variable. Errors never
+// include the value.
+func resolveEnvVar(e config.EnvVar) (string, error) {
+	switch {
+	case e.Env != "":
+		value, ok := os.LookupEnv(e.Env)
+		if !ok {
+			return "", fmt.Errorf("host environment variable %s is not set", e.Env)
+		}
+		return value, nil
+	case e.File != "":
+		path, err := config.ExpandPath(e.File)
+		if err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case e.Command != "":
+		var stdout bytes.Buffer
+		cmd := exec.Command("sh", "-c", e.Command)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		cmd.Stdin = os.Stdin
+		if err := cmd.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return "", fmt.Errorf("command '%s' failed: %s", e.Command, exitErr.ProcessState)
+			}
+			return "", fmt.Errorf("command '%s' failed: %w", e.Command, err)
+		}
+		return strings.TrimRight(stdout.String(), "\r\n"), nil
+	}
+	return e.Value, nil
+}
+
+// The environment file of guests controlled over SSH. /run/sear is a
+// tmpfs, so the values never reach the guest disk; login shells read the
+// file through the profile script.
+const (
+	guestEnvDir     = "/run/sear"
+	guestEnvFile    = guestEnvDir + "/env"
+	guestEnvProfile = "/etc/profile.d/sear-env.sh"
+)
+
+// envSetter is implemented by clients that keep the session environment
+// themselves
+type envSetter interface {
+	SetEnv(env []string) error
+}
+
+// SetEnv sets the environment of all later commands and shells in the
+// guest, given as NAME=value
+func (c *SSHClient) SetEnv(env []string) error {
+	if s, ok := c.client.(envSetter); ok {
+		return s.SetEnv(env)
+	}
+
+	mountTmpfs := fmt.Sprintf("mkdir -p %[1]s && chmod 700 %[1]s && (mountpoint -q %[1]s || mount -t tmpfs -o mode=0700,size=1m tmpfs %[1]s)", guestEnvDir)
+	if err := c.client.ExecuteCommand(mountTmpfs); err != nil {
+		return fmt.Errorf("failed to create environment directory: %w", err)
+	}
+
+	var script strings.Builder
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		fmt.Fprintf(&script, "export %s=%s\n", name, ssh.Quote(value))
+	}
+
+	client, err := c.client.SFTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := writeGuestFile(client, guestEnvFile, script.String(), 0o600); err != nil {
+		return fmt.Errorf("failed to write environment: %w", err)
+	}
+	profile := fmt.Sprintf("[ -r %[1]s ] && . %[1]s\n", guestEnvFile)
+	if err := writeGuestFile(client, guestEnvProfile, profile, 0o644); err != nil {
+		return fmt.Errorf("failed to write environment profile script: %w", err)
+	}
+
+	c.sourceEnv = true
+	return nil
+}
+
+// withEnv prefixes cmd so that it reads the environment file
+func (c *SSHClient) withEnv(cmd string) string {
+	if !c.sourceEnv {
+		return cmd
+	}
+	return fmt.Sprintf("[ -r %[1]s ] && . %[1]s; %s", guestEnvFile, cmd)
+}
+
+// writeGuestFile writes a file in the guest with the given mode
+func writeGuestFile(client *sftp.Client, path, content string, mode os.FileMode) error {
+	f, err := client.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
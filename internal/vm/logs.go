@@ -0,0 +1,171 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/console"
+	"github.com/sirupsen/logrus"
+)
+
+// Log files in the runtime directory of a VM
+const (
+	logFile       = "firecracker.log"
+	consoleFile   = "console.log"
+	consoleSocket = "console.sock"
+)
+
+// logTailLines is the number of log lines added to boot errors
+const logTailLines = 15
+
+// LogLevels are the Firecracker log levels a profile can select
+var LogLevels = []string{"Error", "Warning", "Info", "Debug", "Trace", "Off"}
+
+// LogLevel returns the Firecracker log level of a profile in the spelling
+// Firecracker expects, or an error if it is not one of LogLevels
+func LogLevel(profile config.Profile) (string, error) {
+	level := profile.VM.LogLevel
+	if level == "" {
+		return "Info", nil
+	}
+	for _, l := range LogLevels {
+		if strings.EqualFold(level, l) {
+			return l, nil
+		}
+	}
+	return "", fmt.Errorf("unknown log level '%s' (supported: %s)", level, strings.Join(LogLevels, ", "))
+}
+
+// LogPath returns the Firecracker log of the VM
+func (v *VM) LogPath() string {
+	return filepath.Join(vmDir(v.id), logFile)
+}
+
+// ConsolePath returns the log of the guest serial console. It only exists
+// for VMs whose Firecracker process was started by sear.
+func (v *VM) ConsolePath() string {
+	return filepath.Join(vmDir(v.id), consoleFile)
+}
+
+// ConsoleSocket returns the socket serving the serial console of the VM,
+// see console.Attach. Like the console log, it only exists for VMs whose
+// Firecracker process was started by sear.
+func (v *VM) ConsoleSocket() string {
+	return filepath.Join(vmDir(v.id), consoleSocket)
+}
+
+// captureConsole relays the serial console of the Firecracker process to
+// the console log and socket. The output of the process is drained even if
+// that fails, or the guest would stall.
+func (v *VM) captureConsole() {
+	output, input := v.fcProcess.Output(), v.fcProcess.Input()
+
+	logFile, err := os.OpenFile(v.ConsolePath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		logrus.Warnf("Failed to create console log: %v", err)
+		go func() {
+			defer output.Close()
+			_, _ = io.Copy(io.Discard, output)
+		}()
+		return
+	}
+
+	relay, err := console.Serve(v.ConsoleSocket(), output, input, logFile)
+	if err != nil {
+		logrus.Warnf("Failed to serve the serial console: %v", err)
+		go func() {
+			defer output.Close()
+			defer logFile.Close()
+			_, _ = io.Copy(logFile, output)
+		}()
+		return
+	}
+	v.console = relay
+}
+
+// configureLogger makes Firecracker log into the runtime directory of the
+// VM at the level of the profile
+func (v *VM) configureLogger() error {
+	level, err := LogLevel(v.profile)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(vmDir(v.id), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(v.LogPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return v.fcClient.ConfigureLogger(v.LogPath(), level)
+}
+
+// WithLogs adds the last lines of the Firecracker log and the serial
+// console to an error about the VM failing to boot
+func (v *VM) WithLogs(err error) error {
+	var b strings.Builder
+	for _, log := range []struct{ name, path string }{
+		{"Firecracker log", v.LogPath()},
+		{"serial console", v.ConsolePath()},
+	} {
+		lines, tailErr := tailFile(log.path, logTailLines)
+		if tailErr != nil || len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n--- last lines of the %s (%s) ---\n%s", log.name, log.path, strings.Join(lines, "\n"))
+	}
+
+	if b.Len() == 0 {
+		return err
+	}
+	return fmt.Errorf("%w%s", err, b.String())
+}
+
+// tailFile returns up to n last lines of a file
+func tailFile(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	const maxTail = 64 * 1024
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - maxTail
+	if offset < 0 {
+		offset = 0
+	}
+
+	data, err := io.ReadAll(io.NewSectionReader(f, offset, info.Size()-offset))
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimRight(data, "\r\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	lines := strings.Split(string(data), "\n")
+	if offset > 0 && len(lines) > 1 {
+		// The first line is likely cut off
+		lines = lines[1:]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+	return lines, nil
+}
@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"os"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/redact"
+	"github.com/sirupsen/logrus"
+)
+
+// MMDSAddress is where guests reach the metadata service
+const MMDSAddress = "169.254.169.254"
+
+// Metadata is the document the metadata service serves to the guest
+// under /sear
+type Metadata struct {
+	VMID      string                 `json:"vm_id"`
+	Profile   string                 `json:"profile"`
+	Network   *MetadataNetwork       `json:"network,omitempty"`
+	Workspace []MetadataMount        `json:"workspace,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Secrets   map[string]string      `json:"secrets,omitempty"`
+}
+
+// MetadataNetwork describes the guest network
+type MetadataNetwork struct {
+	GuestIP   string `json:"guest_ip"`
+	GatewayIP string `json:"gateway_ip"`
+	DNSServer string `json:"dns_server"`
+}
+
+// MetadataMount describes a host directory shared with the guest
+type MetadataMount struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	Mode     string `json:"mode"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+}
+
+// metadata builds the metadata document of the VM
+func (v *VM) metadata() map[string]interface{} {
+	md := Metadata{
+		VMID:     v.id,
+		Profile:  v.profile.Name,
+		Metadata: v.profile.Metadata,
+	}
+
+	if n := v.Network(); n.Mode != config.NetworkModeNone {
+		md.Network = &MetadataNetwork{
+			GuestIP:   n.GuestIP,
+			GatewayIP: n.GatewayIP,
+			DNSServer: n.DNSServer,
+		}
+	}
+
+	for _, mc := range v.mounts {
+		md.Workspace = append(md.Workspace, MetadataMount{
+			Source:   mc.Source,
+			Target:   mc.Target,
+			Mode:     v.workspaceMode(mc),
+			ReadOnly: mc.ReadOnly,
+		})
+	}
+
+	if m := v.profile.MMDS; m != nil {
+		for _, name := range m.Secrets {
+			value, ok := v.secret(name)
+			if !ok {
+				value, ok = os.LookupEnv(name)
+			}
+			if !ok {
+				logrus.Warnf("Secret %s is neither a secret of the profile nor set in the environment, not publishing it", name)
+				continue
+			}
+			redact.Add(value)
+			if md.Secrets == nil {
+				md.Secrets = make(map[string]string)
+			}
+			md.Secrets[name] = value
+		}
+	}
+
+	return map[string]interface{}{"sear": md}
+}
+
+// configureMMDS enables the metadata service on the network interface of
+// a VM that is about to boot and publishes its document
+func (v *VM) configureMMDS() error {
+	if v.netManager == nil {
+		logrus.Debug("No metadata service without a network device")
+		return nil
+	}
+
+	if err := v.fcClient.ConfigureMMDS("net1"); err != nil {
+		return err
+	}
+	return v.publishMetadata()
+}
+
+// publishMetadata replaces the document of the metadata service, for
+// example once the mounts of a VM are known
+func (v *VM) publishMetadata() error {
+	if !hasNetwork(v.profile) {
+		return nil
+	}
+
+	fcClient, err := v.client()
+	if err != nil {
+		return err
+	}
+	return fcClient.PutMMDS(v.metadata())
+}
@@ -0,0 +1,429 @@
+package vm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/firecracker"
+	"github.com/sirupsen/logrus"
+)
+
+// poolRetryDelay is how long the pool waits after a VM failed to boot
+const poolRetryDelay = 30 * time.Second
+
+// poolRequest asks the pool daemon for an idle VM of a profile
+type poolRequest struct {
+	Profile     string `json:"profile"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// poolResponse names the VM handed out, or why there is none
+type poolResponse struct {
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// poolSocket returns the path of the socket the pool daemon listens on
+func poolSocket() string {
+	return filepath.Join(RuntimeDir(), "pool.sock")
+}
+
+// poolFingerprint identifies what a pooled VM of the profile was booted
+// and provisioned from: the snapshot key and the resolved profile itself
+func poolFingerprint(profile config.Profile) (string, error) {
+	key, err := SnapshotKey(profile)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode profile: %w", err)
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", key)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// Claim takes an idle, provisioned VM of the profile from the warm pool.
+// The VM stays owned by the pool daemon, which destroys it once the
+// returned VM is stopped or this process exits. It fails if no daemon is
+// running, it has no idle VM of the profile or its VMs were set up from a
+// different version of the profile.
+func Claim(profile config.Profile) (*VM, error) {
+	fingerprint, err := poolFingerprint(profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fingerprint profile: %w", err)
+	}
+
+	conn, err := net.DialTimeout("unix", poolSocket(), time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("pool daemon is not running: %w", err)
+	}
+
+	req := poolRequest{Profile: profile.Name, Fingerprint: fingerprint}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send pool request: %w", err)
+	}
+
+	var resp poolResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read pool response: %w", err)
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return nil, errors.New(resp.Error)
+	}
+
+	v, err := Open(resp.ID)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The state file has no secret values; the fingerprint matched, so
+	// the caller's profile is the one the VM was set up from
+	v.profile = profile
+	v.poolConn = conn
+
+	return v, nil
+}
+
+// Pool keeps idle, provisioned VMs of profiles ready to be claimed and
+// boots replacements in the background as they are handed out
+type Pool struct {
+	profiles  map[string]config.Profile
+	ssh       *config.SSHConfig
+	provision func(*VM) error
+
+	mu      sync.Mutex
+	idle    map[string][]*VM
+	claimed map[*VM]struct{}
+	wake    map[string]chan struct{}
+	// fingerprints holds the profile fingerprint each idle VM was booted
+	// with
+	fingerprints map[*VM]string
+}
+
+// NewPool creates a pool for profiles with a pool size, whose VMs use the
+// SSH configuration ssh. provision is called on every freshly started VM
+// before it is considered ready.
+func NewPool(profiles []config.Profile, ssh *config.SSHConfig, provision func(*VM) error) *Pool {
+	p := &Pool{
+		profiles:  make(map[string]config.Profile),
+		ssh:       ssh,
+		provision: provision,
+		idle:      make(map[string][]*VM),
+		claimed:   make(map[*VM]struct{}),
+		wake:      make(map[string]chan struct{}),
+
+		fingerprints: make(map[*VM]string),
+	}
+	for _, profile := range profiles {
+		p.profiles[profile.Name] = profile
+		p.wake[profile.Name] = make(chan struct{}, 1)
+	}
+	return p
+}
+
+// Serve fills the pool and hands out VMs until ctx is done. All VMs of the
+// pool, including those in use, are stopped before it returns.
+func (p *Pool) Serve(ctx context.Context) error {
+	if os.Getenv("FIRECRACKER_API_SOCKET") != "" {
+		return errors.New("the warm pool starts a Firecracker process per VM, unset FIRECRACKER_API_SOCKET")
+	}
+	if _, err := firecracker.Binary(); err != nil {
+		return fmt.Errorf("the warm pool needs the firecracker binary in PATH or $SEAR_FIRECRACKER: %w", err)
+	}
+
+	ln, err := listenPool()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(poolSocket())
+
+	var wg sync.WaitGroup
+	for name := range p.profiles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.fill(ctx, name)
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	logrus.Infof("Pool daemon listening on %s", poolSocket())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logrus.Warnf("Failed to accept pool connection: %v", err)
+			continue
+		}
+		go p.handle(conn)
+	}
+
+	logrus.Info("Waiting for VMs being booted...")
+	wg.Wait()
+	p.stopAll()
+	return nil
+}
+
+// listenPool creates the pool socket, refusing to replace the socket of a
+// running daemon
+func listenPool() (net.Listener, error) {
+	socket := poolSocket()
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return nil, errors.New("a pool daemon is already running")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(socket), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+	_ = os.Remove(socket)
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", socket, err)
+	}
+	if err := os.Chmod(socket, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// handle serves a claim. The client keeps the connection open while it
+// uses the VM; the VM is destroyed when the connection closes.
+func (p *Pool) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var req poolRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		logrus.Debugf("Invalid pool request: %v", err)
+		return
+	}
+
+	v, err := p.claim(req.Profile, req.Fingerprint)
+	if err != nil {
+		_ = json.NewEncoder(conn).Encode(poolResponse{Error: err.Error()})
+		return
+	}
+	defer p.release(v)
+
+	if err := json.NewEncoder(conn).Encode(poolResponse{ID: v.id}); err != nil {
+		logrus.Debugf("Failed to hand out VM %s: %v", v.id, err)
+		return
+	}
+	logrus.Infof("Handed out VM %s of profile %s", v.id, req.Profile)
+
+	_, _ = io.Copy(io.Discard, conn)
+	logrus.Infof("VM %s was released", v.id)
+}
+
+// claim takes an idle VM of a profile out of the pool and wakes the filler
+// to replace it. Idle VMs booted from an older version of the profile are
+// drained; the claim is refused if the client's profile differs from the
+// daemon's.
+func (p *Pool) claim(profile, fingerprint string) (*VM, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pooled, ok := p.profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("profile '%s' is not pooled", profile)
+	}
+
+	current, err := poolFingerprint(pooled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fingerprint profile '%s': %w", profile, err)
+	}
+
+	for len(p.idle[profile]) > 0 {
+		v := p.idle[profile][0]
+		p.idle[profile] = p.idle[profile][1:]
+		booted := p.fingerprints[v]
+		delete(p.fingerprints, v)
+		p.refill(profile)
+
+		if v.fcProcess.Exited() {
+			logrus.Warnf("Idle VM %s of profile %s died, discarding it", v.id, profile)
+			go v.Stop()
+			continue
+		}
+		if booted != current {
+			logrus.Infof("Idle VM %s of profile %s is out of date, discarding it", v.id, profile)
+			go v.Stop()
+			continue
+		}
+		if booted != fingerprint {
+			// Keep it for clients with the daemon's version of the profile
+			p.idle[profile] = append([]*VM{v}, p.idle[profile]...)
+			p.fingerprints[v] = booted
+			return nil, fmt.Errorf("pooled VMs of profile '%s' were set up from a different configuration, restart the pool daemon", profile)
+		}
+
+		if err := setStatus(v.id, StatusRunning); err != nil {
+			logrus.Debugf("Failed to update state of VM %s: %v", v.id, err)
+		}
+		p.claimed[v] = struct{}{}
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("no idle VM of profile '%s'", profile)
+}
+
+// release destroys a VM that is no longer used
+func (p *Pool) release(v *VM) {
+	p.mu.Lock()
+	_, ok := p.claimed[v]
+	delete(p.claimed, v)
+	p.mu.Unlock()
+
+	// VMs are no longer tracked once the pool shut down
+	if ok {
+		v.Stop()
+	}
+}
+
+// refill wakes the filler of a profile; callers hold p.mu
+func (p *Pool) refill(profile string) {
+	select {
+	case p.wake[profile] <- struct{}{}:
+	default:
+	}
+}
+
+// fill keeps the number of idle VMs of a profile at its pool size,
+// booting one VM at a time
+func (p *Pool) fill(ctx context.Context, name string) {
+	profile := p.profiles[name]
+
+	for {
+		p.mu.Lock()
+		missing := profile.Pool.Size - len(p.idle[name])
+		p.mu.Unlock()
+
+		if missing <= 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.wake[name]:
+			}
+			continue
+		}
+
+		start := time.Now()
+		fingerprint, err := poolFingerprint(profile)
+		if err != nil {
+			logrus.Errorf("Failed to fingerprint profile %s: %v", name, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(poolRetryDelay):
+			}
+			continue
+		}
+
+		v, err := p.boot(profile)
+		if err != nil {
+			logrus.Errorf("Failed to boot VM for the pool of %s: %v", name, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(poolRetryDelay):
+			}
+			continue
+		}
+
+		p.mu.Lock()
+		p.idle[name] = append(p.idle[name], v)
+		p.fingerprints[v] = fingerprint
+		idle := len(p.idle[name])
+		p.mu.Unlock()
+
+		logrus.Infof("VM %s of profile %s is ready in %s (%d/%d idle)", v.id, name, time.Since(start).Round(time.Millisecond), idle, profile.Pool.Size)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// boot starts and provisions a VM for the pool
+func (p *Pool) boot(profile config.Profile) (*VM, error) {
+	v, err := NewVM(profile)
+	if err != nil {
+		return nil, err
+	}
+	v.SetSSH(p.ssh)
+	v.SetSnapshots(true)
+
+	if err := v.Start(); err != nil {
+		v.Stop()
+		return nil, err
+	}
+	if v.fcProcess == nil {
+		v.Stop()
+		return nil, errors.New("firecracker was not started for the VM")
+	}
+
+	if err := p.provision(v); err != nil {
+		v.Stop()
+		return nil, err
+	}
+
+	// Clients open their own connections
+	if v.sshClient != nil {
+		v.sshClient.Close()
+		v.sshClient = nil
+	}
+
+	if err := setStatus(v.id, StatusIdle); err != nil {
+		logrus.Warnf("Failed to update state of VM %s: %v", v.id, err)
+	}
+
+	return v, nil
+}
+
+// stopAll stops the idle and claimed VMs of the pool
+func (p *Pool) stopAll() {
+	p.mu.Lock()
+	var vms []*VM
+	for _, idle := range p.idle {
+		vms = append(vms, idle...)
+	}
+	for v := range p.claimed {
+		vms = append(vms, v)
+	}
+	p.idle = make(map[string][]*VM)
+	p.claimed = make(map[*VM]struct{})
+	p.fingerprints = make(map[*VM]string)
+	p.mu.Unlock()
+
+	for _, v := range vms {
+		if err := v.Stop(); err != nil {
+			logrus.Warnf("Failed to stop VM %s: %v", v.id, err)
+		}
+	}
+}
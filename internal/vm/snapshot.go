@@ -0,0 +1,496 @@
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/fsutil"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Files of a profile snapshot directory. The snapshot itself lives in a
+// subdirectory that is replaced atomically; the lock and the rootfs alias
+// are shared by every snapshot of the profile.
+const (
+	snapshotCurrent = "current"
+	snapshotLock    = "lock"
+	snapshotAlias   = "rootfs.link"
+	snapshotMeta    = "snapshot.json"
+	snapshotState   = "vmstate"
+	snapshotMemory  = "memory"
+	snapshotDisk    = "rootfs.img"
+	snapshotSSHKey  = sshKeyFile
+)
+
+// Snapshot is a saved, fully provisioned VM. Later runs of the same
+// profile restore it instead of booting and running the tools again.
+type Snapshot struct {
+	Profile   string    `json:"profile"`
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+	Kernel    string    `json:"kernel"`
+	RootFS    string    `json:"rootfs"`
+	Tools     []string  `json:"tools,omitempty"`
+	// Slot is the allocated network slot the guest was configured for, or
+	// -1 if the profile configures its network
+	Slot int `json:"network_slot"`
+
+	dir string
+}
+
+// path returns the path of a file of the snapshot
+func (s *Snapshot) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// has reports whether the snapshot contains a file
+func (s *Snapshot) has(name string) bool {
+	_, err := os.Stat(s.path(name))
+	return err == nil
+}
+
+// Size returns the disk space used by the snapshot
+func (s *Snapshot) Size() int64 {
+	var size int64
+	for _, name := range []string{snapshotMeta, snapshotState, snapshotMemory, snapshotDisk, snapshotSSHKey} {
+		info, err := os.Stat(s.path(name))
+		if err != nil {
+			continue
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			size += st.Blocks * 512
+		} else {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// SnapshotDir returns the directory holding the snapshots of all profiles
+func SnapshotDir() (string, error) {
+	if dir := os.Getenv("SEAR_SNAPSHOT_DIR"); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate cache directory: %w", err)
+	}
+	return filepath.Join(base, "sear", "snapshots"), nil
+}
+
+// profileSnapshotDir returns the snapshot directory of a profile
+func profileSnapshotDir(profile string) (string, error) {
+	root, err := SnapshotDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, profile), nil
+}
+
+// SnapshotKey identifies the state a snapshot of the profile was taken
+// from: the kernel and rootfs images, the agent, the tools, the machine and the
+// guest network configuration. A snapshot is only restored if its key
+// matches the current one. Allocated networks are not part of the key;
+// restores lease the slot recorded in the snapshot instead.
+func SnapshotKey(profile config.Profile) (string, error) {
+	h := sha256.New()
+	network := effectiveNetworkConfig(profile)
+
+	for _, p := range []string{profile.VM.Kernel, profile.VM.RootFS} {
+		path, err := config.ExpandPath(p)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "file %s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+
+	if profile.VM.Agent {
+		bin, err := AgentBinary()
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(bin)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "agent %d %d\n", info.Size(), info.ModTime().UnixNano())
+	}
+
+	fmt.Fprintf(h, "vcpus %d\nmemory %d\nargs %s\n", profile.VM.VCPUs, profile.VM.MemoryMiB, profile.VM.KernelArgs)
+	if b := profile.VM.Balloon; b != nil {
+		fmt.Fprintf(h, "balloon %d %t %d\n", b.TargetMiB, b.DeflateOnOOM, balloonStatsInterval(b))
+	}
+	if v := vsockConfig(profile); v != nil {
+		cid, port := vsockPorts(v)
+		fmt.Fprintf(h, "vsock %d %d\n", cid, port)
+	}
+	if !hasNetwork(profile) {
+		fmt.Fprintf(h, "network none\n")
+	} else if hasStaticNetwork(profile) {
+		fmt.Fprintf(h, "network %s %s %s %s\n", network.TAPDevice, network.GuestIP, network.GatewayIP, network.DNSServer)
+	} else {
+		fmt.Fprintf(h, "network allocated %s\n", network.DNSServer)
+	}
+	if hasNetwork(profile) {
+		// The metadata service configuration is part of the snapshot
+		fmt.Fprintf(h, "mmds\n")
+	}
+	for _, tool := range profile.Tools {
+		fmt.Fprintf(h, "tool %s\n", tool)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// LoadSnapshot returns the snapshot saved for a profile
+func LoadSnapshot(profile string) (*Snapshot, error) {
+	dir, err := profileSnapshotDir(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	current := filepath.Join(dir, snapshotCurrent)
+	data, err := os.ReadFile(filepath.Join(current, snapshotMeta))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no snapshot of profile '%s'", profile)
+		}
+		return nil, err
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid snapshot of profile '%s': %w", profile, err)
+	}
+	s.dir = current
+	return &s, nil
+}
+
+// ListSnapshots returns the saved snapshots, sorted by profile
+func ListSnapshots() ([]*Snapshot, error) {
+	root, err := SnapshotDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var snapshots []*Snapshot
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		s, err := LoadSnapshot(entry.Name())
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Profile < snapshots[j].Profile
+	})
+	return snapshots, nil
+}
+
+// RemoveSnapshot deletes the snapshot of a profile. VMs restored from it
+// keep running.
+func RemoveSnapshot(profile string) error {
+	dir, err := profileSnapshotDir(profile)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotCurrent)); err != nil {
+		return fmt.Errorf("no snapshot of profile '%s'", profile)
+	}
+
+	unlock, err := lockSnapshotDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return os.RemoveAll(filepath.Join(dir, snapshotCurrent))
+}
+
+// lockSnapshotDir takes the exclusive lock of a profile snapshot
+// directory, creating it if needed
+func lockSnapshotDir(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, snapshotLock), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock snapshot directory: %w", err)
+	}
+
+	return func() { f.Close() }, nil
+}
+
+// pointAlias atomically points the rootfs alias of a snapshot directory
+// at target.
+//
+// Firecracker records drive paths in the snapshot and opens them again on
+// restore. VMs that may be snapshotted attach their rootfs through this
+// stable alias, and restores point it at their own copy of the snapshot
+// disk while loading. Callers must hold the directory lock.
+func pointAlias(dir, target string) (string, error) {
+	alias := filepath.Join(dir, snapshotAlias)
+	tmp := alias + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, alias); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return alias, nil
+}
+
+// SetSnapshots enables restoring the VM from a snapshot of its profile,
+// or saving one with SaveSnapshot once it is provisioned. It must be
+// called before Start.
+func (v *VM) SetSnapshots(enabled bool) {
+	v.snapshots = enabled
+}
+
+// Restored reports whether the VM was restored from a snapshot, in which
+// case it is already provisioned
+func (v *VM) Restored() bool {
+	return v.restore != nil
+}
+
+// selectSnapshot decides whether Start restores a snapshot or boots a VM
+// that can be snapshotted later
+func (v *VM) selectSnapshot() {
+	switch {
+	case !v.snapshots:
+		return
+	case v.persist:
+		logrus.Debug("Snapshots are not used with --persist")
+		return
+	case len(v.drives) > 0:
+		logrus.Info("Snapshots are not used when extra drives are attached")
+		return
+	case vsockConfig(v.profile) != nil && firecrackerBinary() == "":
+		// The vsock socket path in the snapshot is absolute then
+		logrus.Info("Snapshots of VMs with a vsock device need Firecracker started by sear")
+		return
+	case len(v.profile.Secrets) > 0:
+		// The memory of the guest would hold them
+		logrus.Info("Snapshots are not used for profiles with secrets")
+		return
+	}
+
+	key, err := SnapshotKey(v.profile)
+	if err != nil {
+		logrus.Warnf("Snapshots disabled: %v", err)
+		return
+	}
+
+	snap, err := LoadSnapshot(v.profile.Name)
+	switch {
+	case err != nil:
+		logrus.Debugf("No usable snapshot: %v", err)
+	case snap.Key != key:
+		logrus.Infof("Profile %s changed since its snapshot was taken, discarding it", v.profile.Name)
+		if err := RemoveSnapshot(v.profile.Name); err != nil {
+			logrus.Warnf("Failed to remove stale snapshot: %v", err)
+		}
+	case v.generatesSSHKey() && !snap.has(snapshotSSHKey):
+		// The guest would not know the key generated for this VM
+		logrus.Infof("Snapshot of profile %s has no SSH key, discarding it", v.profile.Name)
+		if err := RemoveSnapshot(v.profile.Name); err != nil {
+			logrus.Warnf("Failed to remove stale snapshot: %v", err)
+		}
+	default:
+		v.restore = snap
+		return
+	}
+
+	v.snapshotKey = key
+}
+
+// attachSnapshotRootfs attaches the rootfs of a VM that may be
+// snapshotted through the alias of its profile snapshot directory
+func (v *VM) attachSnapshotRootfs(rootfs string) error {
+	dir, err := profileSnapshotDir(v.profile.Name)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockSnapshotDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	alias, err := pointAlias(dir, rootfs)
+	if err != nil {
+		return fmt.Errorf("failed to create rootfs alias: %w", err)
+	}
+
+	return v.fcClient.AttachRootfs("rootfs", alias, true, false)
+}
+
+// restoreSnapshot loads the selected snapshot into the fresh Firecracker
+// process and resumes it. rootfs is this VM's copy of the snapshot disk.
+func (v *VM) restoreSnapshot(rootfs string) error {
+	start := time.Now()
+	dir := filepath.Dir(v.restore.dir)
+
+	if v.generatesSSHKey() {
+		if err := v.restoreSSHKey(v.restore); err != nil {
+			return err
+		}
+	}
+
+	unlock, err := lockSnapshotDir(dir)
+	if err != nil {
+		return err
+	}
+
+	if _, err := pointAlias(dir, rootfs); err != nil {
+		unlock()
+		return fmt.Errorf("failed to create rootfs alias: %w", err)
+	}
+
+	err = v.fcClient.LoadSnapshot(v.restore.path(snapshotState), v.restore.path(snapshotMemory), false)
+	unlock()
+	if err != nil {
+		// A snapshot Firecracker rejects once is useless; drop it so that
+		// the next run boots from scratch
+		if rmErr := RemoveSnapshot(v.profile.Name); rmErr != nil {
+			logrus.Debugf("Failed to remove snapshot: %v", rmErr)
+		}
+		return fmt.Errorf("failed to restore snapshot (it was removed, the next run boots normally): %w", err)
+	}
+
+	// The metadata document is not part of the snapshot
+	if err := v.publishMetadata(); err != nil {
+		return fmt.Errorf("failed to publish metadata: %w", err)
+	}
+
+	if err := v.fcClient.ResumeVM(); err != nil {
+		return fmt.Errorf("failed to resume restored VM: %w", err)
+	}
+
+	logrus.Infof("Restored snapshot of profile %s in %s", v.profile.Name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// SaveSnapshot snapshots a freshly provisioned VM so that later runs of
+// its profile restore it instead of booting. It does nothing unless the
+// VM was booted with snapshots enabled and no usable snapshot existed.
+// The VM is paused while its memory and disk are saved.
+func (v *VM) SaveSnapshot() error {
+	if v.snapshotKey == "" {
+		return nil
+	}
+	key := v.snapshotKey
+	v.snapshotKey = ""
+
+	dir, err := profileSnapshotDir(v.profile.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	tmp, err := os.MkdirTemp(dir, "new-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// Drop the SSH connection so that restored guests do not carry a
+	// session nobody will ever use; it is re-established on demand
+	if v.sshClient != nil {
+		v.sshClient.Close()
+	}
+
+	start := time.Now()
+	logrus.Infof("Saving snapshot of profile %s...", v.profile.Name)
+
+	if err := v.fcClient.PauseVM(); err != nil {
+		return fmt.Errorf("failed to pause VM: %w", err)
+	}
+	err = v.fcClient.CreateSnapshot(filepath.Join(tmp, snapshotState), filepath.Join(tmp, snapshotMemory))
+	if err == nil {
+		_, err = fsutil.CloneFile(v.rootfsPath, filepath.Join(tmp, snapshotDisk))
+	}
+	if err == nil && v.generatesSSHKey() {
+		// Restored guests accept the key of this VM only
+		_, err = fsutil.CloneFile(filepath.Join(vmDir(v.id), sshKeyFile), filepath.Join(tmp, snapshotSSHKey))
+	}
+	if resumeErr := v.fcClient.ResumeVM(); resumeErr != nil {
+		return fmt.Errorf("failed to resume VM after snapshot: %w", resumeErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+
+	meta := Snapshot{
+		Profile:   v.profile.Name,
+		Key:       key,
+		CreatedAt: time.Now(),
+		Kernel:    v.profile.VM.Kernel,
+		RootFS:    v.profile.VM.RootFS,
+		Tools:     v.profile.Tools,
+		Slot:      -1,
+	}
+	if v.lease != nil {
+		meta.Slot = v.lease.Slot
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, snapshotMeta), data, 0o600); err != nil {
+		return err
+	}
+
+	unlock, err := lockSnapshotDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current := filepath.Join(dir, snapshotCurrent)
+	if err := os.RemoveAll(current); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, current); err != nil {
+		return err
+	}
+
+	logrus.Infof("Saved snapshot of profile %s in %s", v.profile.Name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,76 @@
+package vm
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/fsutil"
+	"github.com/nikiskaarup/sear/internal/ssh"
+)
+
+// sshKeyFile is the private key sear generates for a VM, kept in its
+// runtime directory and in snapshots taken of it
+const sshKeyFile = "ssh_key"
+
+// sshKeyArg is the kernel command line parameter that carries the public
+// key of the generated key pair to the guest
+const sshKeyArg = "sear.ssh_key"
+
+// SetSSH sets the SSH key and user configured for sear. Without a key,
+// sear generates one for the VM.
+func (v *VM) SetSSH(cfg *config.SSHConfig) {
+	v.ssh = cfg
+}
+
+// generatesSSHKey reports whether sear generates the SSH key of the VM
+func (v *VM) generatesSSHKey() bool {
+	return !v.profile.VM.Agent && (v.ssh == nil || v.ssh.KeyPath == "")
+}
+
+// sshKeyPath returns the private key sear authenticates with
+func (v *VM) sshKeyPath() (string, error) {
+	if v.ssh != nil && v.ssh.KeyPath != "" {
+		return config.ExpandPath(v.ssh.KeyPath)
+	}
+	return filepath.Join(vmDir(v.id), sshKeyFile), nil
+}
+
+// sshUser returns the user sear logs in as
+func (v *VM) sshUser() string {
+	if v.ssh != nil && v.ssh.Username != "" {
+		return v.ssh.Username
+	}
+	return "root"
+}
+
+// generateSSHKey creates the key pair of a freshly booted VM and returns
+// the kernel parameter that hands its public key to the guest
+func (v *VM) generateSSHKey() (string, error) {
+	dir := vmDir(v.id)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+
+	pub, err := ssh.GenerateKey(filepath.Join(dir, sshKeyFile), "sear-"+v.id)
+	if err != nil {
+		return "", err
+	}
+	return sshKeyArg + "=" + base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// restoreSSHKey takes over the key pair of the VM a snapshot was taken
+// from; the restored guest only knows its public key
+func (v *VM) restoreSSHKey(snap *Snapshot) error {
+	dir := vmDir(v.id)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+
+	if _, err := fsutil.CloneFile(snap.path(sshKeyFile), filepath.Join(dir, sshKeyFile)); err != nil {
+		return fmt.Errorf("failed to copy SSH key of snapshot: %w", err)
+	}
+	return nil
+}
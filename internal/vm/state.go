@@ -0,0 +1,202 @@
+package vm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// VM status values recorded in the state file
+const (
+	StatusRunning = "running"
+	// StatusIdle marks a provisioned VM waiting in the warm pool
+	StatusIdle = "idle"
+	// StatusPaused marks a VM whose vCPUs are paused
+	StatusPaused = "paused"
+)
+
+// stateFile is the name of the state file inside a VM runtime directory
+const stateFile = "state.json"
+
+// State is the on-disk record of a running VM. It allows sear commands
+// other than the one that started the VM to find and operate on it.
+type State struct {
+	ID         string                `json:"id"`
+	Profile    config.Profile        `json:"profile"`
+	PID        int                   `json:"pid"`
+	SocketPath string                `json:"socket_path"`
+	Network    *config.NetworkConfig `json:"network,omitempty"`
+	SSH        *config.SSHConfig     `json:"ssh,omitempty"`
+	Status     string                `json:"status"`
+	CreatedAt  time.Time             `json:"created_at"`
+}
+
+// RuntimeDir returns the directory holding the state of running VMs
+func RuntimeDir() string {
+	if dir := os.Getenv("SEAR_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	if os.Getuid() == 0 {
+		return "/run/sear"
+	}
+	if xdg := os.Getenv("XDG_RUNTIME_DIR"); xdg != "" {
+		return filepath.Join(xdg, "sear")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("sear-%d", os.Getuid()))
+}
+
+// vmDir returns the runtime directory of the VM with the given ID
+func vmDir(id string) string {
+	return filepath.Join(RuntimeDir(), "vms", id)
+}
+
+// DiskDir returns the directory holding the private rootfs copies of
+// running VMs. It is kept on disk next to the snapshots rather than in the
+// runtime directory, which is usually a tmpfs: copies there would take
+// memory and could never share extents with the base image.
+func DiskDir() (string, error) {
+	if dir := os.Getenv("SEAR_DISK_DIR"); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate cache directory: %w", err)
+	}
+	return filepath.Join(base, "sear", "disks"), nil
+}
+
+// newID generates a short random VM identifier
+func newID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+// saveState atomically writes the state file of a VM
+func saveState(s *State) error {
+	dir := vmDir(s.ID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+
+	// Literal secret values stay out of the file; other sear processes
+	// only need their names
+	stored := *s
+	stored.Profile.Secrets = make([]config.EnvVar, len(s.Profile.Secrets))
+	for i, secret := range s.Profile.Secrets {
+		secret.Value = ""
+		stored.Profile.Secrets[i] = secret
+	}
+
+	data, err := json.MarshalIndent(&stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode VM state: %w", err)
+	}
+
+	tmp := filepath.Join(dir, stateFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write VM state: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, stateFile)); err != nil {
+		return fmt.Errorf("failed to write VM state: %w", err)
+	}
+
+	return nil
+}
+
+// LoadState reads the state of the running VM with the given ID
+func LoadState(id string) (*State, error) {
+	data, err := os.ReadFile(filepath.Join(vmDir(id), stateFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no running VM with ID '%s'", id)
+		}
+		return nil, fmt.Errorf("failed to read VM state: %w", err)
+	}
+
+	var s State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse VM state: %w", err)
+	}
+
+	if !processAlive(s.PID) {
+		removeState(id)
+		return nil, fmt.Errorf("VM '%s' is no longer running", id)
+	}
+
+	return &s, nil
+}
+
+// setStatus records a new status in the state file of a VM
+func setStatus(id, status string) error {
+	s, err := LoadState(id)
+	if err != nil {
+		return err
+	}
+	s.Status = status
+	return saveState(s)
+}
+
+// ListStates returns the state of all running VMs, oldest first. Entries
+// left behind by sear processes that no longer exist are cleaned up.
+func ListStates() ([]*State, error) {
+	entries, err := os.ReadDir(filepath.Join(RuntimeDir(), "vms"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read runtime directory: %w", err)
+	}
+
+	states := make([]*State, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		s, err := LoadState(entry.Name())
+		if err != nil {
+			logrus.Debugf("Skipping VM %s: %v", entry.Name(), err)
+			continue
+		}
+		states = append(states, s)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].CreatedAt.Before(states[j].CreatedAt)
+	})
+
+	return states, nil
+}
+
+// removeState deletes the runtime directory and the rootfs copy of a VM
+func removeState(id string) {
+	if err := os.RemoveAll(vmDir(id)); err != nil {
+		logrus.Debugf("Failed to remove runtime directory of VM %s: %v", id, err)
+	}
+	if dir, err := DiskDir(); err == nil {
+		if err := os.RemoveAll(filepath.Join(dir, id)); err != nil {
+			logrus.Debugf("Failed to remove rootfs copy of VM %s: %v", id, err)
+		}
+	}
+}
+
+// processAlive reports whether a process with the given PID exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
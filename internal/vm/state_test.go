@@ -0,0 +1,50 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nikiskaarup/sear/internal/config"
+)
+
+func TestSaveStateOmitsSecretValues(t *testing.T) {
+	t.Setenv("SEAR_RUNTIME_DIR", t.TempDir())
+
+	profile := config.Profile{
+		Name: "dev",
+		Secrets: []config.EnvVar{
+			{Name: "TOKEN", Value: "hunter2-secret"},
+			{Name: "GH_TOKEN", Env: "GH_TOKEN"},
+		},
+	}
+	if err := saveState(&State{ID: "test", Profile: profile, PID: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(vmDir("test"), stateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2-secret") {
+		t.Errorf("state file holds a secret value:\n%s", data)
+	}
+	if profile.Secrets[0].Value != "hunter2-secret" {
+		t.Error("saveState changed the profile of the caller")
+	}
+
+	s, err := LoadState("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []config.EnvVar{{Name: "TOKEN"}, {Name: "GH_TOKEN", Env: "GH_TOKEN"}}
+	if len(s.Profile.Secrets) != len(want) {
+		t.Fatalf("secrets = %+v, want %+v", s.Profile.Secrets, want)
+	}
+	for i := range want {
+		if s.Profile.Secrets[i] != want[i] {
+			t.Errorf("secret %d = %+v, want %+v", i, s.Profile.Secrets[i], want[i])
+		}
+	}
+}
@@ -1,71 +1,585 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/nikiskaarup/sear/internal/agent"
 	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/console"
 	"github.com/nikiskaarup/sear/internal/firecracker"
+	"github.com/nikiskaarup/sear/internal/fsutil"
+	"github.com/nikiskaarup/sear/internal/metrics"
 	"github.com/nikiskaarup/sear/internal/network"
 	"github.com/nikiskaarup/sear/internal/ssh"
+	"github.com/nikiskaarup/sear/internal/workspace"
+	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 // VM represents a Firecracker microVM
 type VM struct {
-	profile     config.Profile
-	fcClient    *firecracker.Client
-	netManager  *network.Manager
-	sshClient   *SSHClient
-	userHomeDir string
+	id         string
+	profile    config.Profile
+	socketPath string
+	fcClient   *firecracker.Client
+	netManager *network.Manager
+	sshClient  *SSHClient
+	workspaces []workspace.Backend
+
+	// ssh is the SSH configuration of sear; the key of the VM is generated
+	// unless it names one
+	ssh *config.SSHConfig
+
+	// prepared holds backends set up before boot, keyed by host path,
+	// and drives the block devices they need attached
+	prepared map[string]workspace.Backend
+	drives   []workspace.Drive
+
+	// persist attaches the base rootfs image instead of a per-VM copy;
+	// rootfsLock is held on the base image while the VM uses it
+	persist    bool
+	rootfsLock *os.File
+	rootfsPath string
+
+	// snapshots enables snapshot support; restore is the snapshot Start
+	// restores, snapshotKey is set when SaveSnapshot should save one
+	snapshots   bool
+	restore     *Snapshot
+	snapshotKey string
+
+	// fcProcess is the Firecracker process started for the VM, nil if an
+	// externally started one is used
+	fcProcess *firecracker.Process
+	console   *console.Relay
+
+	// env is the environment of guest sessions once resolved, secrets the
+	// secret values in it by name
+	env     []string
+	secrets map[string]string
+
+	// mounts are the directories shared with the VM, published through
+	// the metadata service
+	mounts []config.MountConfig
+
+	// network is the network of the VM; lease is set if it was allocated
+	// because the profile does not configure one
+	network *config.NetworkConfig
+	lease   *network.Lease
+
+	// attached is set for VMs opened by ID that are owned by another
+	// sear process; Stop only releases local resources for them
+	attached bool
+
+	// poolConn is held while a VM claimed from the warm pool is in use;
+	// closing it makes the pool daemon destroy the VM
+	poolConn io.Closer
 }
 
-// SSHClient wraps the SSH client for VM interaction
+// SSHClient is the control channel of a VM: SSH, or sear-agent for
+// profiles with vm.agent set
 type SSHClient struct {
-	client *ssh.Client
+	client guestClient
+
+	// sourceEnv makes commands read the environment file SetEnv writes
+	// into guests controlled over SSH
+	sourceEnv bool
+}
+
+// guestClient is implemented by the SSH and the agent client
+type guestClient interface {
+	workspace.Guest
+	Shell() (*ssh.ExecResult, error)
+	Upload(localPath, remotePath string) error
+	Download(remotePath, localPath string) error
+	WaitReady(timeout time.Duration) error
+	Close() error
+}
+
+// networkConfigurer is implemented by clients that configure the guest
+// network without shell commands
+type networkConfigurer interface {
+	ConfigureNetwork(gateway, dnsServer string) error
 }
 
 // ExecuteCommand executes a command in the VM
 func (c *SSHClient) ExecuteCommand(cmd string) error {
-	return c.client.ExecuteCommand(cmd)
+	return c.client.ExecuteCommand(c.withEnv(cmd))
+}
+
+// Exec runs a command in the VM, streaming its output
+func (c *SSHClient) Exec(cmd string, opts ssh.ExecOptions) (*ssh.ExecResult, error) {
+	return c.client.Exec(c.withEnv(cmd), opts)
 }
 
-// Shell starts an interactive shell in the VM
-func (c *SSHClient) Shell() error {
+// Shell starts an interactive shell in the VM and waits for it to exit
+func (c *SSHClient) Shell() (*ssh.ExecResult, error) {
 	return c.client.Shell()
 }
 
+// agentForwarder is implemented by clients that can forward the host SSH
+// agent
+type agentForwarder interface {
+	SetForwardAgent(forward bool) error
+}
+
+// ForwardAgent forwards the host SSH agent into later shells and commands
+func (c *SSHClient) ForwardAgent() error {
+	f, ok := c.client.(agentForwarder)
+	if !ok {
+		return errors.New("SSH agent forwarding is not available with the guest agent")
+	}
+	return f.SetForwardAgent(true)
+}
+
+// SFTP opens an SFTP session to the VM
+func (c *SSHClient) SFTP() (*sftp.Client, error) {
+	return c.client.SFTP()
+}
+
+// Upload copies a host file or directory into the VM
+func (c *SSHClient) Upload(localPath, remotePath string) error {
+	return c.client.Upload(localPath, remotePath)
+}
+
+// Download copies a file or directory from the VM to the host
+func (c *SSHClient) Download(remotePath, localPath string) error {
+	return c.client.Download(remotePath, localPath)
+}
+
+// WaitReady waits until the guest accepts connections
+func (c *SSHClient) WaitReady(timeout time.Duration) error {
+	return c.client.WaitReady(timeout)
+}
+
+// Close releases the underlying SSH connection
+func (c *SSHClient) Close() error {
+	return c.client.Close()
+}
+
+// ConfigureNetwork points the guest at the DNS server and gateway of its
+// network
+func (c *SSHClient) ConfigureNetwork(network *config.NetworkConfig) error {
+	logrus.Info("Configuring guest networking...")
+
+	if nc, ok := c.client.(networkConfigurer); ok {
+		return nc.ConfigureNetwork(network.GatewayIP, network.DNSServer)
+	}
+
+	commands := []string{
+		// Setup DNS
+		fmt.Sprintf("echo 'nameserver %s' > /etc/resolv.conf", network.DNSServer),
+		// Setup default route
+		fmt.Sprintf("ip route add default via %s dev eth0 2>/dev/null || true", network.GatewayIP),
+	}
+
+	for _, cmd := range commands {
+		if err := c.client.ExecuteCommand(cmd); err != nil {
+			logrus.Warnf("Command failed: %s: %v", cmd, err)
+		}
+	}
+
+	return nil
+}
+
 // NewVM creates a new VM instance
 func NewVM(profile config.Profile) (*VM, error) {
-	userHome, _ := os.UserHomeDir()
+	return &VM{
+		id:      newID(),
+		profile: profile,
+	}, nil
+}
+
+// Open returns a handle to a VM that was started by another sear process
+func Open(id string) (*VM, error) {
+	state, err := LoadState(id)
+	if err != nil {
+		return nil, err
+	}
 
 	return &VM{
-		profile:     profile,
-		userHomeDir: userHome,
+		id:         state.ID,
+		profile:    state.Profile,
+		socketPath: state.SocketPath,
+		network:    state.Network,
+		ssh:        state.SSH,
+		attached:   true,
 	}, nil
 }
 
+// SetPersist makes the VM write to the base rootfs image of the profile
+// directly, keeping changes made in the guest. By default each VM boots
+// from its own copy that is discarded when the VM stops.
+func (v *VM) SetPersist(persist bool) {
+	v.persist = persist
+}
+
+// ID returns the identifier of the VM
+func (v *VM) ID() string {
+	return v.id
+}
+
+// Profile returns the profile the VM was started with
+func (v *VM) Profile() config.Profile {
+	return v.profile
+}
+
 // Start starts the VM
 func (v *VM) Start() error {
 	logrus.Info("Starting VM...")
 
-	// Get network configuration
-	networkConfig := v.getEffectiveNetworkConfig()
+	// Resolve secrets first, commands like 'pass show' may prompt
+	if _, err := v.Env(); err != nil {
+		return err
+	}
+
+	// Restore a provisioned snapshot of the profile if there is one
+	v.selectSnapshot()
 
 	// Setup network
+	if err := v.setupNetwork(); err != nil {
+		return err
+	}
+
+	if err := v.startFirecracker(); err != nil {
+		return err
+	}
+
+	// Configure logger
+	if err := v.configureLogger(); err != nil {
+		logrus.Warnf("Failed to configure logger: %v", err)
+	}
+	if err := v.configureMetrics(); err != nil {
+		logrus.Warnf("Failed to configure metrics: %v", err)
+	}
+
+	rootfs, err := v.prepareRootfs()
+	if err != nil {
+		return err
+	}
+	v.rootfsPath = rootfs
+
+	if v.restore != nil {
+		if err := v.restoreSnapshot(rootfs); err != nil {
+			return v.WithLogs(err)
+		}
+	} else if err := v.boot(rootfs); err != nil {
+		return v.WithLogs(err)
+	}
+
+	// Register the VM so that other sear commands can find it
+	if err := saveState(&State{
+		ID:         v.id,
+		Profile:    v.profile,
+		PID:        os.Getpid(),
+		SocketPath: v.socketPath,
+		Network:    v.network,
+		SSH:        v.ssh,
+		Status:     StatusRunning,
+		CreatedAt:  time.Now(),
+	}); err != nil {
+		logrus.Warnf("Failed to record VM state: %v", err)
+	}
+
+	logrus.Infof("VM %s started successfully", v.id)
+	return nil
+}
+
+// Stop stops the VM
+func (v *VM) Stop() error {
+	logrus.Info("Stopping VM...")
+
+	// Unmount shared directories while the guest is still reachable
+	for _, backend := range v.workspaces {
+		if err := backend.Close(); err != nil {
+			logrus.Warnf("Failed to release %s workspace: %v", backend.Name(), err)
+		}
+	}
+	v.workspaces = nil
+	v.prepared = nil
+
+	// The guest is killed, not shut down; flush what it keeps
+	if v.persist && v.sshClient != nil {
+		if err := v.sshClient.ExecuteCommand("sync"); err != nil {
+			logrus.Warnf("Failed to sync guest file systems: %v", err)
+		}
+	}
+
+	// Release the SSH connection
+	if v.sshClient != nil {
+		if err := v.sshClient.Close(); err != nil {
+			logrus.Debugf("Failed to close SSH connection: %v", err)
+		}
+		v.sshClient = nil
+	}
+
+	if v.attached {
+		if v.poolConn != nil {
+			v.poolConn.Close()
+			v.poolConn = nil
+		}
+		return nil
+	}
+
+	if v.fcProcess != nil {
+		v.fcProcess.Kill()
+		v.fcProcess = nil
+	}
+	if v.console != nil {
+		v.console.Close()
+		v.console = nil
+	}
+
+	removeState(v.id)
+
+	if v.rootfsLock != nil {
+		v.rootfsLock.Close()
+		v.rootfsLock = nil
+	}
+
+	// Cleanup network
+	if v.netManager != nil {
+		if err := v.netManager.Teardown(); err != nil {
+			logrus.Warnf("Failed to teardown network: %v", err)
+		}
+		v.netManager = nil
+	}
+	if v.lease != nil {
+		v.lease.Release()
+		v.lease = nil
+	}
+
+	return nil
+}
+
+// Pause pauses the vCPUs of the VM. Its memory and devices are kept, so
+// it continues where it left off when resumed, but it uses no CPU.
+func (v *VM) Pause() error {
+	state, err := LoadState(v.id)
+	if err != nil {
+		return err
+	}
+	switch state.Status {
+	case StatusPaused:
+		return fmt.Errorf("VM '%s' is already paused", v.id)
+	case StatusIdle:
+		return fmt.Errorf("VM '%s' is idle in the warm pool", v.id)
+	}
+
+	fcClient, err := v.client()
+	if err != nil {
+		return err
+	}
+	if err := fcClient.PauseVM(); err != nil {
+		return fmt.Errorf("failed to pause VM: %w", err)
+	}
+
+	return setStatus(v.id, StatusPaused)
+}
+
+// Resume resumes a VM paused with Pause
+func (v *VM) Resume() error {
+	paused, err := v.Paused()
+	if err != nil {
+		return err
+	}
+	if !paused {
+		return fmt.Errorf("VM '%s' is not paused", v.id)
+	}
+
+	fcClient, err := v.client()
+	if err != nil {
+		return err
+	}
+	if err := fcClient.ResumeVM(); err != nil {
+		return fmt.Errorf("failed to resume VM: %w", err)
+	}
+
+	return setStatus(v.id, StatusRunning)
+}
+
+// SetBalloon changes the memory reclaimed from the guest by the balloon
+// device of the VM
+func (v *VM) SetBalloon(targetMiB int) error {
+	fcClient, err := v.client()
+	if err != nil {
+		return err
+	}
+	if err := fcClient.UpdateBalloon(targetMiB); err != nil {
+		return fmt.Errorf("failed to resize balloon: %w", err)
+	}
+	return nil
+}
+
+// BalloonStats returns the memory statistics of the balloon device
+func (v *VM) BalloonStats() (*firecracker.BalloonStats, error) {
+	fcClient, err := v.client()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := fcClient.GetBalloonStats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balloon statistics: %w", err)
+	}
+	return stats, nil
+}
+
+// metricsFile is the file in the runtime directory of a VM that
+// Firecracker writes its metrics to
+const metricsFile = "metrics.json"
+
+// configureMetrics makes Firecracker write metrics into the runtime
+// directory of the VM
+func (v *VM) configureMetrics() error {
+	dir := vmDir(v.id)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, metricsFile)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return v.fcClient.ConfigureMetrics(path)
+}
+
+// Metrics returns the Firecracker metrics of the VM since it started
+func (v *VM) Metrics() (*metrics.Metrics, error) {
+	// Include what happened since the last periodic flush
+	if fcClient, err := v.client(); err == nil {
+		if err := fcClient.FlushMetrics(); err != nil {
+			logrus.Debugf("Failed to flush metrics: %v", err)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(vmDir(v.id), metricsFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("VM '%s' does not record metrics", v.id)
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	return metrics.Parse(f)
+}
+
+// balloonStatsInterval returns the statistics polling interval of a
+// balloon in whole seconds, 0 disabling statistics
+func balloonStatsInterval(b *config.BalloonConfig) int {
+	if b.StatsInterval <= 0 {
+		return 0
+	}
+	return int((b.StatsInterval + time.Second - 1) / time.Second)
+}
+
+// Paused reports whether the VM is paused
+func (v *VM) Paused() (bool, error) {
+	state, err := LoadState(v.id)
+	if err != nil {
+		return false, err
+	}
+	return state.Status == StatusPaused, nil
+}
+
+// client returns the Firecracker API client of the VM, connecting to the
+// API socket of VMs owned by another sear process
+func (v *VM) client() (*firecracker.Client, error) {
+	if v.fcClient != nil {
+		return v.fcClient, nil
+	}
+
+	fcClient, err := firecracker.NewClient(v.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Firecracker: %w", err)
+	}
+	v.fcClient = fcClient
+	return fcClient, nil
+}
+
+// setupNetwork sets up the host side of the VM network: the network of
+// the profile if it names a TAP device, otherwise one allocated for this
+// VM so that several VMs can run at once
+func (v *VM) setupNetwork() error {
+	networkConfig := effectiveNetworkConfig(v.profile)
+
+	if !hasNetwork(v.profile) {
+		v.network = networkConfig
+		return nil
+	}
+
+	if !hasStaticNetwork(v.profile) {
+		lease, err := v.leaseNetwork()
+		if err != nil {
+			return fmt.Errorf("failed to allocate network: %w", err)
+		}
+		v.lease = lease
+		networkConfig.TAPDevice = lease.TAPDevice
+		networkConfig.TAPIP = lease.TAPIP
+		networkConfig.GuestIP = lease.GuestIP
+		networkConfig.GatewayIP = lease.GatewayIP
+	}
+	v.network = networkConfig
+
 	v.netManager = network.NewManager(
 		networkConfig.TAPDevice,
 		networkConfig.TAPIP,
+		networkConfig.GuestIP,
 		networkConfig.GatewayIP,
 	)
 	if err := v.netManager.Setup(); err != nil {
 		return fmt.Errorf("failed to setup network: %w", err)
 	}
 
-	// Create Firecracker client
-	socketPath := os.Getenv("FIRECRACKER_API_SOCKET")
-	if socketPath == "" {
+	return nil
+}
+
+// leaseNetwork allocates a network slot. The guest of a snapshot keeps the
+// address it was provisioned with, so restoring needs the slot the
+// snapshot was taken in; if another VM holds it, this one boots from
+// scratch instead.
+func (v *VM) leaseNetwork() (*network.Lease, error) {
+	allocator := network.NewAllocator(filepath.Join(RuntimeDir(), "network"))
+
+	if v.restore != nil {
+		lease, err := allocator.Acquire(v.restore.Slot)
+		if err == nil {
+			return lease, nil
+		}
+		logrus.Infof("The network of the snapshot is in use by another VM, booting from scratch: %v", err)
+		v.restore = nil
+	}
+
+	return allocator.AcquireAny()
+}
+
+// startFirecracker starts a Firecracker process for the VM and connects
+// to it. If FIRECRACKER_API_SOCKET is set, or no firecracker binary is
+// found, the externally started process listening there is used instead;
+// it can only run one VM.
+func (v *VM) startFirecracker() error {
+	var socketPath string
+	if binary := firecrackerBinary(); binary != "" {
+		dir := vmDir(v.id)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fmt.Errorf("failed to create runtime directory: %w", err)
+		}
+		proc, err := firecracker.StartProcess(binary, filepath.Join(dir, "firecracker.socket"))
+		if err != nil {
+			return err
+		}
+		v.fcProcess = proc
+		v.captureConsole()
+		socketPath = proc.SocketPath()
+	} else if socketPath = os.Getenv("FIRECRACKER_API_SOCKET"); socketPath == "" {
 		socketPath = "/tmp/firecracker.socket"
 	}
 
@@ -74,31 +588,103 @@ func (v *VM) Start() error {
 		return fmt.Errorf("failed to connect to Firecracker: %w", err)
 	}
 	v.fcClient = fcClient
+	v.socketPath = socketPath
 
-	// Configure logger
-	if err := fcClient.ConfigureLogger("/tmp/sear-firecracker.log", "Debug"); err != nil {
-		logrus.Warnf("Failed to configure logger: %v", err)
+	return nil
+}
+
+// firecrackerBinary returns the Firecracker binary to start for a VM, or
+// "" if the externally started process is used
+func firecrackerBinary() string {
+	if os.Getenv("FIRECRACKER_API_SOCKET") != "" {
+		return ""
 	}
+	binary, err := firecracker.Binary()
+	if err != nil {
+		logrus.Debugf("Not starting Firecracker: %v", err)
+		return ""
+	}
+	return binary
+}
+
+// boot configures the fresh Firecracker process and starts the instance
+func (v *VM) boot(rootfs string) error {
+	fcClient := v.fcClient
 
 	// Set boot source
 	kernelArgs := "console=ttyS0 reboot=k panic=1"
 	if v.profile.VM.KernelArgs != "" {
 		kernelArgs = v.profile.VM.KernelArgs
 	}
+	if v.generatesSSHKey() {
+		arg, err := v.generateSSHKey()
+		if err != nil {
+			return err
+		}
+		kernelArgs += " " + arg
+	}
+
+	var initrd string
+	if v.profile.VM.Agent {
+		path, err := v.prepareAgent()
+		if err != nil {
+			return err
+		}
+		initrd = path
+	}
 
-	if err := fcClient.SetBootSource(v.profile.VM.Kernel, kernelArgs); err != nil {
+	if err := fcClient.SetBootSource(v.profile.VM.Kernel, initrd, kernelArgs); err != nil {
 		return fmt.Errorf("failed to set boot source: %w", err)
 	}
 
-	// Attach rootfs
-	if err := fcClient.AttachRootfs("rootfs", v.profile.VM.RootFS, true, false); err != nil {
+	// Set vCPUs and memory, keeping the Firecracker defaults for unset ones
+	if v.profile.VM.VCPUs > 0 && v.profile.VM.MemoryMiB > 0 {
+		if err := fcClient.SetMachineConfig(v.profile.VM.VCPUs, v.profile.VM.MemoryMiB); err != nil {
+			return fmt.Errorf("failed to set machine config: %w", err)
+		}
+	}
+
+	if b := v.profile.VM.Balloon; b != nil {
+		if err := fcClient.ConfigureBalloon(b.TargetMiB, b.DeflateOnOOM, balloonStatsInterval(b)); err != nil {
+			return fmt.Errorf("failed to configure balloon: %w", err)
+		}
+	}
+
+	// Attach rootfs, through the snapshot alias if the VM will be
+	// snapshotted once provisioned
+	var err error
+	if v.snapshotKey != "" {
+		err = v.attachSnapshotRootfs(rootfs)
+	} else {
+		err = fcClient.AttachRootfs("rootfs", rootfs, true, false)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to attach rootfs: %w", err)
 	}
 
+	// Attach drives of workspaces prepared before boot
+	for _, drive := range v.drives {
+		if err := fcClient.AttachRootfs(drive.ID, drive.Path, false, drive.ReadOnly); err != nil {
+			return fmt.Errorf("failed to attach drive %s: %w", drive.ID, err)
+		}
+	}
+
 	// Attach network
-	mac := v.netManager.GetMACAddress()
-	if err := fcClient.AttachNetwork("net1", mac, v.netManager.TAPDevice); err != nil {
-		return fmt.Errorf("failed to attach network: %w", err)
+	if v.netManager != nil {
+		mac := v.netManager.GetMACAddress()
+		if err := fcClient.AttachNetwork("net1", mac, v.netManager.TAPDevice); err != nil {
+			return fmt.Errorf("failed to attach network: %w", err)
+		}
+	}
+
+	if err := v.configureMMDS(); err != nil {
+		return fmt.Errorf("failed to configure metadata service: %w", err)
+	}
+
+	if vsockConfig(v.profile) != nil {
+		if err := v.attachVsock(); err != nil {
+			return fmt.Errorf("failed to attach vsock device: %w", err)
+		}
 	}
 
 	// Start instance
@@ -106,74 +692,290 @@ func (v *VM) Start() error {
 		return fmt.Errorf("failed to start instance: %w", err)
 	}
 
-	logrus.Info("VM started successfully")
 	return nil
 }
 
-// Stop stops the VM
-func (v *VM) Stop() error {
-	logrus.Info("Stopping VM...")
+// prepareRootfs returns the rootfs image to boot from: a copy of the base
+// image private to this VM in DiskDir, or the base image itself in persist
+// mode. The base image is locked so that a persistent VM never runs while
+// another VM uses or copies the same image.
+func (v *VM) prepareRootfs() (string, error) {
+	base, err := config.ExpandPath(v.profile.VM.RootFS)
+	if err != nil {
+		return "", fmt.Errorf("invalid rootfs path: %w", err)
+	}
+	if v.restore != nil {
+		base = v.restore.path(snapshotDisk)
+	}
 
-	// Cleanup network
-	if v.netManager != nil {
-		if err := v.netManager.Teardown(); err != nil {
-			logrus.Warnf("Failed to teardown network: %v", err)
+	f, err := os.Open(base)
+	if err != nil {
+		return "", fmt.Errorf("failed to open rootfs: %w", err)
+	}
+
+	how := unix.LOCK_SH
+	if v.persist {
+		how = unix.LOCK_EX
+	}
+	if err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB); err != nil {
+		f.Close()
+		if v.persist {
+			return "", fmt.Errorf("rootfs %s is in use by another VM", base)
 		}
+		return "", fmt.Errorf("rootfs %s is in use by a VM started with --persist", base)
 	}
 
-	return nil
+	if v.persist {
+		logrus.Infof("Changes to %s will be kept", base)
+		v.rootfsLock = f
+		return base, nil
+	}
+	defer f.Close()
+
+	disks, err := DiskDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(disks, v.id)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create disk directory: %w", err)
+	}
+
+	start := time.Now()
+	clone := filepath.Join(dir, "rootfs"+filepath.Ext(base))
+	reflinked, err := fsutil.CloneFile(base, clone)
+	if err != nil {
+		return "", fmt.Errorf("failed to copy rootfs: %w", err)
+	}
+	if reflinked {
+		logrus.Debugf("Cloned rootfs to %s", clone)
+	} else {
+		logrus.Debugf("Copied rootfs to %s in %s", clone, time.Since(start).Round(time.Millisecond))
+	}
+
+	return clone, nil
 }
 
-// GetSSHClient returns an SSH client for the VM
+// GetSSHClient returns the control channel of the VM. The client is
+// created once and shared, so all callers reuse the same connection.
 func (v *VM) GetSSHClient() (*SSHClient, error) {
-	networkConfig := v.getEffectiveNetworkConfig()
+	if v.sshClient != nil {
+		return v.sshClient, nil
+	}
 
-	sshKeyPath := "sear_key"
-	if v.userHomeDir != "" {
-		sshKeyPath = filepath.Join(v.userHomeDir, ".config", "sear", "sear_key")
+	if v.profile.VM.Agent {
+		// The agent keeps the environment itself
+		v.sshClient = &SSHClient{client: agent.NewClient(v.dialAgent)}
+		return v.sshClient, nil
+	}
+
+	networkConfig := v.Network()
+
+	sshKeyPath, err := v.sshKeyPath()
+	if err != nil {
+		return nil, err
 	}
 
 	sshClient := ssh.NewClient(
 		networkConfig.GuestIP,
 		22,
-		"root",
+		v.sshUser(),
 		sshKeyPath,
 	)
+	if vsockConfig(v.profile) != nil {
+		sshClient.SetDialer(v.dialVsock)
+	}
 
-	return &SSHClient{client: sshClient}, nil
+	v.sshClient = &SSHClient{client: sshClient, sourceEnv: hasEnv(v.profile)}
+	return v.sshClient, nil
 }
 
-// MountDirectory mounts a directory into the VM using virtiofs
-func (v *VM) MountDirectory(sshClient *SSHClient, hostPath string) error {
-	logrus.Infof("Mounting directory: %s", hostPath)
+// defaultMountPoint is where the current directory appears in the guest
+const defaultMountPoint = "/host"
 
-	// Get absolute path
-	absPath, err := filepath.Abs(hostPath)
-	if err != nil {
-		return fmt.Errorf("failed to get absolute path: %w", err)
+// Mounts returns the directories shared with the VM: cwd at the workspace
+// target, then the profile mounts, then extra. A later mount replaces an
+// earlier one with the same target.
+func (v *VM) Mounts(cwd string, extra ...config.MountConfig) []config.MountConfig {
+	workspaceMount := config.MountConfig{Source: cwd, Target: defaultMountPoint}
+	if ws := v.profile.Workspace; ws != nil {
+		if ws.Target != "" {
+			workspaceMount.Target = ws.Target
+		}
+		workspaceMount.Mode = ws.Mode
+	}
+
+	all := append([]config.MountConfig{workspaceMount}, v.profile.Mounts...)
+	all = append(all, extra...)
+
+	var mounts []config.MountConfig
+	for _, m := range all {
+		if m.Source == "" {
+			continue
+		}
+		replaced := false
+		for i := range mounts {
+			if mounts[i].Target == m.Target {
+				mounts[i] = m
+				replaced = true
+			}
+		}
+		if !replaced {
+			mounts = append(mounts, m)
+		}
+	}
+	return mounts
+}
+
+// PrepareMounts sets up sharing of host directories before the VM starts,
+// for backends that need it such as image mode. It must be called before
+// Start; MountDirectory then mounts the directories in the guest.
+func (v *VM) PrepareMounts(mounts []config.MountConfig) error {
+	v.mounts = mounts
+	for _, mc := range mounts {
+		backend, m, err := v.newWorkspace(mc)
+		if err != nil {
+			return err
+		}
+
+		preparer, ok := backend.(workspace.Preparer)
+		if !ok {
+			continue
+		}
+
+		drives, err := preparer.Prepare(m, vmDir(v.id))
+		if err != nil {
+			backend.Close()
+			return fmt.Errorf("%s: %s backend: %w", m.Source, backend.Name(), err)
+		}
+
+		if v.prepared == nil {
+			v.prepared = make(map[string]workspace.Backend)
+		}
+		v.prepared[m.Target] = backend
+		v.workspaces = append(v.workspaces, backend)
+		v.drives = append(v.drives, drives...)
+	}
+	return nil
+}
+
+// NeedsPreparation reports whether any of the mounts uses a backend that
+// must be prepared before the VM starts
+func (v *VM) NeedsPreparation(mounts []config.MountConfig) bool {
+	for _, mc := range mounts {
+		backend, _, err := v.newWorkspace(mc)
+		if err != nil {
+			continue
+		}
+		if _, ok := backend.(workspace.Preparer); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MountDirectory shares host directories with the VM using the workspace
+// backend selected by each mount or the profile. A mount that fails does
+// not prevent the others.
+func (v *VM) MountDirectory(sshClient *SSHClient, mounts []config.MountConfig) error {
+	// VMs from the warm pool learn their mounts once claimed
+	if v.attached {
+		v.mounts = mounts
+		if err := v.publishMetadata(); err != nil {
+			logrus.Warnf("Failed to publish metadata: %v", err)
+		}
+	}
+
+	var errs []error
+	for _, mc := range mounts {
+		if err := v.mountOne(sshClient, mc); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", mc.Source, err))
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	// Create mount point in VM
-	mountPoint := "/host"
-	if err := sshClient.ExecuteCommand(fmt.Sprintf("mkdir -p %s", mountPoint)); err != nil {
-		return fmt.Errorf("failed to create mount point: %w", err)
+// mountOne shares a single host directory with the VM
+func (v *VM) mountOne(sshClient *SSHClient, mc config.MountConfig) error {
+	logrus.Infof("Mounting directory: %s", mc.Source)
+
+	backend, m, err := v.newWorkspace(mc)
+	if err != nil {
+		return err
 	}
 
-	// Mount using virtiofs
-	// Note: This requires virtiofsd to be available in the VM
-	mountCmd := fmt.Sprintf("mount -t virtiofs -o allow_other,default_permissions sear_share %s", mountPoint)
-	if err := sshClient.ExecuteCommand(mountCmd); err != nil {
-		// Fallback to bind mount if virtiofs is not available
-		logrus.Warnf("virtiofs mount failed, trying bind mount: %v", err)
-		bindCmd := fmt.Sprintf("mount --bind %s %s", absPath, mountPoint)
-		if err := sshClient.ExecuteCommand(bindCmd); err != nil {
-			return fmt.Errorf("failed to mount directory: %w", err)
+	if prepared, ok := v.prepared[m.Target]; ok {
+		// Prepared backends are released by Stop, even if mounting fails
+		if err := prepared.Mount(sshClient.client, m); err != nil {
+			return fmt.Errorf("%s backend: %w", prepared.Name(), err)
 		}
+		backend = prepared
+	} else {
+		if _, ok := backend.(workspace.Preparer); ok {
+			return fmt.Errorf("the %s backend must be prepared before the VM starts", backend.Name())
+		}
+		if err := backend.Mount(sshClient.client, m); err != nil {
+			backend.Close()
+			return fmt.Errorf("%s backend: %w", backend.Name(), err)
+		}
+		v.workspaces = append(v.workspaces, backend)
 	}
 
+	access := "read-write"
+	if m.ReadOnly {
+		access = "read-only"
+	}
+	logrus.Infof("Mounted %s at %s using %s (%s)", m.Source, m.Target, backend.Name(), access)
 	return nil
 }
 
+// workspaceMode returns the backend a mount uses: its own mode, the
+// profile workspace mode or the default
+func (v *VM) workspaceMode(mc config.MountConfig) string {
+	if mc.Mode != "" {
+		return mc.Mode
+	}
+	if ws := v.profile.Workspace; ws != nil && ws.Mode != "" {
+		return ws.Mode
+	}
+	return workspace.DefaultMode
+}
+
+// newWorkspace creates the backend for sharing a host directory
+func (v *VM) newWorkspace(mc config.MountConfig) (workspace.Backend, workspace.Mount, error) {
+	source, err := config.ExpandPath(mc.Source)
+	if err != nil {
+		return nil, workspace.Mount{}, fmt.Errorf("invalid mount source %s: %w", mc.Source, err)
+	}
+	if info, err := os.Stat(source); err != nil {
+		return nil, workspace.Mount{}, err
+	} else if !info.IsDir() {
+		return nil, workspace.Mount{}, fmt.Errorf("%s is not a directory", source)
+	}
+
+	target := mc.Target
+	if target == "" {
+		target = defaultMountPoint
+	}
+
+	var opts workspace.Options
+	if ws := v.profile.Workspace; ws != nil {
+		opts = workspace.Options{
+			Conflict:     ws.Conflict,
+			Pull:         ws.Pull,
+			PullInterval: ws.PullInterval,
+			Extract:      ws.Extract,
+		}
+	}
+
+	backend, err := workspace.New(v.workspaceMode(mc), opts)
+	if err != nil {
+		return nil, workspace.Mount{}, err
+	}
+
+	return backend, workspace.Mount{Source: source, Target: target, ReadOnly: mc.ReadOnly}, nil
+}
+
 // ExecuteCommand executes a command in the VM
 func (v *VM) ExecuteCommand(cmd string) error {
 	sshClient, err := v.GetSSHClient()
@@ -183,16 +985,59 @@ func (v *VM) ExecuteCommand(cmd string) error {
 	return sshClient.ExecuteCommand(cmd)
 }
 
-// getEffectiveNetworkConfig returns the effective network configuration
-func (v *VM) getEffectiveNetworkConfig() *config.NetworkConfig {
-	if v.profile.Network != nil {
-		return v.profile.Network
+// Network returns the network configuration of the VM
+func (v *VM) Network() *config.NetworkConfig {
+	if v.network != nil {
+		return v.network
 	}
-	return &config.NetworkConfig{
+	return effectiveNetworkConfig(v.profile)
+}
+
+// hasNetwork reports whether VMs of a profile get a network device
+func hasNetwork(profile config.Profile) bool {
+	return profile.Network == nil || profile.Network.Mode != config.NetworkModeNone
+}
+
+// hasStaticNetwork reports whether a profile configures its own TAP
+// device instead of getting one allocated per VM
+func hasStaticNetwork(profile config.Profile) bool {
+	return profile.Network != nil && profile.Network.TAPDevice != ""
+}
+
+// effectiveNetworkConfig returns the network configuration of a profile,
+// with unset fields falling back to the defaults
+func effectiveNetworkConfig(profile config.Profile) *config.NetworkConfig {
+	nc := config.NetworkConfig{
 		TAPDevice: "tap0",
 		TAPIP:     "172.16.0.1",
 		GuestIP:   "172.16.0.2",
 		GatewayIP: "172.16.0.1",
 		DNSServer: "1.1.1.1",
 	}
+
+	p := profile.Network
+	if p == nil {
+		return &nc
+	}
+	nc.Mode = p.Mode
+	if p.TAPDevice != "" {
+		nc.TAPDevice = p.TAPDevice
+	}
+	if p.TAPIP != "" {
+		nc.TAPIP = p.TAPIP
+	}
+	if p.GuestIP != "" {
+		nc.GuestIP = p.GuestIP
+	}
+	if p.GatewayIP != "" {
+		nc.GatewayIP = p.GatewayIP
+	}
+	if p.HostInterface != "" {
+		nc.HostInterface = p.HostInterface
+	}
+	if p.DNSServer != "" {
+		nc.DNSServer = p.DNSServer
+	}
+
+	return &nc
 }
@@ -0,0 +1,68 @@
+package vm
+
+import (
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/config"
+	"github.com/nikiskaarup/sear/internal/firecracker"
+)
+
+// vsockSocket is the host socket of the vsock device in the runtime
+// directory of a VM
+const vsockSocket = "vsock.sock"
+
+// Defaults of the vsock device
+const (
+	defaultGuestCID     = 3
+	defaultVsockSSHPort = 22
+)
+
+// vsockConfig returns the vsock device of a profile, nil if it has none.
+// The agent implies a device with default settings.
+func vsockConfig(profile config.Profile) *config.VsockConfig {
+	if profile.VM.Vsock == nil && profile.VM.Agent {
+		return &config.VsockConfig{}
+	}
+	return profile.VM.Vsock
+}
+
+// vsockPorts returns the guest context ID and sshd port of a vsock device
+// with defaults applied
+func vsockPorts(vc *config.VsockConfig) (cid, sshPort uint32) {
+	cid, sshPort = defaultGuestCID, defaultVsockSSHPort
+	if vc.CID != 0 {
+		cid = vc.CID
+	}
+	if vc.SSHPort != 0 {
+		sshPort = vc.SSHPort
+	}
+	return cid, sshPort
+}
+
+// VsockPath returns the host socket of the vsock device of the VM
+func (v *VM) VsockPath() string {
+	return filepath.Join(vmDir(v.id), vsockSocket)
+}
+
+// attachVsock adds the vsock device of the profile. A Firecracker process
+// started by sear runs in the runtime directory of the VM, so it gets a
+// relative socket path: snapshots record the path, and a relative one lets
+// any VM restore them.
+func (v *VM) attachVsock() error {
+	cid, _ := vsockPorts(vsockConfig(v.profile))
+
+	udsPath := vsockSocket
+	if v.fcProcess == nil {
+		udsPath = v.VsockPath()
+	}
+
+	return v.fcClient.SetVsock(cid, udsPath)
+}
+
+// dialVsock connects to sshd in the guest over the vsock device
+func (v *VM) dialVsock(timeout time.Duration) (net.Conn, error) {
+	_, port := vsockPorts(vsockConfig(v.profile))
+	return firecracker.DialVsock(v.VsockPath(), port, timeout)
+}
@@ -0,0 +1,242 @@
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// fileServer implements the SFTP request handlers on top of an os.Root,
+// so that the guest cannot reach anything outside the shared directory,
+// not even through symbolic links
+type fileServer struct {
+	root *os.Root
+	// readOnly rejects every request that would modify the directory
+	readOnly bool
+}
+
+// newFileServer returns SFTP handlers serving the directory dir
+func newFileServer(dir string, readOnly bool) (*fileServer, sftp.Handlers, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, sftp.Handlers{}, err
+	}
+
+	s := &fileServer{root: root, readOnly: readOnly}
+	return s, sftp.Handlers{
+		FileGet:  s,
+		FilePut:  s,
+		FileCmd:  s,
+		FileList: s,
+	}, nil
+}
+
+// Close releases the root directory handle
+func (s *fileServer) Close() error {
+	return s.root.Close()
+}
+
+// rel converts an absolute SFTP path into a path relative to the root
+func rel(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// Fileread implements sftp.FileReader
+func (s *fileServer) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return s.root.Open(rel(r.Filepath))
+}
+
+// Filewrite implements sftp.FileWriter
+func (s *fileServer) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return s.openFile(r)
+}
+
+// OpenFile implements sftp.OpenFileWriter
+func (s *fileServer) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return s.openFile(r)
+}
+
+// openFile opens a file with the flags of an SFTP open request
+func (s *fileServer) openFile(r *sftp.Request) (*os.File, error) {
+	if s.readOnly {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	pflags := r.Pflags()
+
+	flag := os.O_WRONLY
+	if pflags.Read {
+		flag = os.O_RDWR
+	}
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+
+	perm := os.FileMode(0o644)
+	if r.AttrFlags().Permissions {
+		perm = r.Attributes().FileMode().Perm()
+	}
+
+	return s.root.OpenFile(rel(r.Filepath), flag, perm)
+}
+
+// Filecmd implements sftp.FileCmder
+func (s *fileServer) Filecmd(r *sftp.Request) error {
+	name := rel(r.Filepath)
+	if s.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	switch r.Method {
+	case "Setstat":
+		return s.setstat(name, r)
+	case "Rename":
+		if _, err := s.root.Lstat(rel(r.Target)); err == nil {
+			return os.ErrExist
+		}
+		return s.root.Rename(name, rel(r.Target))
+	case "Rmdir", "Remove":
+		return s.root.Remove(name)
+	case "Mkdir":
+		return s.root.Mkdir(name, 0o755)
+	case "Link":
+		return s.root.Link(name, rel(r.Target))
+	case "Symlink":
+		// For symlinks Filepath is the link target, verbatim
+		return s.root.Symlink(r.Filepath, rel(r.Target))
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename implements sftp.PosixRenameFileCmder
+func (s *fileServer) PosixRename(r *sftp.Request) error {
+	if s.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return s.root.Rename(rel(r.Filepath), rel(r.Target))
+}
+
+// setstat applies the attributes of a Setstat request
+func (s *fileServer) setstat(name string, r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+
+	if flags.Size {
+		f, err := s.root.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(int64(attrs.Size))
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := s.root.Chmod(name, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := s.root.Chtimes(name, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Filelist implements sftp.FileLister
+func (s *fileServer) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name := rel(r.Filepath)
+
+	switch r.Method {
+	case "List":
+		dir, err := s.root.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+
+		entries, err := dir.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(entries), nil
+
+	case "Stat":
+		info, err := s.root.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Lstat implements sftp.LstatFileLister
+func (s *fileServer) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := s.root.Lstat(rel(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+// Readlink implements sftp.ReadlinkFileLister
+func (s *fileServer) Readlink(p string) (string, error) {
+	return s.root.Readlink(rel(p))
+}
+
+// listerAt serves a fixed list of entries
+type listerAt []os.FileInfo
+
+// ListAt implements sftp.ListerAt
+func (l listerAt) ListAt(dst []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(dst, l[offset:])
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// createTemp creates a new file with a random name starting with prefix
+// in the directory dir of root, like os.CreateTemp, and returns it with
+// its name relative to root
+func createTemp(root *os.Root, dir, prefix string) (*os.File, string, error) {
+	for range 1000 {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := root.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return f, name, nil
+	}
+	return nil, "", fmt.Errorf("failed to create a temporary file in %s", dir)
+}
@@ -0,0 +1,217 @@
+package workspace
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ignoreFiles are read from every directory of a synced tree, in order
+var ignoreFiles = []string{".gitignore", ".searignore"}
+
+// ignoreRule is a single pattern from an ignore file
+type ignoreRule struct {
+	// base is the directory of the ignore file, relative to the root
+	base     string
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// anchored patterns are matched against the path relative to base,
+	// others against the last path element only
+	anchored bool
+}
+
+// ignoreMatcher implements the subset of gitignore semantics needed to
+// decide which files of a workspace are synced: comments, negation,
+// directory-only patterns, anchoring, globs and "**". Ignore files are
+// loaded lazily per directory.
+type ignoreMatcher struct {
+	root string
+
+	mu    sync.Mutex
+	rules map[string][]ignoreRule
+}
+
+// newIgnoreMatcher creates a matcher for the tree rooted at root
+func newIgnoreMatcher(root string) *ignoreMatcher {
+	return &ignoreMatcher{
+		root:  root,
+		rules: make(map[string][]ignoreRule),
+	}
+}
+
+// Match reports whether the slash separated path rel, relative to the
+// root, is ignored. A path is also ignored if any of its parents is.
+func (m *ignoreMatcher) Match(rel string, isDir bool) bool {
+	rel = path.Clean(rel)
+	if rel == "." {
+		return false
+	}
+
+	parts := strings.Split(rel, "/")
+	for i := 1; i <= len(parts); i++ {
+		p := strings.Join(parts[:i], "/")
+		dir := i < len(parts) || isDir
+		if m.matchOne(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOne applies the rules of all ancestor directories to a single path;
+// the last matching rule wins
+func (m *ignoreMatcher) matchOne(rel string, isDir bool) bool {
+	ignored := false
+
+	dir := path.Dir(rel)
+	ancestors := []string{"."}
+	if dir != "." {
+		parts := strings.Split(dir, "/")
+		for i := 1; i <= len(parts); i++ {
+			ancestors = append(ancestors, strings.Join(parts[:i], "/"))
+		}
+	}
+
+	for _, ancestor := range ancestors {
+		for _, rule := range m.rulesFor(ancestor) {
+			if rule.matches(rel, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored
+}
+
+// rulesFor returns the rules defined in directory dir, loading them on
+// first use
+func (m *ignoreMatcher) rulesFor(dir string) []ignoreRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rules, ok := m.rules[dir]; ok {
+		return rules
+	}
+
+	var rules []ignoreRule
+	for _, name := range ignoreFiles {
+		rules = append(rules, loadIgnoreFile(filepath.Join(m.root, filepath.FromSlash(dir), name), dir)...)
+	}
+	m.rules[dir] = rules
+	return rules
+}
+
+// invalidate forgets the cached rules of dir, e.g. after an ignore file
+// in it changed
+func (m *ignoreMatcher) invalidate(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.rules, dir)
+}
+
+// loadIgnoreFile parses an ignore file; a missing file yields no rules
+func loadIgnoreFile(file, base string) []ignoreRule {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreLine(scanner.Text(), base); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// parseIgnoreLine parses one line of an ignore file
+func parseIgnoreLine(line, base string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{base: base}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// matches reports whether the rule applies to rel, relative to the root
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	if r.base != "." {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, r.base+"/")
+	}
+
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], path.Base(rel))
+		return ok
+	}
+
+	return matchSegments(r.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches path segments against pattern segments, where a
+// "**" segment matches any number of path segments
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
@@ -0,0 +1,66 @@
+package workspace
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	root := t.TempDir()
+
+	writeFile(t, filepath.Join(root, ".gitignore"), `
+# build output
+/target/
+*.log
+!keep.log
+node_modules/
+docs/**/*.tmp
+`)
+	writeFile(t, filepath.Join(root, ".searignore"), "secrets.env\n")
+	writeFile(t, filepath.Join(root, "sub", ".gitignore"), "local/\n/only-here\n")
+
+	m := newIgnoreMatcher(root)
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"target", true, true},
+		{"target/debug/app", false, true},
+		{"sub/target", true, false},
+		{"build.log", false, true},
+		{"sub/deep/trace.log", false, true},
+		{"keep.log", false, false},
+		{"node_modules", true, true},
+		{"web/node_modules/react/index.js", false, true},
+		{"node_modules", false, false},
+		{"docs/a/b/c.tmp", false, true},
+		{"docs/c.tmp", false, true},
+		{"other/c.tmp", false, false},
+		{"secrets.env", false, true},
+		{"sub/local/x", false, true},
+		{"local/x", false, false},
+		{"sub/only-here", false, true},
+		{"sub/x/only-here", false, false},
+		{"src/main.go", false, false},
+		{".", true, false},
+	}
+
+	for _, tt := range tests {
+		if got := m.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,599 @@
+package workspace
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/extfs"
+	"github.com/nikiskaarup/sear/internal/fsutil"
+	"github.com/nikiskaarup/sear/internal/ssh"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// imageFormat is bumped whenever the image layout changes, so that
+	// cached images from older versions are rebuilt
+	imageFormat = 1
+
+	// imageFreeBytes is the minimum space left in an image for the guest
+	// to write to; the image is sparse, so this costs no host disk space
+	imageFreeBytes = 1 << 30
+
+	// imageFreeInodes is the number of inodes left for new guest files
+	imageFreeInodes = 65536
+)
+
+// Drive is a block device a backend needs attached to the VM before boot
+type Drive struct {
+	// ID is the Firecracker drive identifier
+	ID string
+	// Path is the host path of the backing file
+	Path string
+	// ReadOnly attaches the drive read-only
+	ReadOnly bool
+}
+
+// Preparer is implemented by backends that need work on the host before
+// the VM boots. Prepare is called before Start and Mount after the guest
+// is reachable.
+type Preparer interface {
+	// Prepare readies m.Source and returns the drives to attach. dir is a
+	// private directory for files that live as long as the VM.
+	Prepare(m Mount, dir string) ([]Drive, error)
+}
+
+// manifestEntry records the host state of one path when an image was built
+type manifestEntry struct {
+	Dir     bool        `json:"dir,omitempty"`
+	Link    string      `json:"link,omitempty"`
+	Size    int64       `json:"size"`
+	ModTime int64       `json:"mtime"` // nanoseconds
+	Mode    os.FileMode `json:"mode"`
+}
+
+// manifest describes the host tree an image was built from, keyed by
+// slash separated path relative to the root
+type manifest struct {
+	Format    int                      `json:"format"`
+	FreeBytes int64                    `json:"free_bytes"`
+	Entries   map[string]manifestEntry `json:"entries"`
+}
+
+// entry converts a manifest entry to a comparable entry
+func (e manifestEntry) entry() *entry {
+	return &entry{
+		dir:     e.Dir,
+		link:    e.Link,
+		size:    e.Size,
+		modTime: time.Unix(0, e.ModTime).Unix(),
+		mode:    e.Mode,
+	}
+}
+
+// imageMount is a host directory packed into an ext2 image
+type imageMount struct {
+	source string
+	target string
+	label  string
+	// image is the file attached to the VM: a private working copy, or
+	// the cached image itself for read-only mounts
+	image    string
+	readOnly bool
+	// built is the host tree the image was built from
+	built  *manifest
+	ignore *ignoreMatcher
+
+	guest   Guest
+	mounted bool
+}
+
+// imageBackend packs the workspace into an ext2 image attached to the VM
+// as an extra drive. Images are cached per source directory; when file
+// sizes or modification times changed, only the changed entries are
+// written to the cached image, which is rebuilt only once it runs out of
+// room. Guest changes are discarded unless extraction is enabled.
+type imageBackend struct {
+	opts   Options
+	mounts map[string]*imageMount
+}
+
+func newImage(opts Options) *imageBackend {
+	return &imageBackend{opts: opts, mounts: make(map[string]*imageMount)}
+}
+
+// Name implements Backend
+func (b *imageBackend) Name() string {
+	return ModeImage
+}
+
+// Prepare implements Preparer
+func (b *imageBackend) Prepare(m Mount, dir string) ([]Drive, error) {
+	sum := sha256.Sum256([]byte(m.Source))
+	key := hex.EncodeToString(sum[:])[:16]
+
+	im := &imageMount{
+		source:   m.Source,
+		target:   m.Target,
+		label:    "sear-" + key[:8],
+		image:    filepath.Join(dir, "workspace-"+key[:8]+".ext2"),
+		readOnly: m.ReadOnly,
+		ignore:   newIgnoreMatcher(m.Source),
+	}
+
+	cacheDir, err := imageCacheDir(key)
+	if err != nil {
+		return nil, err
+	}
+	cached := filepath.Join(cacheDir, "image.ext2")
+
+	current, err := im.scanHost()
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", m.Source, err)
+	}
+
+	manifestPath := filepath.Join(cacheDir, "manifest.json")
+	previous, _ := loadManifest(manifestPath)
+	if previous != nil && (previous.Format != imageFormat || !fileExists(cached)) {
+		previous = nil
+	}
+
+	if previous != nil && sameManifest(previous, current) {
+		logrus.Infof("Reusing cached workspace image for %s", m.Source)
+	} else {
+		if err := im.refresh(cached, previous, current); err != nil {
+			return nil, err
+		}
+		if err := saveManifest(manifestPath, current); err != nil {
+			logrus.Warnf("Failed to save workspace image manifest: %v", err)
+		}
+	}
+	im.built = current
+
+	// Read-only mounts share the cached image, others get their own copy
+	// so that guest writes never reach the cache
+	if im.readOnly {
+		im.image = cached
+	} else {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		if _, err := fsutil.CloneFile(cached, im.image); err != nil {
+			return nil, fmt.Errorf("failed to copy workspace image: %w", err)
+		}
+	}
+
+	b.mounts[m.Source] = im
+	return []Drive{{ID: "workspace_" + key[:8], Path: im.image, ReadOnly: im.readOnly}}, nil
+}
+
+// Mount implements Backend
+func (b *imageBackend) Mount(guest Guest, m Mount) error {
+	im, ok := b.mounts[m.Source]
+	if !ok {
+		return fmt.Errorf("no image was prepared for %s", m.Source)
+	}
+
+	// Find the drive by label rather than by device name, which depends on
+	// the order Firecracker enumerates drives in
+	if mounter, ok := guest.(Mounter); ok {
+		if err := mounter.Mount("LABEL="+im.label, m.Target, im.readOnly); err != nil {
+			return fmt.Errorf("failed to mount workspace image: %w", err)
+		}
+	} else {
+		mountOpts := "-o rw"
+		if im.readOnly {
+			mountOpts = "-o ro"
+		}
+
+		script := fmt.Sprintf(`dev=$(blkid -L %[1]s 2>/dev/null || findfs LABEL=%[1]s 2>/dev/null) && mkdir -p %[2]s && mount %[3]s "$dev" %[2]s`,
+			ssh.Quote(im.label), ssh.Quote(m.Target), mountOpts)
+		if err := guest.ExecuteCommand(script); err != nil {
+			return fmt.Errorf("failed to mount workspace image: %w", err)
+		}
+	}
+
+	im.guest = guest
+	im.mounted = true
+	return nil
+}
+
+// Close implements Backend
+func (b *imageBackend) Close() error {
+	var errs []error
+	for _, im := range b.mounts {
+		if err := im.close(b.opts.Extract); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	b.mounts = nil
+	return errors.Join(errs...)
+}
+
+// close unmounts the image, extracts guest changes if requested and
+// removes the working copy
+func (im *imageMount) close(extract bool) error {
+	if !im.readOnly {
+		defer os.Remove(im.image)
+	}
+
+	if im.mounted {
+		// Flush the guest page cache so the image is consistent on disk
+		if err := im.guest.ExecuteCommand("sync; umount " + ssh.Quote(im.target)); err != nil {
+			logrus.Debugf("Failed to unmount workspace image: %v", err)
+		}
+		im.mounted = false
+	}
+
+	if !extract || im.readOnly {
+		return nil
+	}
+
+	logrus.Infof("Extracting workspace changes back to %s", im.source)
+	if err := im.extract(); err != nil {
+		return fmt.Errorf("failed to extract workspace changes: %w", err)
+	}
+	return nil
+}
+
+// refresh brings the cached image up to date with the host tree current:
+// in place if the tree it was built from is known and the image has room
+// for the changes, otherwise by building it anew
+func (im *imageMount) refresh(image string, previous, current *manifest) error {
+	start := time.Now()
+
+	if previous != nil {
+		changed, err := im.update(image, previous, current)
+		if err == nil {
+			logrus.Infof("Updated %d changed entries of the workspace image for %s in %s", changed, im.source, time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		if errors.Is(err, extfs.ErrNoRoom) {
+			logrus.Infof("Workspace image for %s has no room for the changes", im.source)
+		} else {
+			logrus.Warnf("Failed to update workspace image for %s: %v", im.source, err)
+		}
+	}
+
+	logrus.Infof("Building workspace image for %s", im.source)
+	if err := im.build(image, current); err != nil {
+		return err
+	}
+	logrus.Infof("Built workspace image with %d entries in %s", len(current.Entries), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// update writes the changes between the host trees previous and current
+// to a copy of image and puts the copy in place, so that VMs attaching the
+// image read-only never see it change. Unchanged files keep their inode
+// and data blocks. It returns the number of changed entries.
+func (im *imageMount) update(image string, previous, current *manifest) (int, error) {
+	unchanged := func(rel string) bool {
+		before, ok := previous.Entries[rel]
+		now, found := current.Entries[rel]
+		return ok && found && before == now
+	}
+
+	changed := 0
+	for rel := range current.Entries {
+		if !unchanged(rel) {
+			changed++
+		}
+	}
+	for rel := range previous.Entries {
+		if _, ok := current.Entries[rel]; !ok {
+			changed++
+		}
+	}
+
+	tmp := image + ".tmp"
+	if _, err := fsutil.CloneFile(image, tmp); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("failed to copy workspace image: %w", err)
+	}
+	if err := extfs.Update(im.source, tmp, im.options(current), unchanged); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return changed, os.Rename(tmp, image)
+}
+
+// build packs the host tree into image, replacing it atomically
+func (im *imageMount) build(image string, m *manifest) error {
+	tmp := image + ".tmp"
+	if err := extfs.Build(im.source, tmp, im.options(m)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to build workspace image: %w", err)
+	}
+	return os.Rename(tmp, image)
+}
+
+// options returns the image options packing exactly the paths of m
+func (im *imageMount) options(m *manifest) extfs.Options {
+	return extfs.Options{
+		Label: im.label,
+		Skip: func(rel string, isDir bool) bool {
+			_, ok := m.Entries[rel]
+			return !ok
+		},
+		FreeBytes:  m.FreeBytes,
+		FreeInodes: imageFreeInodes,
+	}
+}
+
+// scanHost records the host tree, skipping ignored paths and file types
+// that cannot be packed
+func (im *imageMount) scanHost() (*manifest, error) {
+	m := &manifest{Format: imageFormat, Entries: make(map[string]manifestEntry)}
+
+	var total int64
+	err := filepath.Walk(im.source, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(im.source, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		mode := info.Mode()
+		if !mode.IsDir() && !mode.IsRegular() && mode&os.ModeSymlink == 0 {
+			return nil
+		}
+		if rel == "lost+found" || im.ignore.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		e := manifestEntry{
+			Dir:     info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+			Mode:    mode.Perm(),
+		}
+		if mode&os.ModeSymlink != 0 {
+			if e.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		if mode.IsRegular() {
+			total += info.Size()
+		}
+		m.Entries[rel] = e
+		return nil
+	})
+
+	// Leave at least as much free space as the workspace takes, so that
+	// builds in the guest do not run out of room
+	m.FreeBytes = max(total, imageFreeBytes)
+	return m, err
+}
+
+// extract applies guest changes in the image to the host. A path is only
+// updated on the host if the host copy did not change since the image was
+// built; otherwise the host version is kept. The image is written by the
+// guest, so all host access goes through an os.Root of the source and
+// paths that would leave it are refused.
+func (im *imageMount) extract() error {
+	img, err := extfs.Open(im.image)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	root, err := os.OpenRoot(im.source)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	guest := make(map[string]*extfs.Entry)
+	if err := img.Walk(func(rel string, e *extfs.Entry) error {
+		guest[rel] = e
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var errs []error
+	changed := 0
+
+	// New and modified paths; Walk yields parents first, so directories
+	// are created before their content
+	if err := img.Walk(func(rel string, e *extfs.Entry) error {
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			errs = append(errs, fmt.Errorf("%s: path outside the workspace", rel))
+			return nil
+		}
+
+		ge := imageEntry(e)
+		if base, ok := im.built.Entries[rel]; ok && sameEntry(base.entry(), ge) {
+			return nil
+		}
+		if !im.hostUnchanged(root, rel) {
+			logrus.Warnf("Workspace conflict on %s: keeping the host version", rel)
+			return nil
+		}
+
+		changed++
+		if err := im.extractEntry(root, img, rel, e); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rel, err))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Deleted paths, children first
+	var removed []string
+	for rel := range im.built.Entries {
+		if _, ok := guest[rel]; !ok {
+			removed = append(removed, rel)
+		}
+	}
+	sortDeepestFirst(removed)
+	for _, rel := range removed {
+		if !im.hostUnchanged(root, rel) {
+			logrus.Warnf("Workspace conflict on %s: keeping the host version", rel)
+			continue
+		}
+		changed++
+		if err := root.Remove(filepath.FromSlash(rel)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("%s: %w", rel, err))
+		}
+	}
+
+	logrus.Infof("Extracted %d changed entries", changed)
+	return errors.Join(errs...)
+}
+
+// hostUnchanged reports whether the host copy of rel is still as it was
+// when the image was built
+func (im *imageMount) hostUnchanged(root *os.Root, rel string) bool {
+	name := filepath.FromSlash(rel)
+
+	var current *entry
+	if info, err := root.Lstat(name); err == nil {
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, _ = root.Readlink(name)
+		}
+		current = newEntry(info, link)
+	}
+
+	var base *entry
+	if e, ok := im.built.Entries[rel]; ok {
+		base = e.entry()
+	}
+	return sameEntry(base, current)
+}
+
+// extractEntry writes one image entry to the host
+func (im *imageMount) extractEntry(root *os.Root, img *extfs.Image, rel string, e *extfs.Entry) error {
+	name := filepath.FromSlash(rel)
+	logrus.Debugf("image: extracting %s", rel)
+
+	switch {
+	case e.Mode.IsDir():
+		if info, err := root.Lstat(name); err == nil && !info.IsDir() {
+			_ = root.Remove(name)
+		}
+		return root.MkdirAll(name, e.Mode.Perm()|0o700)
+
+	case e.Mode&os.ModeSymlink != 0:
+		_ = root.RemoveAll(name)
+		return root.Symlink(e.Link, name)
+
+	case e.Mode.IsRegular():
+		if info, err := root.Lstat(name); err == nil && info.IsDir() {
+			_ = root.RemoveAll(name)
+		}
+		tmp, tmpName, err := createTemp(root, filepath.Dir(name), ".sear-image-")
+		if err != nil {
+			return err
+		}
+		defer root.Remove(tmpName)
+
+		if err := img.WriteTo(e, tmp); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		if err := root.Chmod(tmpName, e.Mode.Perm()); err != nil {
+			return err
+		}
+		if err := root.Chtimes(tmpName, e.ModTime, e.ModTime); err != nil {
+			return err
+		}
+		return root.Rename(tmpName, name)
+	}
+
+	// Devices, FIFOs and sockets created in the guest are not extracted
+	return nil
+}
+
+// imageEntry converts an image entry to a comparable entry
+func imageEntry(e *extfs.Entry) *entry {
+	return &entry{
+		dir:     e.Mode.IsDir(),
+		link:    e.Link,
+		size:    e.Size,
+		modTime: e.ModTime.Unix(),
+		mode:    e.Mode.Perm(),
+	}
+}
+
+// sortDeepestFirst orders paths so that children come before parents
+func sortDeepestFirst(paths []string) {
+	slices.SortFunc(paths, func(a, b string) int {
+		return strings.Compare(b, a)
+	})
+}
+
+// imageCacheDir returns the cache directory of the images built from one
+// source directory
+func imageCacheDir(key string) (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate cache directory: %w", err)
+	}
+	dir := filepath.Join(base, "sear", "workspaces", key)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return dir, nil
+}
+
+func loadManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func saveManifest(path string, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// sameManifest reports whether two manifests describe the same tree
+func sameManifest(a, b *manifest) bool {
+	if a.Format != b.Format || a.FreeBytes != b.FreeBytes || len(a.Entries) != len(b.Entries) {
+		return false
+	}
+	for rel, e := range a.Entries {
+		if other, ok := b.Entries[rel]; !ok || other != e {
+			return false
+		}
+	}
+	return true
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
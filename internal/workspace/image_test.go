@@ -0,0 +1,100 @@
+package workspace
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nikiskaarup/sear/internal/extfs"
+)
+
+func TestExtractStaysInSource(t *testing.T) {
+	// The guest tree has out/x, the host has out as a link leading
+	// outside the workspace
+	guest, source, outside := t.TempDir(), t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(guest, "out", "x"), "guest")
+	writeFile(t, filepath.Join(guest, "ok"), "guest")
+	if err := os.Symlink(outside, filepath.Join(source, "out")); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(t.TempDir(), "image.ext2")
+	if err := extfs.Build(guest, image, extfs.Options{Label: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	im := &imageMount{
+		source: source,
+		image:  image,
+		built:  &manifest{Entries: make(map[string]manifestEntry)},
+	}
+	if err := im.extract(); err == nil {
+		t.Error("extract wrote through a link leading outside the workspace")
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("extract created %s outside the workspace", entries[0].Name())
+	}
+	if data, err := os.ReadFile(filepath.Join(source, "ok")); err != nil || string(data) != "guest" {
+		t.Errorf("ok = %q, %v; want it extracted", data, err)
+	}
+}
+
+func TestPrepareUpdatesImage(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	source := t.TempDir()
+	writeFile(t, filepath.Join(source, "keep.txt"), "keep")
+	writeFile(t, filepath.Join(source, "change.txt"), "before")
+
+	m := Mount{Source: source, Target: "/host", ReadOnly: true}
+	contents := func() map[string]string {
+		t.Helper()
+		drives, err := newImage(Options{}).Prepare(m, t.TempDir())
+		if err != nil {
+			t.Fatalf("Prepare: %v", err)
+		}
+		img, err := extfs.Open(drives[0].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+
+		got := make(map[string]string)
+		if err := img.Walk(func(rel string, e *extfs.Entry) error {
+			var buf strings.Builder
+			if e.Mode.IsRegular() {
+				if err := img.WriteTo(e, &buf); err != nil {
+					return err
+				}
+			}
+			got[rel] = buf.String()
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	contents()
+
+	writeFile(t, filepath.Join(source, "change.txt"), "after the change")
+	writeFile(t, filepath.Join(source, "new.txt"), "new")
+	if err := os.Remove(filepath.Join(source, "keep.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := contents()
+	want := map[string]string{"change.txt": "after the change", "new.txt": "new"}
+	if len(got) != len(want) {
+		t.Errorf("image holds %v, want %v", got, want)
+	}
+	for rel, content := range want {
+		if got[rel] != content {
+			t.Errorf("%s = %q, want %q", rel, got[rel], content)
+		}
+	}
+}
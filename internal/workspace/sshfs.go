@@ -0,0 +1,207 @@
+package workspace
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/ssh"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// sshfsMountTimeout bounds how long to wait for sshfs to mount
+const sshfsMountTimeout = 10 * time.Second
+
+// sshfs mounts host directories in the guest by running sshfs in passive
+// mode over an SSH session and serving its SFTP requests from sear. No
+// device or daemon is needed on the host and the guest only needs sshfs.
+type sshfs struct {
+	mounts []*sshfsMount
+}
+
+// sshfsMount is a single active sshfs mount
+type sshfsMount struct {
+	guest  Guest
+	target string
+	files  *fileServer
+	server *sftp.RequestServer
+	conn   *pipeConn
+	done   chan struct{}
+
+	// closing is set once the mount is torn down on purpose
+	closing atomic.Bool
+}
+
+func newSSHFS() *sshfs {
+	return &sshfs{}
+}
+
+// Name implements Backend
+func (b *sshfs) Name() string {
+	return ModeSSHFS
+}
+
+// Mount implements Backend
+func (b *sshfs) Mount(guest Guest, m Mount) error {
+	if err := guest.ExecuteCommand("command -v sshfs"); err != nil {
+		return fmt.Errorf("sshfs is not installed in the guest, add it to the rootfs (e.g. apt-get install sshfs)")
+	}
+
+	// sshfs 3.x calls the stdin/stdout mode "passive", 2.x calls it "slave"
+	passiveOpt := "slave"
+	if err := guest.ExecuteCommand("sshfs -h 2>&1 | grep -q passive"); err == nil {
+		passiveOpt = "passive"
+	}
+
+	if err := guest.ExecuteCommand(fmt.Sprintf("mkdir -p %s", ssh.Quote(m.Target))); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+
+	files, handlers, err := newFileServer(m.Source, m.ReadOnly)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", m.Source, err)
+	}
+
+	toGuestR, toGuestW := io.Pipe()
+	fromGuestR, fromGuestW := io.Pipe()
+	conn := &pipeConn{r: fromGuestR, w: toGuestW, closers: []io.Closer{toGuestR, fromGuestW}}
+
+	mount := &sshfsMount{
+		guest:  guest,
+		target: m.Target,
+		files:  files,
+		server: sftp.NewRequestServer(conn, handlers),
+		conn:   conn,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		if err := mount.server.Serve(); err != nil && err != io.EOF {
+			logrus.Debugf("SFTP server for %s stopped: %v", m.Target, err)
+		}
+	}()
+
+	// The sshfs process lives as long as the mount; its stderr is kept to
+	// explain failures
+	var stderr bytes.Buffer
+	var exitErr error
+	opts := "-o allow_other"
+	if m.ReadOnly {
+		opts += " -o ro"
+	}
+	cmd := fmt.Sprintf("sshfs -f -o %s %s sear:/ %s", passiveOpt, opts, ssh.Quote(m.Target))
+	go func() {
+		defer close(mount.done)
+		result, err := guest.Exec(cmd, ssh.ExecOptions{
+			Stdin:  toGuestR,
+			Stdout: fromGuestW,
+			Stderr: &stderr,
+		})
+		switch {
+		case err != nil:
+			exitErr = err
+		case !result.Success():
+			exitErr = fmt.Errorf("sshfs %s: %s", result, strings.TrimSpace(stderr.String()))
+		default:
+			exitErr = fmt.Errorf("sshfs exited")
+		}
+		conn.Close()
+	}()
+
+	if err := mount.waitMounted(); err != nil {
+		mount.close()
+		<-mount.done
+		if exitErr != nil {
+			return fmt.Errorf("failed to mount with sshfs: %w", exitErr)
+		}
+		return err
+	}
+
+	// Report the mount going away while the VM is still in use
+	go func() {
+		<-mount.done
+		if !mount.closing.Load() {
+			logrus.Warnf("Workspace mount at %s terminated: %v", m.Target, exitErr)
+		}
+	}()
+
+	b.mounts = append(b.mounts, mount)
+	return nil
+}
+
+// waitMounted polls the guest mount table until the sshfs mount appears
+func (m *sshfsMount) waitMounted() error {
+	entry := " " + mountsEscape(path.Clean(m.target)) + " fuse.sshfs "
+	check := "grep -Fqs -- " + ssh.Quote(entry) + " /proc/mounts"
+	deadline := time.Now().Add(sshfsMountTimeout)
+
+	for {
+		select {
+		case <-m.done:
+			return fmt.Errorf("sshfs exited before the mount was ready")
+		default:
+		}
+
+		if err := m.guest.ExecuteCommand(check); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for sshfs to mount %s", m.target)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// mountsEscape encodes a path the way /proc/mounts shows it, with white
+// space and backslashes as octal escapes
+func mountsEscape(p string) string {
+	return strings.NewReplacer(`\`, `\134`, " ", `\040`, "\t", `\011`, "\n", `\012`).Replace(p)
+}
+
+// close unmounts in the guest and tears down the SFTP server
+func (m *sshfsMount) close() {
+	m.closing.Store(true)
+
+	unmount := fmt.Sprintf("fusermount -u %[1]s 2>/dev/null || umount -l %[1]s", ssh.Quote(m.target))
+	if err := m.guest.ExecuteCommand(unmount); err != nil {
+		logrus.Debugf("Failed to unmount %s: %v", m.target, err)
+	}
+
+	m.conn.Close()
+	m.server.Close()
+	m.files.Close()
+}
+
+// Close implements Backend
+func (b *sshfs) Close() error {
+	for _, m := range b.mounts {
+		m.close()
+	}
+	b.mounts = nil
+	return nil
+}
+
+// pipeConn joins the two pipes to the sshfs process into the
+// io.ReadWriteCloser served by the SFTP server
+type pipeConn struct {
+	r       *io.PipeReader
+	w       *io.PipeWriter
+	closers []io.Closer
+}
+
+func (p *pipeConn) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *pipeConn) Write(b []byte) (int, error) { return p.w.Write(b) }
+
+func (p *pipeConn) Close() error {
+	p.r.Close()
+	p.w.Close()
+	for _, c := range p.closers {
+		c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package workspace
+
+import "testing"
+
+func TestMountsEscape(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"/host", "/host"},
+		{"/home/me/my project", `/home/me/my\040project`},
+		{"/a\tb\nc", `/a\011b\012c`},
+		{`/back\slash`, `/back\134slash`},
+		{"/[re]gex.*", "/[re]gex.*"},
+	}
+	for _, tt := range tests {
+		if got := mountsEscape(tt.path); got != tt.want {
+			t.Errorf("mountsEscape(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
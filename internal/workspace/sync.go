@@ -0,0 +1,798 @@
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// Conflict resolution rules for the sync backend
+const (
+	ConflictNewer = "newer"
+	ConflictHost  = "host"
+	ConflictGuest = "guest"
+)
+
+// Pull modes for the sync backend
+const (
+	// PullOnExit copies guest changes back when the VM is stopped
+	PullOnExit = "exit"
+	// PullContinuous also copies guest changes back periodically
+	PullContinuous = "continuous"
+)
+
+const (
+	// syncDebounce delays pushing host changes until events settle
+	syncDebounce = 300 * time.Millisecond
+
+	// defaultPullInterval is how often the guest is scanned in continuous mode
+	defaultPullInterval = 2 * time.Second
+)
+
+// entry is the state of one path on either side
+type entry struct {
+	dir     bool
+	link    string
+	size    int64
+	modTime int64
+	mode    os.FileMode
+}
+
+// newEntry builds an entry from a file info; link is the symlink target
+func newEntry(info os.FileInfo, link string) *entry {
+	return &entry{
+		dir:     info.IsDir(),
+		link:    link,
+		size:    info.Size(),
+		modTime: info.ModTime().Unix(),
+		mode:    info.Mode().Perm(),
+	}
+}
+
+// sameEntry reports whether two entries have the same content as far as
+// the sync is concerned. Modification times are compared in seconds, the
+// resolution SFTP offers.
+func sameEntry(a, b *entry) bool {
+	switch {
+	case a == nil || b == nil:
+		return a == b
+	case a.dir || b.dir:
+		return a.dir == b.dir
+	case a.link != "" || b.link != "":
+		return a.link == b.link
+	}
+	return a.size == b.size && a.modTime == b.modTime
+}
+
+// syncMount keeps a copy of a host directory in the guest in sync
+type syncMount struct {
+	sc     *sftp.Client
+	source string
+	// root confines all host access to source, so that paths and links
+	// coming from the guest cannot lead outside it
+	root     *os.Root
+	target   string
+	conflict string
+	ignore   *ignoreMatcher
+	// readOnly mounts are never copied back to the host
+	readOnly bool
+
+	// mu serialises reconciliation; base is the last state both sides
+	// agreed on, keyed by slash separated path relative to the root
+	mu   sync.Mutex
+	base map[string]*entry
+	// guestOwned holds the paths that were only in the guest at the
+	// initial scan; they are left alone until the host creates them
+	guestOwned map[string]bool
+
+	watcher *fsnotify.Watcher
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// syncBackend copies the workspace into the guest, pushes host changes as
+// they happen and pulls guest changes back on exit or continuously
+type syncBackend struct {
+	opts   Options
+	mounts []*syncMount
+}
+
+func newSync(opts Options) *syncBackend {
+	return &syncBackend{opts: opts}
+}
+
+// Name implements Backend
+func (b *syncBackend) Name() string {
+	return ModeSync
+}
+
+// Mount implements Backend
+func (b *syncBackend) Mount(guest Guest, m Mount) error {
+	conflict := b.opts.Conflict
+	switch conflict {
+	case "":
+		conflict = ConflictNewer
+	case ConflictNewer, ConflictHost, ConflictGuest:
+	default:
+		return fmt.Errorf("unknown conflict rule '%s' (supported: %s, %s, %s)", conflict, ConflictNewer, ConflictHost, ConflictGuest)
+	}
+
+	root, err := os.OpenRoot(m.Source)
+	if err != nil {
+		return err
+	}
+
+	sc, err := guest.SFTP()
+	if err != nil {
+		root.Close()
+		return err
+	}
+
+	if err := sc.MkdirAll(m.Target); err != nil {
+		sc.Close()
+		root.Close()
+		return fmt.Errorf("failed to create %s: %w", m.Target, err)
+	}
+
+	s := &syncMount{
+		sc:         sc,
+		source:     m.Source,
+		root:       root,
+		target:     m.Target,
+		conflict:   conflict,
+		ignore:     newIgnoreMatcher(m.Source),
+		readOnly:   m.ReadOnly,
+		base:       make(map[string]*entry),
+		guestOwned: make(map[string]bool),
+		stop:       make(chan struct{}),
+	}
+
+	start := time.Now()
+	if err := s.scan(true); err != nil {
+		sc.Close()
+		root.Close()
+		return fmt.Errorf("initial copy failed: %w", err)
+	}
+	logrus.Infof("Copied %d entries to %s in %s", len(s.base), m.Target, time.Since(start).Round(time.Millisecond))
+
+	if err := s.watch(); err != nil {
+		sc.Close()
+		root.Close()
+		return fmt.Errorf("failed to watch %s: %w", m.Source, err)
+	}
+
+	switch b.opts.Pull {
+	case "", PullOnExit:
+	case PullContinuous:
+		if s.readOnly {
+			break
+		}
+		interval := b.opts.PullInterval
+		if interval <= 0 {
+			interval = defaultPullInterval
+		}
+		s.wg.Add(1)
+		go s.pullLoop(interval)
+	default:
+		s.close(false)
+		return fmt.Errorf("unknown pull mode '%s' (supported: %s, %s)", b.opts.Pull, PullOnExit, PullContinuous)
+	}
+
+	b.mounts = append(b.mounts, s)
+	return nil
+}
+
+// Close implements Backend. It pushes pending host changes and pulls the
+// changes made in the guest before releasing the SFTP session.
+func (b *syncBackend) Close() error {
+	var errs []error
+	for _, s := range b.mounts {
+		if err := s.close(true); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	b.mounts = nil
+	return errors.Join(errs...)
+}
+
+// close stops watching and, if final is set, runs a last full scan
+func (s *syncMount) close(final bool) error {
+	close(s.stop)
+	if s.watcher != nil {
+		s.watcher.Close()
+	}
+	s.wg.Wait()
+
+	var err error
+	if final && !s.readOnly {
+		logrus.Infof("Syncing changes from %s back to %s", s.target, s.source)
+		if err = s.scan(false); err != nil {
+			err = fmt.Errorf("final sync of %s failed: %w", s.target, err)
+		}
+	}
+
+	s.sc.Close()
+	s.root.Close()
+	return err
+}
+
+// watch starts pushing host changes to the guest
+func (s *syncMount) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	s.watcher = watcher
+
+	if err := s.addWatches("."); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	s.wg.Add(1)
+	go s.watchLoop()
+	return nil
+}
+
+// addWatches watches rel and all directories below it that are not ignored
+func (s *syncMount) addWatches(rel string) error {
+	root := s.hostPath(rel)
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		r := s.relPath(p)
+		if s.ignore.Match(r, true) {
+			return filepath.SkipDir
+		}
+		return s.watcher.Add(p)
+	})
+}
+
+// watchLoop collects file system events and reconciles the affected
+// paths once they settle
+func (s *syncMount) watchLoop() {
+	defer s.wg.Done()
+
+	pending := make(map[string]bool)
+	timer := time.NewTimer(syncDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			rel := s.relPath(event.Name)
+			if name := path.Base(rel); name == ".gitignore" || name == ".searignore" {
+				s.ignore.invalidate(path.Dir(rel))
+			}
+			pending[rel] = true
+			timer.Reset(syncDebounce)
+
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Warnf("Workspace watcher error: %v", err)
+
+		case <-timer.C:
+			paths := make([]string, 0, len(pending))
+			for p := range pending {
+				paths = append(paths, p)
+			}
+			pending = make(map[string]bool)
+			sort.Strings(paths)
+
+			for _, p := range paths {
+				if err := s.reconcilePath(p); err != nil {
+					logrus.Warnf("Failed to sync %s: %v", p, err)
+				}
+			}
+		}
+	}
+}
+
+// pullLoop periodically reconciles the whole tree
+func (s *syncMount) pullLoop(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.scan(false); err != nil {
+				logrus.Warnf("Failed to sync %s: %v", s.target, err)
+			}
+		}
+	}
+}
+
+// reconcilePath reconciles a single changed host path, including its
+// subtree if it is a new directory
+func (s *syncMount) reconcilePath(rel string) error {
+	host, err := s.hostEntry(rel)
+	if err != nil {
+		return err
+	}
+	guest, err := s.guestEntry(rel)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	err = s.reconcile(rel, host, guest, false)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if host != nil && host.dir {
+		if err := s.addWatches(rel); err != nil {
+			logrus.Debugf("Failed to watch %s: %v", rel, err)
+		}
+		return s.scanTree(rel, false)
+	}
+	return nil
+}
+
+// scan reconciles the whole tree. The initial scan only copies host files
+// into the guest; files already present in the guest are left alone.
+func (s *syncMount) scan(initial bool) error {
+	return s.scanTree(".", initial)
+}
+
+// scanTree reconciles every path below rel
+func (s *syncMount) scanTree(rel string, initial bool) error {
+	hostEntries, err := s.walkHost(rel)
+	if err != nil {
+		return fmt.Errorf("failed to scan host: %w", err)
+	}
+	guestEntries, err := s.walkGuest(rel)
+	if err != nil {
+		return fmt.Errorf("failed to scan guest: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths := make(map[string]bool)
+	for p := range hostEntries {
+		paths[p] = true
+	}
+	for p := range guestEntries {
+		paths[p] = true
+	}
+	for p := range s.base {
+		if within(p, rel) {
+			paths[p] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	var errs []error
+	removed := ""
+	for _, p := range sorted {
+		// Everything below a directory removed on either side is gone
+		if removed != "" && within(p, removed) {
+			continue
+		}
+
+		wasDir := s.base[p] != nil && s.base[p].dir
+		if err := s.reconcile(p, hostEntries[p], guestEntries[p], initial); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p, err))
+			continue
+		}
+		if wasDir && s.base[p] == nil {
+			removed = p
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reconcile brings one path in sync given its state on both sides. Must
+// be called with mu held.
+func (s *syncMount) reconcile(rel string, host, guest *entry, initial bool) error {
+	base := s.base[rel]
+
+	if initial {
+		if host == nil {
+			// Not agreed state: the next scan would take it for a file
+			// deleted on the host and remove it from the guest
+			if guest != nil {
+				s.guestOwned[rel] = true
+			}
+			return nil
+		}
+		if sameEntry(host, guest) {
+			s.setBase(rel, host)
+			return nil
+		}
+		return s.push(rel, host)
+	}
+
+	if s.guestOwned[rel] {
+		if host == nil && guest != nil {
+			return nil
+		}
+		delete(s.guestOwned, rel)
+	}
+
+	hostChanged := !sameEntry(host, base)
+	guestChanged := !sameEntry(guest, base)
+
+	switch {
+	case !hostChanged && !guestChanged:
+		return nil
+	case hostChanged && !guestChanged:
+		return s.push(rel, host)
+	case guestChanged && !hostChanged:
+		if s.readOnly {
+			return nil
+		}
+		return s.pull(rel, guest)
+	case sameEntry(host, guest):
+		s.setBase(rel, host)
+		return nil
+	}
+
+	// Both sides changed differently
+	keepHost := s.readOnly || s.conflict == ConflictHost
+	if s.conflict == ConflictNewer {
+		keepHost = host != nil && (guest == nil || host.modTime >= guest.modTime)
+	}
+
+	if keepHost {
+		logrus.Warnf("Sync conflict on %s: keeping the host version", rel)
+		return s.push(rel, host)
+	}
+	logrus.Warnf("Sync conflict on %s: keeping the guest version", rel)
+	return s.pull(rel, guest)
+}
+
+// setBase records the agreed state of a path; nil forgets the path and
+// everything below it
+func (s *syncMount) setBase(rel string, e *entry) {
+	if e != nil {
+		s.base[rel] = e
+		return
+	}
+	for p := range s.base {
+		if within(p, rel) {
+			delete(s.base, p)
+		}
+	}
+}
+
+// push makes the guest match the host entry
+func (s *syncMount) push(rel string, host *entry) error {
+	remote := s.guestPath(rel)
+
+	if host == nil {
+		logrus.Debugf("sync: removing %s from guest", rel)
+		if err := s.sc.RemoveAll(remote); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		s.setBase(rel, nil)
+		return nil
+	}
+
+	logrus.Debugf("sync: pushing %s", rel)
+	switch {
+	case host.dir:
+		if info, err := s.sc.Lstat(remote); err == nil && !info.IsDir() {
+			_ = s.sc.Remove(remote)
+		}
+		if err := s.sc.MkdirAll(remote); err != nil {
+			return err
+		}
+		if err := s.sc.Chmod(remote, host.mode); err != nil {
+			return err
+		}
+
+	case host.link != "":
+		_ = s.sc.RemoveAll(remote)
+		if err := s.sc.Symlink(host.link, remote); err != nil {
+			return err
+		}
+
+	default:
+		if info, err := s.sc.Lstat(remote); err == nil && info.IsDir() {
+			_ = s.sc.RemoveAll(remote)
+		}
+		if err := uploadSyncFile(s.sc, s.root, filepath.FromSlash(rel), remote, host); err != nil {
+			return err
+		}
+	}
+
+	s.setBase(rel, host)
+	return nil
+}
+
+// pull makes the host match the guest entry. The path and entry come from
+// the guest, so the host is only written through s.root.
+func (s *syncMount) pull(rel string, guest *entry) error {
+	name := filepath.FromSlash(rel)
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("path outside the workspace")
+	}
+
+	if guest == nil {
+		logrus.Debugf("sync: removing %s from host", rel)
+		if err := s.root.RemoveAll(name); err != nil {
+			return err
+		}
+		s.setBase(rel, nil)
+		return nil
+	}
+
+	logrus.Debugf("sync: pulling %s", rel)
+	switch {
+	case guest.dir:
+		if info, err := s.root.Lstat(name); err == nil && !info.IsDir() {
+			_ = s.root.Remove(name)
+		}
+		if err := s.root.MkdirAll(name, guest.mode|0o700); err != nil {
+			return err
+		}
+
+	case guest.link != "":
+		_ = s.root.RemoveAll(name)
+		if err := s.root.Symlink(guest.link, name); err != nil {
+			return err
+		}
+
+	default:
+		if info, err := s.root.Lstat(name); err == nil && info.IsDir() {
+			_ = s.root.RemoveAll(name)
+		}
+		if err := downloadSyncFile(s.sc, s.guestPath(rel), s.root, name, guest); err != nil {
+			return err
+		}
+	}
+
+	s.setBase(rel, guest)
+	return nil
+}
+
+// uploadSyncFile copies the file name of root to the guest and applies its
+// mode and time
+func uploadSyncFile(sc *sftp.Client, root *os.Root, name, remote string, e *entry) error {
+	src, err := root.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := sc.OpenFile(remote, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.ReadFrom(src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	if err := sc.Chmod(remote, e.mode); err != nil {
+		return err
+	}
+	mtime := time.Unix(e.modTime, 0)
+	return sc.Chtimes(remote, mtime, mtime)
+}
+
+// downloadSyncFile copies a file from the guest to the file name of root
+// and applies its mode and time. The file is written next to its
+// destination and renamed into place so that host tools never see it half
+// written.
+func downloadSyncFile(sc *sftp.Client, remote string, root *os.Root, name string, e *entry) error {
+	src, err := sc.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dir := filepath.Dir(name)
+	if err := root.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, tmpName, err := createTemp(root, dir, ".sear-sync-")
+	if err != nil {
+		return err
+	}
+	defer root.Remove(tmpName)
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := root.Chmod(tmpName, e.mode); err != nil {
+		return err
+	}
+	mtime := time.Unix(e.modTime, 0)
+	if err := root.Chtimes(tmpName, mtime, mtime); err != nil {
+		return err
+	}
+	return root.Rename(tmpName, name)
+}
+
+// walkHost returns the entries below rel on the host, skipping ignored paths
+func (s *syncMount) walkHost(rel string) (map[string]*entry, error) {
+	entries := make(map[string]*entry)
+
+	err := filepath.Walk(s.hostPath(rel), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		r := s.relPath(p)
+		if r == "." {
+			return nil
+		}
+		if s.ignore.Match(r, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		e, err := s.hostEntry(r)
+		if err != nil || e == nil {
+			return err
+		}
+		entries[r] = e
+		return nil
+	})
+
+	return entries, err
+}
+
+// walkGuest returns the entries below rel in the guest, skipping ignored paths
+func (s *syncMount) walkGuest(rel string) (map[string]*entry, error) {
+	entries := make(map[string]*entry)
+
+	walker := s.sc.Walk(s.guestPath(rel))
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+
+		r := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), s.target), "/")
+		if r == "" {
+			continue
+		}
+
+		info := walker.Stat()
+		if s.ignore.Match(r, info.IsDir()) {
+			if info.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := s.sc.ReadLink(walker.Path())
+			if err != nil {
+				return nil, err
+			}
+			link = target
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+		entries[r] = newEntry(info, link)
+	}
+
+	return entries, nil
+}
+
+// hostEntry returns the state of rel on the host, nil if it does not exist
+// or is ignored
+func (s *syncMount) hostEntry(rel string) (*entry, error) {
+	name := filepath.FromSlash(rel)
+	info, err := s.root.Lstat(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if s.ignore.Match(rel, info.IsDir()) || strings.HasPrefix(path.Base(rel), ".sear-sync-") {
+		return nil, nil
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = s.root.Readlink(name); err != nil {
+			return nil, err
+		}
+	} else if !info.IsDir() && !info.Mode().IsRegular() {
+		return nil, nil
+	}
+	return newEntry(info, link), nil
+}
+
+// guestEntry returns the state of rel in the guest, nil if it does not
+// exist or is ignored
+func (s *syncMount) guestEntry(rel string) (*entry, error) {
+	info, err := s.sc.Lstat(s.guestPath(rel))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if s.ignore.Match(rel, info.IsDir()) {
+		return nil, nil
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = s.sc.ReadLink(s.guestPath(rel)); err != nil {
+			return nil, err
+		}
+	}
+	return newEntry(info, link), nil
+}
+
+// hostPath maps a relative path to the host
+func (s *syncMount) hostPath(rel string) string {
+	return filepath.Join(s.source, filepath.FromSlash(rel))
+}
+
+// guestPath maps a relative path to the guest
+func (s *syncMount) guestPath(rel string) string {
+	return path.Join(s.target, rel)
+}
+
+// relPath maps a host path to a relative slash separated path
+func (s *syncMount) relPath(p string) string {
+	r, err := filepath.Rel(s.source, p)
+	if err != nil {
+		return "."
+	}
+	return filepath.ToSlash(r)
+}
+
+// within reports whether p is dir or inside it
+func within(p, dir string) bool {
+	return dir == "." || p == dir || strings.HasPrefix(p, dir+"/")
+}
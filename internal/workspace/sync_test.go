@@ -0,0 +1,262 @@
+package workspace
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// gone marks a file that is deleted, or expected to be absent
+const gone = "\x00gone"
+
+// newTestSync returns a sync mount between two temporary directories, the
+// guest one served over an in-process SFTP session
+func newTestSync(t *testing.T, conflict string) *syncMount {
+	t.Helper()
+
+	source, target := t.TempDir(), t.TempDir()
+	root, err := os.OpenRoot(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	sc, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sc.Close()
+		server.Close()
+		root.Close()
+	})
+
+	return &syncMount{
+		sc:         sc,
+		source:     source,
+		root:       root,
+		target:     target,
+		conflict:   conflict,
+		ignore:     newIgnoreMatcher(source),
+		base:       make(map[string]*entry),
+		guestOwned: make(map[string]bool),
+		stop:       make(chan struct{}),
+	}
+}
+
+// applyFiles writes or, for gone, deletes files below root with the given
+// modification time
+func applyFiles(t *testing.T, root string, files map[string]string, mtime time.Time) {
+	t.Helper()
+	for rel, content := range files {
+		name := filepath.Join(root, rel)
+		if content == gone {
+			if err := os.Remove(name); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		writeFile(t, name, content)
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkFiles compares files below root with their expected content
+func checkFiles(t *testing.T, side, root string, want map[string]string) {
+	t.Helper()
+	for rel, content := range want {
+		data, err := os.ReadFile(filepath.Join(root, rel))
+		switch {
+		case content == gone && err == nil:
+			t.Errorf("%s: %s exists, want it absent", side, rel)
+		case content != gone && err != nil:
+			t.Errorf("%s: %s: %v", side, rel, err)
+		case content != gone && string(data) != content:
+			t.Errorf("%s: %s = %q, want %q", side, rel, data, content)
+		}
+	}
+}
+
+func TestSyncReconcile(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	earlier, later := start.Add(10*time.Minute), start.Add(20*time.Minute)
+
+	tests := []struct {
+		name     string
+		conflict string
+		// host and guest are the files before the initial scan,
+		// changeHost and changeGuest the changes made after it
+		host, guest             map[string]string
+		changeHost, changeGuest map[string]string
+		// hostNewer makes the host changes the more recent ones
+		hostNewer bool
+		// want holds the expected files, on both sides unless wantHost
+		// or wantGuest are set
+		want, wantHost, wantGuest map[string]string
+	}{
+		{
+			name:      "guest only files are left alone",
+			guest:     map[string]string{"notes.txt": "guest", "cache/data": "guest"},
+			wantHost:  map[string]string{"notes.txt": gone, "cache/data": gone},
+			wantGuest: map[string]string{"notes.txt": "guest", "cache/data": "guest"},
+		},
+		{
+			name: "host only files are copied",
+			host: map[string]string{"main.go": "package main", "sub/lib.go": "package sub"},
+			want: map[string]string{"main.go": "package main", "sub/lib.go": "package sub"},
+		},
+		{
+			name:       "host change is pushed",
+			host:       map[string]string{"a.txt": "one"},
+			changeHost: map[string]string{"a.txt": "host two"},
+			want:       map[string]string{"a.txt": "host two"},
+		},
+		{
+			name:        "guest change is pulled",
+			host:        map[string]string{"a.txt": "one"},
+			changeGuest: map[string]string{"a.txt": "guest two", "new.txt": "created"},
+			want:        map[string]string{"a.txt": "guest two", "new.txt": "created"},
+		},
+		{
+			name:       "deleted on the host",
+			host:       map[string]string{"a.txt": "one", "b.txt": "two"},
+			changeHost: map[string]string{"a.txt": gone},
+			want:       map[string]string{"a.txt": gone, "b.txt": "two"},
+		},
+		{
+			name:        "deleted in the guest",
+			host:        map[string]string{"a.txt": "one", "b.txt": "two"},
+			changeGuest: map[string]string{"a.txt": gone},
+			want:        map[string]string{"a.txt": gone, "b.txt": "two"},
+		},
+		{
+			name:        "conflict keeps the newer guest version",
+			conflict:    ConflictNewer,
+			host:        map[string]string{"a.txt": "one"},
+			changeHost:  map[string]string{"a.txt": "host"},
+			changeGuest: map[string]string{"a.txt": "guest"},
+			want:        map[string]string{"a.txt": "guest"},
+		},
+		{
+			name:        "conflict keeps the newer host version",
+			conflict:    ConflictNewer,
+			host:        map[string]string{"a.txt": "one"},
+			changeHost:  map[string]string{"a.txt": "host"},
+			changeGuest: map[string]string{"a.txt": "guest"},
+			hostNewer:   true,
+			want:        map[string]string{"a.txt": "host"},
+		},
+		{
+			name:        "conflict rule host",
+			conflict:    ConflictHost,
+			host:        map[string]string{"a.txt": "one"},
+			changeHost:  map[string]string{"a.txt": "host"},
+			changeGuest: map[string]string{"a.txt": "guest"},
+			want:        map[string]string{"a.txt": "host"},
+		},
+		{
+			name:        "conflict rule guest",
+			conflict:    ConflictGuest,
+			host:        map[string]string{"a.txt": "one"},
+			changeHost:  map[string]string{"a.txt": "host"},
+			changeGuest: map[string]string{"a.txt": "guest"},
+			hostNewer:   true,
+			want:        map[string]string{"a.txt": "guest"},
+		},
+		{
+			name:        "edit against delete",
+			conflict:    ConflictNewer,
+			host:        map[string]string{"a.txt": "one"},
+			changeHost:  map[string]string{"a.txt": gone},
+			changeGuest: map[string]string{"a.txt": "guest"},
+			want:        map[string]string{"a.txt": "guest"},
+		},
+		{
+			name:       "host creates a guest only file",
+			conflict:   ConflictNewer,
+			guest:      map[string]string{"a.txt": "guest"},
+			changeHost: map[string]string{"a.txt": "host"},
+			hostNewer:  true,
+			want:       map[string]string{"a.txt": "host"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflict := tt.conflict
+			if conflict == "" {
+				conflict = ConflictNewer
+			}
+			s := newTestSync(t, conflict)
+
+			applyFiles(t, s.source, tt.host, start)
+			applyFiles(t, s.target, tt.guest, start)
+			if err := s.scan(true); err != nil {
+				t.Fatalf("initial scan: %v", err)
+			}
+
+			hostTime, guestTime := earlier, later
+			if tt.hostNewer {
+				hostTime, guestTime = later, earlier
+			}
+			applyFiles(t, s.source, tt.changeHost, hostTime)
+			applyFiles(t, s.target, tt.changeGuest, guestTime)
+
+			// Twice: the second scan must find nothing left to do
+			for i := 0; i < 2; i++ {
+				if err := s.scan(false); err != nil {
+					t.Fatalf("scan: %v", err)
+				}
+			}
+
+			wantHost, wantGuest := tt.wantHost, tt.wantGuest
+			if wantHost == nil {
+				wantHost = tt.want
+			}
+			if wantGuest == nil {
+				wantGuest = tt.want
+			}
+			checkFiles(t, "host", s.source, wantHost)
+			checkFiles(t, "guest", s.target, wantGuest)
+		})
+	}
+}
+
+func TestPullStaysInSource(t *testing.T) {
+	s := newTestSync(t, ConflictNewer)
+	outside := t.TempDir()
+
+	// A link on the host the guest path leads through
+	if err := os.Symlink(outside, filepath.Join(s.source, "out")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(s.target, "out", "x"), "guest")
+
+	guest, err := s.guestEntry("out/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.pull("out/x", guest); err == nil {
+		t.Error("pull wrote through a link leading outside the workspace")
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("pull created %s outside the workspace", entries[0].Name())
+	}
+}
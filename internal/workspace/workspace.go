@@ -0,0 +1,87 @@
+package workspace
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nikiskaarup/sear/internal/ssh"
+	"github.com/pkg/sftp"
+)
+
+// Supported workspace backends
+const (
+	// ModeSSHFS exports the host directory with an SFTP server inside sear
+	// and mounts it in the guest with sshfs over the existing SSH link
+	ModeSSHFS = "sshfs"
+
+	// ModeSync copies the host directory into the guest and keeps both
+	// copies in sync, trading consistency for native file system speed
+	ModeSync = "sync"
+
+	// ModeImage packs the host directory into a file system image attached
+	// to the VM as a drive, optionally extracting guest changes on exit
+	ModeImage = "image"
+)
+
+// DefaultMode is the backend used when the profile does not choose one
+const DefaultMode = ModeSSHFS
+
+// Guest is the part of the VM control channel used by the backends
+type Guest interface {
+	ExecuteCommand(cmd string) error
+	Exec(cmd string, opts ssh.ExecOptions) (*ssh.ExecResult, error)
+	SFTP() (*sftp.Client, error)
+}
+
+// Mounter is implemented by guests that mount file systems without a
+// shell. source may be LABEL=<label>.
+type Mounter interface {
+	Mount(source, target string, readOnly bool) error
+}
+
+// Options holds backend specific settings
+type Options struct {
+	// Conflict is the sync conflict rule: newer, host or guest
+	Conflict string
+	// Pull selects when the sync backend copies guest changes back: on
+	// exit or continuously
+	Pull string
+	// PullInterval is the guest scan interval in continuous pull mode
+	PullInterval time.Duration
+	// Extract makes the image backend copy guest changes back to the host
+	// when the VM is stopped
+	Extract bool
+}
+
+// Mount describes a host directory shared with the guest
+type Mount struct {
+	// Source is the absolute host path
+	Source string
+	// Target is the mount point inside the guest
+	Target string
+	// ReadOnly keeps the guest from changing the host directory
+	ReadOnly bool
+}
+
+// Backend shares host directories with the guest
+type Backend interface {
+	// Name identifies the backend in logs and errors
+	Name() string
+	// Mount makes m.Source available at m.Target in the guest
+	Mount(guest Guest, m Mount) error
+	// Close unmounts and releases everything the backend set up
+	Close() error
+}
+
+// New returns the backend for the given mode
+func New(mode string, opts Options) (Backend, error) {
+	switch mode {
+	case "", ModeSSHFS:
+		return newSSHFS(), nil
+	case ModeSync:
+		return newSync(opts), nil
+	case ModeImage:
+		return newImage(opts), nil
+	}
+	return nil, fmt.Errorf("unknown workspace mode '%s' (supported: %s, %s, %s)", mode, ModeSSHFS, ModeSync, ModeImage)
+}
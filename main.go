@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"os"
 
 	"github.com/nikiskaarup/sear/cmd"
@@ -9,6 +10,10 @@ import (
 
 func main() {
 	if err := cmd.Execute(); err != nil {
+		var exitErr *cmd.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		logrus.Errorf("Fatal error: %v", err)
 		os.Exit(1)
 	}
@@ -199,20 +199,6 @@ do_run() {
         exit 1
     fi
     
-    # Check if SSH key exists
-    local ssh_key="$HOME/.config/sear/sear_key"
-    if [ ! -f "$ssh_key" ]; then
-        print_warning "SSH key not found: $ssh_key"
-        print_status "Generating SSH key..."
-        mkdir -p "$HOME/.config/sear"
-        ssh-keygen -t rsa -b 4096 -f "$ssh_key" -N "" -C "sear vm access"
-        print_success "SSH key generated"
-        echo ""
-        echo "IMPORTANT: You need to add this public key to your VM's authorized_keys:"
-        echo "  cat $ssh_key.pub"
-        echo ""
-    fi
-    
     print_status "Starting SEAR..."
     "$sear_binary" run "$@"
 }